@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/repository"
+	"github.com/go-chi/chi/v5"
+)
+
+// csrfTokenHeader APIでCSRFトークンを送るヘッダ
+const csrfTokenHeader = "X-CSRF-Token"
+
+type apiUser struct {
+	ID          int       `json:"id"`
+	AccountName string    `json:"account_name"`
+	IsAdmin     bool      `json:"is_admin"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type apiComment struct {
+	ID        int       `json:"id"`
+	PostID    int       `json:"post_id"`
+	Comment   string    `json:"comment"`
+	CreatedAt time.Time `json:"created_at"`
+	User      apiUser   `json:"user"`
+}
+
+type apiPost struct {
+	ID           int          `json:"id"`
+	Body         string       `json:"body"`
+	Mime         string       `json:"mime"`
+	ImageURL     string       `json:"image_url"`
+	CreatedAt    time.Time    `json:"created_at"`
+	CommentCount int          `json:"comment_count"`
+	Comments     []apiComment `json:"comments"`
+	User         apiUser      `json:"user"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func toAPIUser(u User) apiUser {
+	return apiUser{
+		ID:          u.ID,
+		AccountName: u.AccountName,
+		IsAdmin:     u.Authority != 0,
+		CreatedAt:   u.CreatedAt,
+	}
+}
+
+func toAPIComments(comments []Comment) []apiComment {
+	cs := make([]apiComment, 0, len(comments))
+	for _, c := range comments {
+		cs = append(cs, apiComment{
+			ID:        c.ID,
+			PostID:    c.PostID,
+			Comment:   c.Comment,
+			CreatedAt: c.CreatedAt,
+			User:      toAPIUser(c.User),
+		})
+	}
+
+	return cs
+}
+
+func toAPIPosts(posts []Post) []apiPost {
+	ps := make([]apiPost, 0, len(posts))
+	for _, p := range posts {
+		ps = append(ps, apiPost{
+			ID:           p.ID,
+			Body:         p.Body,
+			Mime:         p.Mime,
+			ImageURL:     imageURL(p),
+			CreatedAt:    p.CreatedAt,
+			CommentCount: p.CommentCount,
+			Comments:     toAPIComments(p.Comments),
+			User:         toAPIUser(p.User),
+		})
+	}
+
+	return ps
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
+func writeAPIError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, struct {
+		Error apiError `json:"error"`
+	}{apiError{Code: code, Message: message}})
+}
+
+// writeAPIServerError 原因をログに残して500を返す
+func writeAPIServerError(w http.ResponseWriter, err error) {
+	log.Print(err)
+	writeAPIError(w, http.StatusInternalServerError, "internal_error", "サーバーでエラーが発生しました")
+}
+
+// acceptsJSON AcceptヘッダがJSONを受け付けるか
+//
+//	Acceptが無い場合は受け付けるとみなします
+func acceptsJSON(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return true
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q <= 0 {
+			continue
+		}
+
+		switch mediaType {
+		case "application/json", "application/*", "*/*":
+			return true
+		}
+	}
+
+	return false
+}
+
+// requireJSON JSONを受け付けないリクエストには406を返す
+func requireJSON(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsJSON(r) {
+			writeAPIError(w, http.StatusNotAcceptable, "not_acceptable", "application/jsonのみ返せます")
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func isJSONRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "application/json"
+}
+
+// apiAuth ログインしているユーザーとCSRFトークンを確認する
+//
+//	確認できなかった場合はエラーを返し、okにfalseを返します
+//	トークンで認証したリクエストはCookieを使わないので、CSRFトークンは確認しません
+func apiAuth(w http.ResponseWriter, r *http.Request, checkCSRF bool) (me User, ok bool) {
+	if u, ok := tokenUser(r); ok {
+		return u, true
+	}
+
+	me = getSessionUser(r)
+	if !isLogin(me) {
+		writeAPIError(w, http.StatusUnauthorized, "unauthorized", "ログインが必要です")
+		return User{}, false
+	}
+
+	if checkCSRF && !apiCheckCSRF(w, r, func() string { return r.FormValue("csrf_token") }) {
+		return User{}, false
+	}
+
+	return me, true
+}
+
+// apiCheckCSRF セッションで認証したリクエストのCSRFトークンを確認する
+//
+//	トークンはヘッダから読み、無ければformTokenを呼んでフォームから読みます
+//	トークンで認証したリクエストは確認しません
+func apiCheckCSRF(w http.ResponseWriter, r *http.Request, formToken func() string) bool {
+	if _, ok := tokenUser(r); ok {
+		return true
+	}
+
+	token := r.Header.Get(csrfTokenHeader)
+	if token == "" {
+		token = formToken()
+	}
+	if token != getCSRFToken(r) {
+		writeAPIError(w, http.StatusUnprocessableEntity, "invalid_csrf_token", "CSRFトークンが正しくありません")
+		return false
+	}
+
+	return true
+}
+
+func apiPostID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	pid, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeAPIError(w, http.StatusNotFound, "not_found", "投稿が見つかりません")
+		return 0, false
+	}
+
+	return pid, true
+}
+
+func apiGetMe(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuth(w, r, false)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		User      apiUser `json:"user"`
+		CSRFToken string  `json:"csrf_token"`
+	}{toAPIUser(me), getCSRFToken(r)})
+}
+
+func apiGetPosts(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	results, err := timelinePage(q.Get("cursor"), q.Get("max_created_at"))
+	if errors.Is(err, errInvalidCursor) || errors.Is(err, errInvalidMaxCreatedAt) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	posts, err := makePosts(results, getCSRFToken(r), false)
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	setNextCursor(w, results)
+	writeJSON(w, http.StatusOK, struct {
+		Posts      []apiPost `json:"posts"`
+		NextCursor string    `json:"next_cursor,omitempty"`
+	}{toAPIPosts(posts), nextCursor(results)})
+}
+
+func apiGetPost(w http.ResponseWriter, r *http.Request) {
+	pid, ok := apiPostID(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := loadPost(pid, getCSRFToken(r))
+	if errors.Is(err, repository.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "投稿が見つかりません")
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toAPIPosts([]Post{p})[0])
+}
+
+func apiGetComments(w http.ResponseWriter, r *http.Request) {
+	pid, ok := apiPostID(w, r)
+	if !ok {
+		return
+	}
+
+	p, err := loadPost(pid, getCSRFToken(r))
+	if errors.Is(err, repository.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "投稿が見つかりません")
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Comments []apiComment `json:"comments"`
+	}{toAPIComments(p.Comments)})
+}
+
+func apiGetUser(w http.ResponseWriter, r *http.Request) {
+	profile, err := loadUserProfile(chi.URLParam(r, "accountName"), getCSRFToken(r))
+	if errors.Is(err, repository.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "ユーザーが見つかりません")
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		User           apiUser   `json:"user"`
+		PostCount      int       `json:"post_count"`
+		CommentCount   int       `json:"comment_count"`
+		CommentedCount int       `json:"commented_count"`
+		Posts          []apiPost `json:"posts"`
+	}{toAPIUser(profile.User), profile.PostCount, profile.CommentCount, profile.CommentedCount, toAPIPosts(profile.Posts)})
+}
+
+// apiPostPosts multipart/form-dataのfileとbodyで投稿する
+func apiPostPosts(w http.ResponseWriter, r *http.Request) {
+	// ログインしていないリクエストのボディは読まない
+	me, ok := apiAuth(w, r, false)
+	if !ok {
+		return
+	}
+
+	// CSRFトークンがフォームにある場合もあるので、フォームを読んでから確かめる
+	form, err := readUploadForm(w, r)
+	if !apiCheckCSRF(w, r, func() string { return form.CSRFToken }) {
+		return
+	}
+
+	pid := 0
+	if err == nil {
+		pid, err = createPost(me, form)
+	}
+	var ie inputError
+	if errors.As(err, &ie) {
+		writeAPIError(w, http.StatusBadRequest, "invalid_image", ie.Error())
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	p, err := loadPost(pid, getCSRFToken(r))
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", "/api/v1/posts/"+strconv.Itoa(pid))
+	writeJSON(w, http.StatusCreated, toAPIPosts([]Post{p})[0])
+}
+
+// apiPostComments コメントする
+//
+//	bodyは {"comment": "..."} のJSONかcommentフォームで送ります
+func apiPostComments(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuth(w, r, true)
+	if !ok {
+		return
+	}
+
+	pid, ok := apiPostID(w, r)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Comment string `json:"comment"`
+	}{}
+	if isJSONRequest(r) {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_body", "JSONが正しくありません")
+			return
+		}
+	} else {
+		req.Comment = r.FormValue("comment")
+	}
+
+	_, err := loadPost(pid, "")
+	if errors.Is(err, repository.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "投稿が見つかりません")
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	c, err := commentRepo.Create(pid, me.ID, req.Comment)
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+	c.User = me
+
+	writeJSON(w, http.StatusCreated, toAPIComments([]Comment{c})[0])
+}
+
+// apiPostAdminBanned ユーザーをBANする
+//
+//	bodyは {"user_ids": [1, 2]} のJSONかuid[]フォームで送ります
+func apiPostAdminBanned(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuth(w, r, true)
+	if !ok {
+		return
+	}
+
+	if me.Authority == 0 {
+		writeAPIError(w, http.StatusForbidden, "forbidden", "管理者のみ実行できます")
+		return
+	}
+
+	req := struct {
+		UserIDs []int `json:"user_ids"`
+	}{}
+	if isJSONRequest(r) {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_body", "JSONが正しくありません")
+			return
+		}
+	} else {
+		err := r.ParseForm()
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_body", "フォームが正しくありません")
+			return
+		}
+		for _, id := range r.Form["uid[]"] {
+			intID, err := strconv.Atoi(id)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "invalid_body", "uid[]は整数のみです")
+				return
+			}
+			req.UserIDs = append(req.UserIDs, intID)
+		}
+	}
+
+	for _, id := range req.UserIDs {
+		err := userRepo.Ban(id)
+		if err != nil {
+			writeAPIServerError(w, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Banned []int `json:"banned"`
+	}{append([]int{}, req.UserIDs...)})
+}
+
+// apiRouter /api/v1 以下のJSON APIのルーティング
+//
+//	HTMLのハンドラと同じくセッションで認証し、書き込みにはCSRFトークンが必要です
+//	CSRFトークンはX-CSRF-Tokenヘッダかcsrf_tokenフォームで送ってください(GET /api/v1/me で取得できます)
+//	Authorization: Bearer ヘッダで個人用アクセストークンを送った場合は、CSRFトークン無しで書き込めます
+//	エラーは {"error": {"code": "...", "message": "..."}} の形で返します
+func apiRouter() chi.Router {
+	r := chi.NewRouter()
+	r.Use(requireJSON)
+	r.Use(tokenAuth)
+	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "APIが見つかりません")
+	})
+	r.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		writeAPIError(w, http.StatusMethodNotAllowed, "method_not_allowed", "このメソッドは使えません")
+	})
+
+	r.Get("/me", apiGetMe)
+	r.Get("/posts", apiGetPosts)
+	r.Post("/posts", apiPostPosts)
+	r.Get("/posts/{id}", apiGetPost)
+	r.Get("/posts/{id}/comments", apiGetComments)
+	r.Post("/posts/{id}/comments", apiPostComments)
+	r.Get(`/users/{accountName:[a-zA-Z]+}`, apiGetUser)
+	r.Post("/admin/banned", apiPostAdminBanned)
+	r.Get("/tokens", apiGetTokens)
+	r.Post("/tokens", apiPostTokens)
+	r.Delete("/tokens/{id}", apiDeleteToken)
+
+	return r
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func (c *testClient) request(method, path string, body io.Reader, header map[string]string) testResponse {
+	c.app.t.Helper()
+
+	req, err := http.NewRequest(method, c.app.server.URL+path, body)
+	if err != nil {
+		c.app.t.Fatal(err)
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+
+	return c.do(req)
+}
+
+func decodeJSON(t *testing.T, res testResponse, v interface{}) {
+	t.Helper()
+
+	if !strings.HasPrefix(res.contentType, "application/json") {
+		t.Fatalf("content type = %q, want application/json", res.contentType)
+	}
+	err := json.Unmarshal([]byte(res.body), v)
+	if err != nil {
+		t.Fatalf("%s: %s", err, res.body)
+	}
+}
+
+func postIDs(posts []apiPost) []int {
+	ids := make([]int, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+
+	return ids
+}
+
+func TestAPIGet(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		accept     string
+		wantStatus int
+		// wantCode エラーで返るcode(空なら確認しない)
+		wantCode string
+		check    func(t *testing.T, res testResponse)
+	}{
+		{
+			name:       "timeline",
+			path:       "/api/v1/posts",
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, res testResponse) {
+				body := struct {
+					Posts      []apiPost `json:"posts"`
+					NextCursor string    `json:"next_cursor"`
+				}{}
+				decodeJSON(t, res, &body)
+				if got := postIDs(body.Posts); len(got) != 2 || got[0] != 3 || got[1] != 1 {
+					t.Errorf("post ids = %v, want [3 1]", got)
+				}
+				if len(body.Posts[0].Comments) != 3 || body.Posts[0].CommentCount != 4 {
+					t.Errorf("comments = %d/%d, want 3/4", len(body.Posts[0].Comments), body.Posts[0].CommentCount)
+				}
+				if body.Posts[0].ImageURL != "/image/3.gif" || body.Posts[0].User.AccountName != "alice" {
+					t.Errorf("post = %+v", body.Posts[0])
+				}
+				if body.NextCursor != "" {
+					t.Errorf("next_cursor = %q, want empty", body.NextCursor)
+				}
+			},
+		},
+		{
+			name:       "timeline with invalid cursor",
+			path:       "/api/v1/posts?cursor=invalid",
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "invalid_parameter",
+		},
+		{
+			name:       "single post",
+			path:       "/api/v1/posts/3",
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, res testResponse) {
+				p := apiPost{}
+				decodeJSON(t, res, &p)
+				if p.ID != 3 || len(p.Comments) != 4 || p.Comments[0].Comment != "comment1" {
+					t.Errorf("post = %+v", p)
+				}
+			},
+		},
+		{
+			name:       "post by banned user",
+			path:       "/api/v1/posts/2",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "not_found",
+		},
+		{
+			name:       "comments",
+			path:       "/api/v1/posts/3/comments",
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, res testResponse) {
+				body := struct {
+					Comments []apiComment `json:"comments"`
+				}{}
+				decodeJSON(t, res, &body)
+				if len(body.Comments) != 4 || body.Comments[3].Comment != "comment4" {
+					t.Errorf("comments = %+v", body.Comments)
+				}
+			},
+		},
+		{
+			name:       "user profile",
+			path:       "/api/v1/users/alice",
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, res testResponse) {
+				body := struct {
+					User           apiUser   `json:"user"`
+					PostCount      int       `json:"post_count"`
+					CommentCount   int       `json:"comment_count"`
+					CommentedCount int       `json:"commented_count"`
+					Posts          []apiPost `json:"posts"`
+				}{}
+				decodeJSON(t, res, &body)
+				if body.User.AccountName != "alice" || body.PostCount != 2 || body.CommentCount != 4 || body.CommentedCount != 4 || len(body.Posts) != 2 {
+					t.Errorf("profile = %+v", body)
+				}
+				if strings.Contains(res.body, "passhash") || strings.Contains(res.body, calculatePasshash("alice", "alicepass")) {
+					t.Error("profile contains password hash")
+				}
+			},
+		},
+		{
+			name:       "banned user profile",
+			path:       "/api/v1/users/bob",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "not_found",
+		},
+		{
+			name:       "me without login",
+			path:       "/api/v1/me",
+			wantStatus: http.StatusUnauthorized,
+			wantCode:   "unauthorized",
+		},
+		{
+			name:       "unknown endpoint",
+			path:       "/api/v1/unknown",
+			wantStatus: http.StatusNotFound,
+			wantCode:   "not_found",
+		},
+		{
+			name:       "accept html",
+			path:       "/api/v1/posts",
+			accept:     "text/html",
+			wantStatus: http.StatusNotAcceptable,
+			wantCode:   "not_acceptable",
+		},
+		{
+			name:       "accept any",
+			path:       "/api/v1/posts/3",
+			accept:     "text/html, */*;q=0.8",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "accept json rejected by q",
+			path:       "/api/v1/posts/3",
+			accept:     "application/json;q=0",
+			wantStatus: http.StatusNotAcceptable,
+			wantCode:   "not_acceptable",
+		},
+	}
+
+	app := newTestApp(t)
+	seedTimeline(app)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := map[string]string{}
+			if tt.accept != "" {
+				header["Accept"] = tt.accept
+			}
+			res := app.newClient().request(http.MethodGet, tt.path, nil, header)
+			if res.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantCode != "" {
+				body := struct {
+					Error apiError `json:"error"`
+				}{}
+				decodeJSON(t, res, &body)
+				if body.Error.Code != tt.wantCode || body.Error.Message == "" {
+					t.Errorf("error = %+v, want code %q", body.Error, tt.wantCode)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, res)
+			}
+		})
+	}
+}
+
+func TestAPIWrite(t *testing.T) {
+	tests := []struct {
+		name        string
+		login       string
+		badCSRF     bool
+		method      string
+		path        string
+		contentType string
+		body        string
+		wantStatus  int
+		wantCode    string
+		check       func(t *testing.T, res testResponse)
+	}{
+		{
+			name:        "comment without login",
+			path:        "/api/v1/posts/1/comments",
+			contentType: "application/json",
+			body:        `{"comment": "hi"}`,
+			wantStatus:  http.StatusUnauthorized,
+			wantCode:    "unauthorized",
+		},
+		{
+			name:        "comment with invalid csrf token",
+			login:       "alice",
+			badCSRF:     true,
+			path:        "/api/v1/posts/1/comments",
+			contentType: "application/json",
+			body:        `{"comment": "hi"}`,
+			wantStatus:  http.StatusUnprocessableEntity,
+			wantCode:    "invalid_csrf_token",
+		},
+		{
+			name:        "comment on unknown post",
+			login:       "alice",
+			path:        "/api/v1/posts/100/comments",
+			contentType: "application/json",
+			body:        `{"comment": "hi"}`,
+			wantStatus:  http.StatusNotFound,
+			wantCode:    "not_found",
+		},
+		{
+			name:        "comment with broken json",
+			login:       "alice",
+			path:        "/api/v1/posts/1/comments",
+			contentType: "application/json",
+			body:        `{"comment":`,
+			wantStatus:  http.StatusBadRequest,
+			wantCode:    "invalid_body",
+		},
+		{
+			name:        "comment json",
+			login:       "alice",
+			path:        "/api/v1/posts/1/comments",
+			contentType: "application/json",
+			body:        `{"comment": "hi"}`,
+			wantStatus:  http.StatusCreated,
+			check: func(t *testing.T, res testResponse) {
+				c := apiComment{}
+				decodeJSON(t, res, &c)
+				if c.ID == 0 || c.PostID != 1 || c.Comment != "hi" || c.User.AccountName != "alice" {
+					t.Errorf("comment = %+v", c)
+				}
+
+				// 保存したコメントをそのまま返す
+				comments, err := commentRepo.ListByPost(1)
+				if err != nil || len(comments) != 1 {
+					t.Fatalf("ListByPost() = %+v, %v", comments, err)
+				}
+				if c.ID != comments[0].ID || !c.CreatedAt.Equal(comments[0].CreatedAt) {
+					t.Errorf("comment = %+v, want %+v", c, comments[0])
+				}
+			},
+		},
+		{
+			name:        "comment form",
+			login:       "alice",
+			path:        "/api/v1/posts/1/comments",
+			contentType: "application/x-www-form-urlencoded",
+			body:        "comment=hello",
+			wantStatus:  http.StatusCreated,
+		},
+		{
+			name:        "ban by non admin",
+			login:       "alice",
+			path:        "/api/v1/admin/banned",
+			contentType: "application/json",
+			body:        `{"user_ids": [2]}`,
+			wantStatus:  http.StatusForbidden,
+			wantCode:    "forbidden",
+		},
+		{
+			name:        "ban",
+			login:       "admin",
+			path:        "/api/v1/admin/banned",
+			contentType: "application/json",
+			body:        `{"user_ids": [2]}`,
+			wantStatus:  http.StatusOK,
+			check: func(t *testing.T, res testResponse) {
+				u, err := userRepo.FindByID(2)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if u.DelFlg == 0 {
+					t.Error("user is not banned")
+				}
+			},
+		},
+		{
+			name:       "post html route unchanged",
+			login:      "alice",
+			method:     http.MethodGet,
+			path:       "/posts/1",
+			wantStatus: http.StatusOK,
+			check: func(t *testing.T, res testResponse) {
+				if !strings.HasPrefix(res.contentType, "text/html") {
+					t.Errorf("content type = %q, want text/html", res.contentType)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.addUser("admin", "adminpass", 1, 0)
+			alice := app.addUser("alice", "alicepass", 0, 0)
+			app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/jpeg", Body: "post"})
+			c := app.newClient()
+
+			header := map[string]string{"Accept": "application/json"}
+			if tt.contentType != "" {
+				header["Content-Type"] = tt.contentType
+			}
+			if tt.login != "" {
+				c.login(tt.login, tt.login+"pass")
+				header[csrfTokenHeader] = "invalid"
+				if !tt.badCSRF {
+					header[csrfTokenHeader] = c.csrfToken()
+				}
+			}
+
+			method := tt.method
+			if method == "" {
+				method = http.MethodPost
+			}
+			res := c.request(method, tt.path, strings.NewReader(tt.body), header)
+			if res.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", res.status, tt.wantStatus, res.body)
+			}
+
+			if tt.wantCode != "" {
+				body := struct {
+					Error apiError `json:"error"`
+				}{}
+				decodeJSON(t, res, &body)
+				if body.Error.Code != tt.wantCode {
+					t.Errorf("error = %+v, want code %q", body.Error, tt.wantCode)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, res)
+			}
+		})
+	}
+}
+
+func TestAPIPostImage(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("alice", "alicepass", 0, 0)
+	c := app.newClient()
+	c.login("alice", "alicepass")
+	token := c.csrfToken()
+
+	res := c.postMultipart("/api/v1/posts", map[string]string{"body": "hello", "csrf_token": token}, &testFile{contentType: "text/plain", data: []byte("hello")})
+	if res.status != http.StatusBadRequest {
+		t.Fatalf("unsupported type: status = %d, want %d", res.status, http.StatusBadRequest)
+	}
+
+	res = c.postMultipart("/api/v1/posts", map[string]string{"body": "hello", "csrf_token": token}, &testFile{contentType: "image/png", data: testImage(t, "image/png")})
+	if res.status != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", res.status, http.StatusCreated, res.body)
+	}
+	if res.location != "/api/v1/posts/1" {
+		t.Errorf("location = %q, want /api/v1/posts/1", res.location)
+	}
+	p := apiPost{}
+	decodeJSON(t, res, &p)
+	if p.ID != 1 || p.Body != "hello" || p.ImageURL != "/image/1.png" {
+		t.Errorf("post = %+v", p)
+	}
+}
+
+// countingReader 読まれたバイト数を数える
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// TestAPIPostImageWithoutLogin ログインしていない投稿はボディを読まずに401を返す
+func TestAPIPostImageWithoutLogin(t *testing.T) {
+	newTestApp(t)
+
+	body := &countingReader{r: strings.NewReader("--x\r\nContent-Disposition: form-data; name=\"body\"\r\n\r\nhello\r\n--x--\r\n")}
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/posts", body)
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if body.n != 0 {
+		t.Errorf("read %d bytes of the body before authentication", body.n)
+	}
+}
+
+func TestAPIToken(t *testing.T) {
+	app := newTestApp(t)
+	alice := app.addUser("alice", "alicepass", 0, 0)
+	bob := app.addUser("bob", "bobpass", 0, 0)
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/jpeg", Body: "post"})
+
+	c := app.newClient()
+	c.login("alice", "alicepass")
+	sessionHeader := map[string]string{"Content-Type": "application/json", csrfTokenHeader: c.csrfToken()}
+
+	res := c.request(http.MethodPost, "/api/v1/tokens", strings.NewReader(`{"name": ""}`), sessionHeader)
+	if res.status != http.StatusBadRequest {
+		t.Fatalf("empty name: status = %d, want %d", res.status, http.StatusBadRequest)
+	}
+
+	res = c.request(http.MethodPost, "/api/v1/tokens", strings.NewReader(`{"name": "script"}`), map[string]string{"Content-Type": "application/json"})
+	if res.status != http.StatusUnprocessableEntity {
+		t.Fatalf("without csrf token: status = %d, want %d", res.status, http.StatusUnprocessableEntity)
+	}
+
+	res = c.request(http.MethodPost, "/api/v1/tokens", strings.NewReader(`{"name": "script"}`), sessionHeader)
+	if res.status != http.StatusCreated {
+		t.Fatalf("status = %d, want %d: %s", res.status, http.StatusCreated, res.body)
+	}
+	created := apiToken{}
+	decodeJSON(t, res, &created)
+	if created.ID == 0 || created.Name != "script" || !strings.HasPrefix(created.Token, tokenPrefix) {
+		t.Fatalf("token = %+v", created)
+	}
+
+	// トークンそのものは保存しない
+	tokens, err := tokenRepo.ListByUser(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 || tokens[0].TokenHash == created.Token || tokens[0].TokenHash != hashToken(created.Token) {
+		t.Fatalf("stored tokens = %+v", tokens)
+	}
+
+	res = c.request(http.MethodGet, "/api/v1/tokens", nil, nil)
+	if res.status != http.StatusOK || strings.Contains(res.body, created.Token) || !strings.Contains(res.body, `"script"`) {
+		t.Fatalf("list: status = %d: %s", res.status, res.body)
+	}
+
+	// Cookieを持たないクライアントからトークンで使う
+	anon := app.newClient()
+	bearer := func(token string) map[string]string {
+		return map[string]string{"Content-Type": "application/json", "Authorization": "Bearer " + token}
+	}
+
+	res = anon.request(http.MethodGet, "/api/v1/me", nil, bearer(created.Token))
+	me := struct {
+		User apiUser `json:"user"`
+	}{}
+	decodeJSON(t, res, &me)
+	if res.status != http.StatusOK || me.User.ID != alice.ID {
+		t.Fatalf("me: status = %d: %s", res.status, res.body)
+	}
+
+	res = anon.request(http.MethodPost, "/api/v1/posts/1/comments", strings.NewReader(`{"comment": "via token"}`), bearer(created.Token))
+	if res.status != http.StatusCreated {
+		t.Fatalf("comment without csrf token: status = %d, want %d: %s", res.status, http.StatusCreated, res.body)
+	}
+
+	res = anon.request(http.MethodGet, "/api/v1/me", nil, bearer(tokenPrefix+"unknown"))
+	if res.status != http.StatusUnauthorized || res.header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("unknown token: status = %d, want %d", res.status, http.StatusUnauthorized)
+	}
+
+	// 他のユーザーのトークンは削除できない
+	bc := app.newClient()
+	bc.login("bob", "bobpass")
+	res = bc.request(http.MethodDelete, "/api/v1/tokens/"+strconv.Itoa(created.ID), nil, map[string]string{csrfTokenHeader: bc.csrfToken()})
+	if res.status != http.StatusNotFound {
+		t.Fatalf("revoke other user's token: status = %d, want %d", res.status, http.StatusNotFound)
+	}
+
+	res = anon.request(http.MethodDelete, "/api/v1/tokens/"+strconv.Itoa(created.ID), nil, bearer(created.Token))
+	if res.status != http.StatusNoContent {
+		t.Fatalf("revoke: status = %d, want %d: %s", res.status, http.StatusNoContent, res.body)
+	}
+
+	res = anon.request(http.MethodGet, "/api/v1/me", nil, bearer(created.Token))
+	if res.status != http.StatusUnauthorized {
+		t.Fatalf("revoked token: status = %d, want %d", res.status, http.StatusUnauthorized)
+	}
+
+	// BANされたユーザーのトークンは使えない
+	bobToken := tokenPrefix + "bob"
+	_, err = tokenRepo.Create(bob.ID, "bob", hashToken(bobToken))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = userRepo.Ban(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res = anon.request(http.MethodGet, "/api/v1/me", nil, bearer(bobToken))
+	if res.status != http.StatusUnauthorized {
+		t.Fatalf("banned user's token: status = %d, want %d", res.status, http.StatusUnauthorized)
+	}
+}
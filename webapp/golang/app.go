@@ -1,25 +1,31 @@
 package main
 
 import (
+	"context"
 	cRand "crypto/rand"
 	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
 	_ "net/http/pprof"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"regexp"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/bradfitz/gomemcache/memcache"
 	gsm "github.com/bradleypeabody/gorilla-sessions-memcache"
 	"github.com/catatsuy/private-isu/webapp/golang/helpisu"
+	"github.com/catatsuy/private-isu/webapp/golang/repository"
 	"github.com/go-chi/chi/v5"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/gorilla/sessions"
@@ -27,62 +33,115 @@ import (
 )
 
 var (
-	db                *sqlx.DB
-	store             *gsm.MemcacheStore
-	userCache         = helpisu.NewCache[int, User]()
-	commentCountCache = helpisu.NewCache[int, int]()
-	commentCache      = helpisu.NewCache[int, []Comment]()
+	db          *sqlx.DB
+	store       sessions.Store
+	cacheBus    = newCacheBus()
+	cacheRemote = newCacheRemote()
+
+	userRepo    repository.UserRepo
+	postRepo    repository.PostRepo
+	commentRepo repository.CommentRepo
+	tokenRepo   repository.TokenRepo
+
+	// imageStore 投稿された画像の置き場所
+	imageStore repository.ImageStore
+	// imageVariantDir 縮小した画像を置くディレクトリ
+	imageVariantDir string
+	// keepImageMetadata 投稿された画像のEXIFなどを取り除かず、そのまま保存する
+	keepImageMetadata = os.Getenv("ISUCONP_KEEP_IMAGE_METADATA") != ""
 )
 
 const (
 	postsPerPage  = 20
 	ISO8601Format = "2006-01-02T15:04:05-07:00"
 	UploadLimit   = 10 * 1024 * 1024 // 10mb
+	warmUpTimeout = 5 * time.Second
 )
 
 var fmap = template.FuncMap{
 	"imageURL": imageURL,
 }
 
-type User struct {
-	ID          int       `db:"id"`
-	AccountName string    `db:"account_name"`
-	Passhash    string    `db:"passhash"`
-	Authority   int       `db:"authority"`
-	DelFlg      int       `db:"del_flg"`
-	CreatedAt   time.Time `db:"created_at"`
-}
-
-type Post struct {
-	ID           int       `db:"id"`
-	UserID       int       `db:"user_id"`
-	Imgdata      []byte    `db:"imgdata"`
-	Body         string    `db:"body"`
-	Mime         string    `db:"mime"`
-	CreatedAt    time.Time `db:"created_at"`
-	CommentCount int
-	Comments     []Comment
-	User         User
-	CSRFToken    string
-}
+type (
+	User    = repository.User
+	Post    = repository.Post
+	Comment = repository.Comment
+)
 
-type Comment struct {
-	ID        int       `db:"id"`
-	PostID    int       `db:"post_id"`
-	UserID    int       `db:"user_id"`
-	Comment   string    `db:"comment"`
-	CreatedAt time.Time `db:"created_at"`
-	User      User
+func init() {
+	memcacheClient := memcache.New(memcachedAddress())
+	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
+	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
 }
 
-func init() {
+func memcachedAddress() string {
 	memdAddr := os.Getenv("ISUCONP_MEMCACHED_ADDRESS")
 	if memdAddr == "" {
 		memdAddr = "localhost:11211"
 	}
-	memcacheClient := memcache.New(memdAddr)
-	store = gsm.NewMemcacheStore(memcacheClient, "iscogram_", []byte("sendagaya"))
-	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
+
+	return memdAddr
+}
+
+// newCacheBus 複数プロセスで動かす場合に、キャッシュの書き込みをmemcached経由で伝える
+//
+//	ISUCONP_CACHE_INVALIDATIONが空の場合は1プロセスで動かす前提でnilを返します
+func newCacheBus() *helpisu.InvalidationBus {
+	if os.Getenv("ISUCONP_CACHE_INVALIDATION") == "" {
+		return nil
+	}
+
+	return helpisu.NewInvalidationBus(memcache.New(memcachedAddress()), "iscogram_cache_")
+}
+
+// newCacheRemote キャッシュの2段目としてmemcachedを使い、複数プロセスでキャッシュを共有する
+//
+//	ISUCONP_CACHE_REMOTEにはエンコード方法(gob, json, msgpack)を指定します
+//	空の場合はnilを返し、ローカルのキャッシュだけを使います
+func newCacheRemote() *helpisu.RemoteTier {
+	var codec helpisu.Codec
+	switch os.Getenv("ISUCONP_CACHE_REMOTE") {
+	case "":
+		return nil
+	case "json":
+		codec = helpisu.JSONCodec
+	case "msgpack":
+		codec = helpisu.MsgpackCodec
+	default:
+		codec = helpisu.GobCodec
+	}
+
+	return helpisu.NewRemoteTier(memcache.New(memcachedAddress()), "iscogram_remote_", codec)
+}
+
+// imageDirFromEnv 画像のファイルを置くディレクトリ(nginxが/image/として配信する)
+func imageDirFromEnv() string {
+	dir := os.Getenv("ISUCONP_IMAGE_DIR")
+	if dir == "" {
+		dir = "../image"
+	}
+
+	return dir
+}
+
+// newImageStore ISUCONP_IMAGE_STOREに合わせて画像の置き場所を作る
+//
+//	file: imageDirFromEnvのディレクトリのファイルだけを使います
+//	db: posts.imgdataだけを使います
+//	migrate(デフォルト): ファイルを先に見て、無ければposts.imgdataから読んでファイルに書き出します
+func newImageStore(db *sqlx.DB) (repository.ImageStore, error) {
+	dir := imageDirFromEnv()
+
+	switch mode := os.Getenv("ISUCONP_IMAGE_STORE"); mode {
+	case "file":
+		return repository.NewFileImageStore(dir), nil
+	case "db":
+		return repository.NewMySQLImageStore(db), nil
+	case "", "migrate":
+		return repository.NewMigratingImageStore(repository.NewMySQLImageStore(db), repository.NewFileImageStore(dir)), nil
+	default:
+		return nil, fmt.Errorf("unknown ISUCONP_IMAGE_STORE: %q", mode)
+	}
 }
 
 func dbInitialize() {
@@ -90,6 +149,7 @@ func dbInitialize() {
 		"DELETE FROM users WHERE id > 1000",
 		"DELETE FROM posts WHERE id > 10000",
 		"DELETE FROM comments WHERE id > 100000",
+		"DELETE FROM personal_access_tokens WHERE user_id > 1000",
 		"UPDATE users SET del_flg = 0",
 		"UPDATE users SET del_flg = 1 WHERE id % 50 = 0",
 	}
@@ -98,12 +158,13 @@ func dbInitialize() {
 		_, _ = db.Exec(sql)
 	}
 
-	helpisu.ResetAllCache()
+	for _, r := range helpisu.ResetAllCacheWithReport() {
+		log.Printf("cache reset: name=%s entries=%d", r.Name, r.Entries)
+	}
 }
 
 func tryLogin(accountName, password string) *User {
-	u := User{}
-	err := db.Get(&u, "SELECT * FROM users WHERE account_name = ? AND del_flg = 0", accountName)
+	u, err := userRepo.FindActiveByAccountName(accountName)
 	if err != nil {
 		return nil
 	}
@@ -146,14 +207,9 @@ func getSessionUser(r *http.Request) User {
 		return User{}
 	}
 
-	u, ok := userCache.Get(uid.(int))
-	if !ok {
-		err := db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", uid)
-		if err != nil {
-			return User{}
-		}
-
-		userCache.Set(uid.(int), u)
+	u, err := userRepo.FindByID(uid.(int))
+	if err != nil {
+		return User{}
 	}
 
 	return u
@@ -172,77 +228,93 @@ func getFlash(w http.ResponseWriter, r *http.Request, key string) string {
 	}
 }
 
+// makePosts 投稿に投稿者、コメント数、コメントを付ける
+//
+//	投稿者がBANされている投稿は除き、最大postsPerPage件を返します
+//	ユーザー、コメント数、コメントはそれぞれまとめて取得します
 func makePosts(results []Post, csrfToken string, allComments bool) ([]Post, error) {
-	var posts []Post
-	var ok bool
+	userIDs := make([]int, 0, len(results))
+	for _, p := range results {
+		userIDs = append(userIDs, p.UserID)
+	}
+	users, err := userRepo.FindByIDs(userIDs)
+	if err != nil {
+		return nil, err
+	}
 
+	posts := make([]Post, 0, len(results))
 	for _, p := range results {
-		p.CommentCount, ok = commentCountCache.Get(p.ID)
+		u, ok := users[p.UserID]
 		if !ok {
-			err := db.Get(&p.CommentCount, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ?", p.ID)
-			if err != nil {
-				return nil, err
-			}
-			commentCountCache.Set(p.ID, p.CommentCount)
-		}
-
-		query := "SELECT * FROM `comments` WHERE `post_id` = ? ORDER BY `created_at` DESC"
-		if !allComments {
-			query += " LIMIT 3"
-		}
-		var comments []Comment
-		comments, ok = commentCache.Get(p.ID)
-		if ok && !allComments {
-			// コメントを3つ取るときだけキャッシュを使う
-			if (len(comments) - 3) > 0 {
-				comments = comments[:3]
-			}
+			return nil, fmt.Errorf("user not found: id=%d", p.UserID)
 		}
-		if !ok || allComments {
-			err := db.Select(&comments, query, p.ID)
-			if err != nil {
-				return nil, err
-			}
-			commentCache.Set(p.ID, comments)
+		if u.DelFlg != 0 {
+			continue
 		}
 
-		for i := 0; i < len(comments); i++ {
-			comments[i].User, ok = userCache.Get(comments[i].UserID)
-			if !ok {
-				err := db.Get(&comments[i].User, "SELECT * FROM `users` WHERE `id` = ?", comments[i].UserID)
-				if err != nil {
-					return nil, err
-				}
-
-				userCache.Set(comments[i].UserID, comments[i].User)
-			}
+		p.User = u
+		p.CSRFToken = csrfToken
+		posts = append(posts, p)
+		if len(posts) >= postsPerPage {
+			break
 		}
+	}
+	if len(posts) == 0 {
+		return nil, nil
+	}
 
-		// reverse
-		for i, j := 0, len(comments)-1; i < j; i, j = i+1, j-1 {
-			comments[i], comments[j] = comments[j], comments[i]
-		}
+	postIDs := make([]int, 0, len(posts))
+	for _, p := range posts {
+		postIDs = append(postIDs, p.ID)
+	}
 
-		p.Comments = comments
+	counts, err := commentRepo.CountByPosts(postIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		var ok bool
-		p.User, ok = userCache.Get(p.UserID)
-		if !ok {
-			err := db.Get(&p.User, "SELECT * FROM `users` WHERE `id` = ?", p.UserID)
+	var comments map[int][]Comment
+	if allComments {
+		comments = make(map[int][]Comment, len(posts))
+		for _, p := range posts {
+			comments[p.ID], err = commentRepo.ListByPost(p.ID)
 			if err != nil {
 				return nil, err
 			}
+		}
+	} else {
+		comments, err = commentRepo.LatestByPosts(postIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-			userCache.Set(p.UserID, p.User)
+	// コメントしたユーザーをまとめて取得する
+	userIDs = userIDs[:0]
+	for _, cs := range comments {
+		for _, c := range cs {
+			userIDs = append(userIDs, c.UserID)
 		}
+	}
+	users, err = userRepo.FindByIDs(userIDs)
+	if err != nil {
+		return nil, err
+	}
 
-		p.CSRFToken = csrfToken
+	for i := range posts {
+		p := &posts[i]
+		p.CommentCount = counts[p.ID]
 
-		if p.User.DelFlg == 0 {
-			posts = append(posts, p)
-		}
-		if len(posts) >= postsPerPage {
-			break
+		// 新しい順に返ってくるので、古い順に並べ直す
+		cs := comments[p.ID]
+		p.Comments = make([]Comment, len(cs))
+		for j, c := range cs {
+			var ok bool
+			c.User, ok = users[c.UserID]
+			if !ok {
+				return nil, fmt.Errorf("user not found: id=%d", c.UserID)
+			}
+			p.Comments[len(cs)-1-j] = c
 		}
 	}
 
@@ -289,6 +361,12 @@ func getTemplPath(filename string) string {
 
 func getInitialize(w http.ResponseWriter, r *http.Request) {
 	dbInitialize()
+
+	err := helpisu.WarmUpAll(r.Context(), warmUpTimeout)
+	if err != nil {
+		log.Print(err)
+	}
+
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -370,11 +448,13 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	exists := 0
-	// ユーザーが存在しない場合はエラーになるのでエラーチェックはしない
-	_ = db.Get(&exists, "SELECT 1 FROM users WHERE `account_name` = ?", accountName)
+	exists, err := userRepo.ExistsAccountName(accountName)
+	if err != nil {
+		log.Print(err)
+		return
+	}
 
-	if exists == 1 {
+	if exists {
 		session := getSession(r)
 		session.Values["notice"] = "アカウント名がすでに使われています"
 		_ = session.Save(r, w)
@@ -383,20 +463,14 @@ func postRegister(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)"
-	result, err := db.Exec(query, accountName, calculatePasshash(accountName, password))
+	uid, err := userRepo.Create(accountName, calculatePasshash(accountName, password))
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
 	session := getSession(r)
-	uid, err := result.LastInsertId()
-	if err != nil {
-		log.Print(err)
-		return
-	}
-	session.Values["user_id"] = int(uid)
+	session.Values["user_id"] = uid
 	session.Values["csrf_token"] = secureRandomStr(16)
 	_ = session.Save(r, w)
 
@@ -422,9 +496,7 @@ var indexTemp = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles
 func getIndex(w http.ResponseWriter, r *http.Request) {
 	me := getSessionUser(r)
 
-	results := []Post{}
-
-	err := db.Select(&results, "SELECT posts.id, `user_id`, `body`, `mime`, posts.created_at FROM `posts` JOIN `users` ON posts.user_id = users.id WHERE users.del_flg = 0 ORDER BY posts.created_at DESC LIMIT ?", postsPerPage)
+	results, err := postRepo.Recent(postsPerPage)
 	if err != nil {
 		log.Print(err)
 		return
@@ -436,6 +508,7 @@ func getIndex(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	setNextCursor(w, results)
 	_ = indexTemp.Execute(w, struct {
 		Posts     []Post
 		Me        User
@@ -451,69 +524,69 @@ var accountNameTemp = template.Must(template.New("layout.html").Funcs(fmap).Pars
 	getTemplPath("post.html"),
 ))
 
-func getAccountName(w http.ResponseWriter, r *http.Request) {
-	accountName := chi.URLParam(r, "accountName")
-	user := User{}
+// userProfile ユーザーページに表示する内容
+type userProfile struct {
+	User           User
+	Posts          []Post
+	PostCount      int
+	CommentCount   int
+	CommentedCount int
+}
 
-	err := db.Get(&user, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+// loadUserProfile BANされていないユーザーのページの内容を取得する
+//
+//	ユーザーが見つからない場合はrepository.ErrNotFoundを返します
+func loadUserProfile(accountName, csrfToken string) (userProfile, error) {
+	user, err := userRepo.FindActiveByAccountName(accountName)
 	if err != nil {
-		log.Print(err)
-		return
+		return userProfile{}, err
 	}
 
-	if user.ID == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
+	results, err := postRepo.ListByUser(user.ID)
+	if err != nil {
+		return userProfile{}, err
 	}
 
-	results := []Post{}
-
-	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC", user.ID)
+	posts, err := makePosts(results, csrfToken, false)
 	if err != nil {
-		log.Print(err)
-		return
+		return userProfile{}, err
 	}
 
-	posts, err := makePosts(results, getCSRFToken(r), false)
+	commentCount, err := commentRepo.CountByUser(user.ID)
 	if err != nil {
-		log.Print(err)
-		return
+		return userProfile{}, err
 	}
 
-	commentCount := 0
-	err = db.Get(&commentCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `user_id` = ?", user.ID)
+	postCount, err := postRepo.CountByUser(user.ID)
 	if err != nil {
-		log.Print(err)
-		return
+		return userProfile{}, err
 	}
 
-	postIDs := []int{}
-	err = db.Select(&postIDs, "SELECT `id` FROM `posts` WHERE `user_id` = ?", user.ID)
+	commentedCount, err := commentRepo.CountOnUserPosts(user.ID)
 	if err != nil {
-		log.Print(err)
-		return
+		return userProfile{}, err
 	}
-	postCount := len(postIDs)
 
-	commentedCount := 0
-	if postCount > 0 {
-		s := []string{}
-		for range postIDs {
-			s = append(s, "?")
-		}
-		placeholder := strings.Join(s, ", ")
+	return userProfile{
+		User:           user,
+		Posts:          posts,
+		PostCount:      postCount,
+		CommentCount:   commentCount,
+		CommentedCount: commentedCount,
+	}, nil
+}
 
-		// convert []int -> []interface{}
-		args := make([]interface{}, len(postIDs))
-		for i, v := range postIDs {
-			args[i] = v
-		}
+func getAccountName(w http.ResponseWriter, r *http.Request) {
+	accountName := chi.URLParam(r, "accountName")
 
-		err = db.Get(&commentedCount, "SELECT COUNT(*) AS count FROM `comments` WHERE `post_id` IN ("+placeholder+")", args...)
-		if err != nil {
-			log.Print(err)
-			return
-		}
+	profile, err := loadUserProfile(accountName, getCSRFToken(r))
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
+		return
 	}
 
 	me := getSessionUser(r)
@@ -525,7 +598,7 @@ func getAccountName(w http.ResponseWriter, r *http.Request) {
 		CommentCount   int
 		CommentedCount int
 		Me             User
-	}{posts, user, postCount, commentCount, commentedCount, me})
+	}{profile.Posts, profile.User, profile.PostCount, profile.CommentCount, profile.CommentedCount, me})
 }
 
 var postsTemp = template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
@@ -533,6 +606,10 @@ var postsTemp = template.Must(template.New("posts.html").Funcs(fmap).ParseFiles(
 	getTemplPath("post.html"),
 ))
 
+// getPosts 投稿一覧の続きを返す
+//
+//	cursorにはX-Next-Cursorヘッダで返したカーソルを指定します
+//	max_created_atはその時刻以前の投稿を返します(main.jsが使う古い方法)
 func getPosts(w http.ResponseWriter, r *http.Request) {
 	m, err := url.ParseQuery(r.URL.RawQuery)
 	if err != nil {
@@ -540,23 +617,17 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		log.Print(err)
 		return
 	}
+	cursor := m.Get("cursor")
 	maxCreatedAt := m.Get("max_created_at")
-	if maxCreatedAt == "" {
+	if cursor == "" && maxCreatedAt == "" {
 		return
 	}
 
-	t, err := time.Parse(ISO8601Format, maxCreatedAt)
-	if err != nil {
-		log.Print(err)
+	results, err := timelinePage(cursor, maxCreatedAt)
+	if errors.Is(err, errInvalidCursor) {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	results := []Post{}
-	err = db.Select(&results,
-		"SELECT posts.id, `user_id`, `body`, `mime`, posts.created_at FROM `posts` JOIN `users` ON posts.user_id = users.id"+
-			" WHERE users.del_flg = 0 AND posts.created_at <= ? ORDER BY posts.created_at DESC LIMIT ?",
-		t.Format(ISO8601Format),
-		postsPerPage)
 	if err != nil {
 		log.Print(err)
 		return
@@ -568,20 +639,123 @@ func getPosts(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if len(posts) == 0 {
+	// カーソルの場合は最後のページも空の一覧を返す
+	if len(posts) == 0 && cursor == "" {
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
 
+	setNextCursor(w, results)
 	_ = postsTemp.Execute(w, posts)
 }
 
+// nextCursorHeader 投稿一覧の次のページのカーソルを返すヘッダ
+const nextCursorHeader = "X-Next-Cursor"
+
+// postCursorVersion カーソルの形式を変えたら上げること
+const postCursorVersion = "1"
+
+var (
+	errInvalidCursor       = errors.New("invalid cursor")
+	errInvalidMaxCreatedAt = errors.New("invalid max_created_at")
+)
+
+// timelinePage 投稿一覧の1ページ分を取得する
+//
+//	cursorとmaxCreatedAtが両方とも空の場合は最初のページを返します
+func timelinePage(cursor, maxCreatedAt string) ([]Post, error) {
+	switch {
+	case cursor != "":
+		c, err := decodePostCursor(cursor)
+		if err != nil {
+			return nil, err
+		}
+		return postRepo.RecentAfter(c, postsPerPage)
+	case maxCreatedAt != "":
+		t, err := time.Parse(ISO8601Format, maxCreatedAt)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", errInvalidMaxCreatedAt, err.Error())
+		}
+		return postRepo.RecentBefore(t, postsPerPage)
+	default:
+		return postRepo.Recent(postsPerPage)
+	}
+}
+
+// encodePostCursor 投稿の位置を不透明なカーソルにする
+func encodePostCursor(p Post) string {
+	raw := postCursorVersion + ":" + strconv.FormatInt(p.CreatedAt.UnixNano(), 10) + ":" + strconv.Itoa(p.ID)
+
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodePostCursor(s string) (repository.PostCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return repository.PostCursor{}, errInvalidCursor
+	}
+
+	parts := strings.Split(string(raw), ":")
+	if len(parts) != 3 || parts[0] != postCursorVersion {
+		return repository.PostCursor{}, errInvalidCursor
+	}
+	nsec, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return repository.PostCursor{}, errInvalidCursor
+	}
+	id, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return repository.PostCursor{}, errInvalidCursor
+	}
+
+	return repository.PostCursor{CreatedAt: time.Unix(0, nsec), ID: id}, nil
+}
+
+// nextCursor 続きがありそうな場合に、resultsの最後の投稿を次のページのカーソルにする(無ければ空)
+//
+//	makePostsで除かれた投稿を読み直さないよう、リポジトリから取得した投稿を渡すこと
+func nextCursor(results []Post) string {
+	if len(results) < postsPerPage {
+		return ""
+	}
+
+	return encodePostCursor(results[len(results)-1])
+}
+
+// setNextCursor 次のページのカーソルをヘッダで返す
+func setNextCursor(w http.ResponseWriter, results []Post) {
+	if c := nextCursor(results); c != "" {
+		w.Header().Set(nextCursorHeader, c)
+	}
+}
+
 var postsIDTemp = template.Must(template.New("layout.html").Funcs(fmap).ParseFiles(
 	getTemplPath("layout.html"),
 	getTemplPath("post_id.html"),
 	getTemplPath("post.html"),
 ))
 
+// loadPost 全てのコメントを付けて投稿を取得する
+//
+//	投稿が無いか、投稿者がBANされている場合はrepository.ErrNotFoundを返します
+func loadPost(pid int, csrfToken string) (Post, error) {
+	post, err := postRepo.FindByID(pid)
+	if err != nil {
+		return Post{}, err
+	}
+
+	posts, err := makePosts([]Post{post}, csrfToken, true)
+	if err != nil {
+		return Post{}, err
+	}
+
+	if len(posts) == 0 {
+		return Post{}, repository.ErrNotFound
+	}
+
+	return posts[0], nil
+}
+
 func getPostsID(w http.ResponseWriter, r *http.Request) {
 	pidStr := chi.URLParam(r, "id")
 	pid, err := strconv.Atoi(pidStr)
@@ -590,26 +764,16 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	results := []Post{}
-	err = db.Select(&results, "SELECT `id`, `user_id`, `body`, `mime`, `created_at` FROM `posts` WHERE `id` = ?", pid)
-	if err != nil {
-		log.Print(err)
+	p, err := loadPost(pid, getCSRFToken(r))
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-
-	posts, err := makePosts(results, getCSRFToken(r), true)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	if len(posts) == 0 {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	p := posts[0]
-
 	me := getSessionUser(r)
 
 	_ = postsIDTemp.Execute(w, struct {
@@ -618,114 +782,105 @@ func getPostsID(w http.ResponseWriter, r *http.Request) {
 	}{p, me})
 }
 
-func postIndex(w http.ResponseWriter, r *http.Request) {
-	me := getSessionUser(r)
-	if !isLogin(me) {
-		http.Redirect(w, r, "/login", http.StatusFound)
-		return
-	}
+// inputError ユーザーの入力が原因のエラー(メッセージはそのまま画面に表示する)
+type inputError string
 
-	if r.FormValue("csrf_token") != getCSRFToken(r) {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		return
-	}
+func (e inputError) Error() string {
+	return string(e)
+}
 
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		session := getSession(r)
-		session.Values["notice"] = "画像が必須です"
-		_ = session.Save(r, w)
+const (
+	errImageRequired   = inputError("画像が必須です")
+	errImageType       = inputError("投稿できる画像形式はjpgとpngとgifだけです")
+	errImageTooLarge   = inputError("ファイルサイズが大きすぎます")
+	errImageBroken     = inputError("画像が壊れています")
+	errImageMismatch   = inputError("画像の形式がファイルの内容と一致しません")
+	errImageDimensions = inputError("画像の縦横が大きすぎます")
+)
 
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+// createPost フォームのfileとbodyから投稿を作成してIDを返す
+func createPost(me User, form uploadForm) (int, error) {
+	if form.File == nil {
+		return 0, errImageRequired
 	}
 
 	mime := ""
-	ext := ""
-	if file != nil {
-		// 投稿のContent-Typeからファイルのタイプを決定する
-		contentType := header.Header["Content-Type"][0]
-		if strings.Contains(contentType, "jpeg") {
-			mime = "image/jpeg"
-			ext = "jpg"
-		} else if strings.Contains(contentType, "png") {
-			mime = "image/png"
-			ext = "png"
-		} else if strings.Contains(contentType, "gif") {
-			mime = "image/gif"
-			ext = "gif"
-		} else {
-			session := getSession(r)
-			session.Values["notice"] = "投稿できる画像形式はjpgとpngとgifだけです"
-			_ = session.Save(r, w)
-
-			http.Redirect(w, r, "/", http.StatusFound)
-			return
-		}
+	// 投稿のContent-Typeからファイルのタイプを決定する
+	contentType := form.ContentType
+	if strings.Contains(contentType, "jpeg") {
+		mime = "image/jpeg"
+	} else if strings.Contains(contentType, "png") {
+		mime = "image/png"
+	} else if strings.Contains(contentType, "gif") {
+		mime = "image/gif"
+	} else {
+		return 0, errImageType
 	}
 
-	filedata, err := io.ReadAll(file)
+	filedata := form.File
+
+	// Content-Typeは信用せず、ファイルの内容が同じ形式の画像であることを確かめる
+	sniffed := sniffImage(filedata)
+	if sniffed == "" {
+		return 0, errImageType
+	}
+	if sniffed != mime {
+		return 0, errImageMismatch
+	}
+	err := validateImage(mime, filedata)
 	if err != nil {
-		log.Print(err)
-		return
+		return 0, err
 	}
 
-	if len(filedata) > UploadLimit {
-		session := getSession(r)
-		session.Values["notice"] = "ファイルサイズが大きすぎます"
-		_ = session.Save(r, w)
-
-		http.Redirect(w, r, "/", http.StatusFound)
-		return
+	// 位置情報などを公開しないよう、メタデータを取り除いてから保存する
+	if !keepImageMetadata {
+		filedata, err = stripImageMetadata(mime, filedata)
+		if err != nil {
+			return 0, errImageBroken
+		}
 	}
 
-	tx, err := db.Begin()
-	if err != nil {
-		log.Print(err)
+	return postRepo.Create(Post{
+		UserID:  me.ID,
+		Mime:    mime,
+		Imgdata: filedata,
+		Body:    form.Body,
+	}, imageStore)
+}
+
+func postIndex(w http.ResponseWriter, r *http.Request) {
+	me := getSessionUser(r)
+	if !isLogin(me) {
+		http.Redirect(w, r, "/login", http.StatusFound)
 		return
 	}
-	defer func() { _ = tx.Rollback() }()
 
-	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
-	result, err := tx.Exec(
-		query,
-		me.ID,
-		mime,
-		[]byte{},
-		r.FormValue("body"),
-	)
-	if err != nil {
-		log.Print(err)
+	// 大きすぎるリクエストでもCSRFトークンを読む前にフォームの読み込みが失敗するので、エラーを表示できるよう後で確かめる
+	form, err := readUploadForm(w, r)
+	if err == nil && form.CSRFToken != getCSRFToken(r) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
 		return
 	}
 
-	pid, err := result.LastInsertId()
-	if err != nil {
-		log.Print(err)
-		return
+	pid := 0
+	if err == nil {
+		pid, err = createPost(me, form)
 	}
+	var ie inputError
+	if errors.As(err, &ie) {
+		session := getSession(r)
+		session.Values["notice"] = ie.Error()
+		_ = session.Save(r, w)
 
-	f, err := os.Create("../image/" + strconv.FormatInt(pid, 10) + "." + ext)
-	if err != nil {
-		log.Print(err)
+		http.Redirect(w, r, "/", http.StatusFound)
 		return
 	}
-	defer func() {
-		err := f.Close()
-		if err != nil {
-			log.Print(err)
-		}
-	}()
-
-	_, err = f.Write(filedata)
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	_ = tx.Commit()
-
-	http.Redirect(w, r, "/posts/"+strconv.FormatInt(pid, 10), http.StatusFound)
+	http.Redirect(w, r, "/posts/"+strconv.Itoa(pid), http.StatusFound)
 }
 
 func getImage(w http.ResponseWriter, r *http.Request) {
@@ -736,47 +891,49 @@ func getImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	post := Post{}
-	err = db.Get(&post, "SELECT * FROM `posts` WHERE `id` = ?", pid)
+	post, err := postRepo.FindByID(pid)
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 	if err != nil {
 		log.Print(err)
 		return
 	}
 
-	ext := chi.URLParam(r, "ext")
-
-	if ext == "jpg" && post.Mime == "image/jpeg" ||
-		ext == "png" && post.Mime == "image/png" ||
-		ext == "gif" && post.Mime == "image/gif" {
-		w.Header().Set("Content-Type", post.Mime)
-		_, err := w.Write(post.Imgdata)
-		if err != nil {
-			log.Print(err)
-			return
-		}
-
-		f, err := os.Create("../image/" + strconv.FormatInt(int64(post.ID), 10) + "." + ext)
-		if err != nil {
-			log.Print(err)
-			return
-		}
-		defer func() {
-			err := f.Close()
-			if err != nil {
-				log.Print(err)
-			}
-		}()
+	if chi.URLParam(r, "ext") != repository.ImageExt(post.Mime) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
 
-		_, err = f.Write(post.Imgdata)
-		if err != nil {
-			log.Print(err)
+	key := repository.ImageKey{PostID: post.ID, Mime: post.Mime}
+	var data []byte
+	// ?w= があれば縮小した画像を返す(imageURLが返すURLには付けないので、明示的に指定した場合だけ)
+	if r.URL.Query().Has("w") {
+		width, ok := parseVariantWidth(r.URL.Query().Get("w"))
+		if !ok {
+			w.WriteHeader(http.StatusBadRequest)
 			return
 		}
-
+		data, err = loadImageVariant(key, width)
+	} else {
+		data, err = imageStore.Get(key)
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Print(err)
 		return
 	}
 
-	w.WriteHeader(http.StatusNotFound)
+	w.Header().Set("Content-Type", post.Mime)
+	_, err = w.Write(data)
+	if err != nil {
+		log.Print(err)
+		return
+	}
 }
 
 func postComment(w http.ResponseWriter, r *http.Request) {
@@ -797,35 +954,11 @@ func postComment(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)"
-
-	result, err := db.Exec(query, postID, me.ID, r.FormValue("comment"))
+	_, err = commentRepo.Create(postID, me.ID, r.FormValue("comment"))
 	if err != nil {
 		log.Print(err)
 		return
 	}
-	num, ok := commentCountCache.Get(postID)
-	if ok {
-		commentCountCache.Set(postID, num+1)
-	}
-
-	comments, ok := commentCache.Get(postID)
-	if ok {
-		commentID, err := result.LastInsertId()
-		if err != nil {
-			log.Print(err)
-			return
-		}
-		var comment Comment
-		_ = db.Get(&comment, "SELECT * FROM `comments` WHERE `id` = ?", commentID)
-
-		// 先頭に3つだけ追加
-		newComments := append([]Comment{comment}, comments...)
-		if len(newComments) > 3 {
-			newComments = newComments[:3]
-		}
-		commentCache.Set(postID, newComments)
-	}
 
 	http.Redirect(w, r, fmt.Sprintf("/posts/%d", postID), http.StatusFound)
 }
@@ -847,8 +980,7 @@ func getAdminBanned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	users := []User{}
-	err := db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC")
+	users, err := userRepo.ListBannable()
 	if err != nil {
 		log.Print(err)
 		return
@@ -878,8 +1010,6 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	query := "UPDATE `users` SET `del_flg` = ? WHERE `id` = ?"
-
 	err := r.ParseForm()
 	if err != nil {
 		log.Print(err)
@@ -887,20 +1017,54 @@ func postAdminBanned(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, id := range r.Form["uid[]"] {
-		_, _ = db.Exec(query, 1, id)
+		intID, err := strconv.Atoi(id)
+		if err != nil {
+			continue
+		}
 
-		intID, _ := strconv.Atoi(id)
-		user, ok := userCache.Get(intID)
-		if ok {
-			user.DelFlg = 1
-			userCache.Set(intID, user)
+		err = userRepo.Ban(intID)
+		if err != nil {
+			log.Print(err)
 		}
 	}
 
 	http.Redirect(w, r, "/admin/banned", http.StatusFound)
 }
 
+func getDebugCache(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(helpisu.AllStats())
+}
+
+func newRouter() chi.Router {
+	r := chi.NewRouter()
+	// r.Use(middleware.Logger)
+
+	r.Get("/initialize", getInitialize)
+	r.Get("/login", getLogin)
+	r.Post("/login", postLogin)
+	r.Get("/register", getRegister)
+	r.Post("/register", postRegister)
+	r.Get("/logout", getLogout)
+	r.Get("/", getIndex)
+	r.Get("/posts", getPosts)
+	r.Get("/posts/{id}", getPostsID)
+	r.Post("/", postIndex)
+	r.Get("/image/{id}.{ext}", getImage)
+	r.Post("/comment", postComment)
+	r.Get("/admin/banned", getAdminBanned)
+	r.Post("/admin/banned", postAdminBanned)
+	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
+	r.Mount("/api/v1", apiRouter())
+	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
+		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
+	})
+
+	return r
+}
+
 func main() {
+	http.HandleFunc("/debug/cache", getDebugCache)
 	go http.ListenAndServe(":6060", nil)
 
 	host := os.Getenv("ISUCONP_DB_HOST")
@@ -943,27 +1107,75 @@ func main() {
 	db.SetMaxOpenConns(256)
 	db.SetMaxIdleConns(64)
 
-	r := chi.NewRouter()
-	// r.Use(middleware.Logger)
+	if len(os.Args) > 1 && os.Args[1] == "migrate-images" {
+		err = runMigrateImages(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Failed to migrate images: %s.", err.Error())
+		}
+		return
+	}
 
-	r.Get("/initialize", getInitialize)
-	r.Get("/login", getLogin)
-	r.Post("/login", postLogin)
-	r.Get("/register", getRegister)
-	r.Post("/register", postRegister)
-	r.Get("/logout", getLogout)
-	r.Get("/", getIndex)
-	r.Get("/posts", getPosts)
-	r.Get("/posts/{id}", getPostsID)
-	r.Post("/", postIndex)
-	r.Get("/image/{id}.{ext}", getImage)
-	r.Post("/comment", postComment)
-	r.Get("/admin/banned", getAdminBanned)
-	r.Post("/admin/banned", postAdminBanned)
-	r.Get(`/@{accountName:[a-zA-Z]+}`, getAccountName)
-	r.Get("/*", func(w http.ResponseWriter, r *http.Request) {
-		http.FileServer(http.Dir("../public")).ServeHTTP(w, r)
-	})
+	cacheConfig := repository.CacheConfig{Bus: cacheBus, Remote: cacheRemote}
+	userRepo = repository.NewMySQLUserRepo(db, cacheConfig)
+	postRepo = repository.NewMySQLPostRepo(db)
+	commentRepo = repository.NewMySQLCommentRepo(db, cacheConfig)
 
-	log.Fatal(http.ListenAndServe(":8080", r))
+	imageStore, err = newImageStore(db)
+	if err != nil {
+		log.Fatalf("Failed to set up image store: %s.", err.Error())
+	}
+	imageVariantDir = imageDirFromEnv()
+
+	mysqlTokenRepo := repository.NewMySQLTokenRepo(db, cacheConfig)
+	err = mysqlTokenRepo.CreateTable()
+	if err != nil {
+		log.Fatalf("Failed to create token table: %s.", err.Error())
+	}
+	tokenRepo = mysqlTokenRepo
+
+	r := newRouter()
+
+	snapshotDir := os.Getenv("ISUCONP_CACHE_SNAPSHOT_DIR")
+	if snapshotDir == "" {
+		snapshotDir = "../cache"
+	}
+	err = helpisu.LoadAllSnapshots(snapshotDir)
+	if err != nil {
+		log.Printf("Failed to load cache snapshots: %s", err.Error())
+	}
+
+	err = helpisu.WarmUpAll(context.Background(), warmUpTimeout)
+	if err != nil {
+		log.Printf("Failed to warm up caches: %s", err.Error())
+	}
+
+	server := &http.Server{Addr: ":8080", Handler: r}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
+	defer stop()
+
+	// ListenAndServeはShutdownが呼ばれるとすぐに戻るので、処理中のリクエストが終わるまでshutdownを待つ
+	shutdown := make(chan struct{})
+	go func() {
+		defer close(shutdown)
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := server.Shutdown(shutdownCtx)
+		if err != nil {
+			log.Print(err)
+		}
+	}()
+
+	err = server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
+
+	err = helpisu.SaveAllSnapshots(snapshotDir)
+	if err != nil {
+		log.Printf("Failed to save cache snapshots: %s", err.Error())
+	}
 }
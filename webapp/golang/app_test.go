@@ -0,0 +1,1039 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/repository"
+	"github.com/gorilla/sessions"
+)
+
+// memorySessionStore メモリ上にセッションを持つsessions.Store
+//
+//	CookieにはセッションIDだけを入れます
+type memorySessionStore struct {
+	mu       sync.Mutex
+	sessions map[string]map[interface{}]interface{}
+}
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{
+		sessions: map[string]map[interface{}]interface{}{},
+	}
+}
+
+func (s *memorySessionStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *memorySessionStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	session.Options = &sessions.Options{Path: "/"}
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values, ok := s.sessions[c.Value]
+	if !ok {
+		return session, nil
+	}
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	session.ID = c.Value
+	session.IsNew = false
+
+	return session, nil
+}
+
+func (s *memorySessionStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session.Options != nil && session.Options.MaxAge < 0 {
+		delete(s.sessions, session.ID)
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = secureRandomStr(16)
+	}
+	values := make(map[interface{}]interface{}, len(session.Values))
+	for k, v := range session.Values {
+		values[k] = v
+	}
+	s.sessions[session.ID] = values
+
+	http.SetCookie(w, sessions.NewCookie(session.Name(), session.ID, session.Options))
+	return nil
+}
+
+// testApp メモリ上のリポジトリとセッションで動かしたアプリ
+type testApp struct {
+	t      *testing.T
+	mem    *repository.Memory
+	server *httptest.Server
+	// imageDir 画像のファイルを置くディレクトリ
+	imageDir string
+}
+
+func newTestApp(t *testing.T) *testApp {
+	t.Helper()
+
+	origUser, origPost, origComment, origToken := userRepo, postRepo, commentRepo, tokenRepo
+	origStore, origImageStore, origImageVariantDir := store, imageStore, imageVariantDir
+	t.Cleanup(func() {
+		userRepo, postRepo, commentRepo, tokenRepo = origUser, origPost, origComment, origToken
+		store, imageStore, imageVariantDir = origStore, origImageStore, origImageVariantDir
+	})
+
+	mem := repository.NewMemory()
+	userRepo, postRepo, commentRepo, tokenRepo = mem.Users, mem.Posts, mem.Comments, mem.Tokens
+	store = newMemorySessionStore()
+	// 本番のデフォルトと同じく、DBからファイルへ移している途中の構成にする
+	imageDir := t.TempDir()
+	imageStore = repository.NewMigratingImageStore(mem.Images, repository.NewFileImageStore(imageDir))
+	imageVariantDir = imageDir
+
+	server := httptest.NewServer(newRouter())
+	t.Cleanup(server.Close)
+
+	return &testApp{t: t, mem: mem, server: server, imageDir: imageDir}
+}
+
+func (a *testApp) addUser(accountName, password string, authority, delFlg int) User {
+	return a.mem.AddUser(User{
+		AccountName: accountName,
+		Passhash:    calculatePasshash(accountName, password),
+		Authority:   authority,
+		DelFlg:      delFlg,
+	})
+}
+
+// testClient Cookieを保持し、リダイレクトを追わないクライアント
+type testClient struct {
+	app    *testApp
+	client *http.Client
+}
+
+func (a *testApp) newClient() *testClient {
+	a.t.Helper()
+
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		a.t.Fatal(err)
+	}
+
+	return &testClient{
+		app: a,
+		client: &http.Client{
+			Jar: jar,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+type testResponse struct {
+	status      int
+	location    string
+	contentType string
+	header      http.Header
+	body        string
+}
+
+func (c *testClient) do(req *http.Request) testResponse {
+	c.app.t.Helper()
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		c.app.t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		c.app.t.Fatal(err)
+	}
+
+	return testResponse{
+		status:      res.StatusCode,
+		location:    res.Header.Get("Location"),
+		contentType: res.Header.Get("Content-Type"),
+		header:      res.Header,
+		body:        string(body),
+	}
+}
+
+func (c *testClient) get(path string) testResponse {
+	c.app.t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, c.app.server.URL+path, nil)
+	if err != nil {
+		c.app.t.Fatal(err)
+	}
+
+	return c.do(req)
+}
+
+func (c *testClient) postForm(path string, form url.Values) testResponse {
+	c.app.t.Helper()
+
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		c.app.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	return c.do(req)
+}
+
+type testFile struct {
+	contentType string
+	data        []byte
+}
+
+func (c *testClient) postMultipart(path string, fields map[string]string, file *testFile) testResponse {
+	c.app.t.Helper()
+
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for k, v := range fields {
+		err := mw.WriteField(k, v)
+		if err != nil {
+			c.app.t.Fatal(err)
+		}
+	}
+	if file != nil {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="upload"`)
+		h.Set("Content-Type", file.contentType)
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			c.app.t.Fatal(err)
+		}
+		_, err = part.Write(file.data)
+		if err != nil {
+			c.app.t.Fatal(err)
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		c.app.t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, c.app.server.URL+path, buf)
+	if err != nil {
+		c.app.t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	return c.do(req)
+}
+
+func (c *testClient) login(accountName, password string) {
+	c.app.t.Helper()
+
+	res := c.postForm("/login", url.Values{"account_name": {accountName}, "password": {password}})
+	if res.status != http.StatusFound || res.location != "/" {
+		c.app.t.Fatalf("login as %s: status=%d location=%q", accountName, res.status, res.location)
+	}
+}
+
+var csrfTokenRe = regexp.MustCompile(`name="csrf_token" value="([0-9a-f]+)"`)
+
+// csrfToken トップページのフォームからCSRFトークンを取り出す
+func (c *testClient) csrfToken() string {
+	c.app.t.Helper()
+
+	m := csrfTokenRe.FindStringSubmatch(c.get("/").body)
+	if m == nil {
+		c.app.t.Fatal("csrf_token not found")
+	}
+
+	return m[1]
+}
+
+func assertContains(t *testing.T, body string, want, notWant []string) {
+	t.Helper()
+
+	for _, s := range want {
+		if !strings.Contains(body, s) {
+			t.Errorf("body does not contain %q", s)
+		}
+	}
+	for _, s := range notWant {
+		if strings.Contains(body, s) {
+			t.Errorf("body contains %q", s)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	tests := []struct {
+		name         string
+		accountName  string
+		password     string
+		wantLocation string
+		// wantFlash リダイレクト先に表示されるメッセージ
+		wantFlash string
+	}{
+		{
+			name:         "success",
+			accountName:  "alice",
+			password:     "alicepass",
+			wantLocation: "/",
+			wantFlash:    `<span class="isu-account-name">alice</span>`,
+		},
+		{
+			name:         "wrong password",
+			accountName:  "alice",
+			password:     "wrongpass",
+			wantLocation: "/login",
+			wantFlash:    "アカウント名かパスワードが間違っています",
+		},
+		{
+			name:         "unknown user",
+			accountName:  "nobody",
+			password:     "nobodypass",
+			wantLocation: "/login",
+			wantFlash:    "アカウント名かパスワードが間違っています",
+		},
+		{
+			name:         "banned user",
+			accountName:  "bob",
+			password:     "bobpass",
+			wantLocation: "/login",
+			wantFlash:    "アカウント名かパスワードが間違っています",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.addUser("alice", "alicepass", 0, 0)
+			app.addUser("bob", "bobpass", 0, 1)
+			c := app.newClient()
+
+			res := c.postForm("/login", url.Values{"account_name": {tt.accountName}, "password": {tt.password}})
+			if res.status != http.StatusFound {
+				t.Fatalf("status = %d, want %d", res.status, http.StatusFound)
+			}
+			if res.location != tt.wantLocation {
+				t.Fatalf("location = %q, want %q", res.location, tt.wantLocation)
+			}
+
+			res = c.get(res.location)
+			assertContains(t, res.body, []string{tt.wantFlash}, nil)
+		})
+	}
+}
+
+func TestLoginPagesRedirectWhenLoggedIn(t *testing.T) {
+	app := newTestApp(t)
+	app.addUser("alice", "alicepass", 0, 0)
+	c := app.newClient()
+	c.login("alice", "alicepass")
+
+	for _, path := range []string{"/login", "/register"} {
+		res := c.get(path)
+		if res.status != http.StatusFound || res.location != "/" {
+			t.Errorf("GET %s: status=%d location=%q, want redirect to /", path, res.status, res.location)
+		}
+	}
+
+	res := c.get("/logout")
+	if res.status != http.StatusFound || res.location != "/" {
+		t.Fatalf("GET /logout: status=%d location=%q", res.status, res.location)
+	}
+	res = c.get("/login")
+	if res.status != http.StatusOK {
+		t.Errorf("GET /login after logout: status = %d, want %d", res.status, http.StatusOK)
+	}
+}
+
+func TestRegister(t *testing.T) {
+	tests := []struct {
+		name         string
+		accountName  string
+		password     string
+		wantLocation string
+		wantFlash    string
+	}{
+		{
+			name:         "success",
+			accountName:  "carol",
+			password:     "carolpass",
+			wantLocation: "/",
+			wantFlash:    `<span class="isu-account-name">carol</span>`,
+		},
+		{
+			name:         "short account name",
+			accountName:  "ca",
+			password:     "carolpass",
+			wantLocation: "/register",
+			wantFlash:    "アカウント名は3文字以上、パスワードは6文字以上である必要があります",
+		},
+		{
+			name:         "short password",
+			accountName:  "carol",
+			password:     "pass",
+			wantLocation: "/register",
+			wantFlash:    "アカウント名は3文字以上、パスワードは6文字以上である必要があります",
+		},
+		{
+			name:         "invalid character",
+			accountName:  "car-ol",
+			password:     "carolpass",
+			wantLocation: "/register",
+			wantFlash:    "アカウント名は3文字以上、パスワードは6文字以上である必要があります",
+		},
+		{
+			name:         "taken",
+			accountName:  "alice",
+			password:     "carolpass",
+			wantLocation: "/register",
+			wantFlash:    "アカウント名がすでに使われています",
+		},
+		{
+			name:         "taken by banned user",
+			accountName:  "bob",
+			password:     "carolpass",
+			wantLocation: "/register",
+			wantFlash:    "アカウント名がすでに使われています",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.addUser("alice", "alicepass", 0, 0)
+			app.addUser("bob", "bobpass", 0, 1)
+			c := app.newClient()
+
+			res := c.postForm("/register", url.Values{"account_name": {tt.accountName}, "password": {tt.password}})
+			if res.status != http.StatusFound {
+				t.Fatalf("status = %d, want %d", res.status, http.StatusFound)
+			}
+			if res.location != tt.wantLocation {
+				t.Fatalf("location = %q, want %q", res.location, tt.wantLocation)
+			}
+
+			res = c.get(res.location)
+			assertContains(t, res.body, []string{tt.wantFlash}, nil)
+		})
+	}
+}
+
+// seedTimeline alice(投稿2つ)とBANされたbob(投稿1つ)の投稿を作る
+//
+//	3番目の投稿には4つのコメントが付いています
+func seedTimeline(app *testApp) {
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)
+
+	alice := app.addUser("alice", "alicepass", 0, 0)
+	bob := app.addUser("bob", "bobpass", 0, 1)
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/jpeg", Body: "first post", CreatedAt: base})
+	app.mem.AddPost(Post{UserID: bob.ID, Mime: "image/png", Body: "banned post", CreatedAt: base.Add(time.Minute)})
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/gif", Body: "third post", CreatedAt: base.Add(2 * time.Minute)})
+	for i := 1; i <= 4; i++ {
+		app.mem.AddComment(Comment{
+			PostID:    3,
+			UserID:    alice.ID,
+			Comment:   "comment" + strconv.Itoa(i),
+			CreatedAt: base.Add(time.Duration(2+i) * time.Minute),
+		})
+	}
+}
+
+func TestPages(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		wantStatus  int
+		wantBody    []string
+		wantNotBody []string
+	}{
+		{
+			name:        "index",
+			path:        "/",
+			wantStatus:  http.StatusOK,
+			wantBody:    []string{`id="pid_3"`, `id="pid_1"`, `src="/image/3.gif"`, "comments: <b>4</b>", "comment2", "comment3", "comment4"},
+			wantNotBody: []string{`id="pid_2"`, "banned post", "comment1"},
+		},
+		{
+			name:       "post with all comments",
+			path:       "/posts/3",
+			wantStatus: http.StatusOK,
+			wantBody:   []string{`id="pid_3"`, "comment1", "comment4"},
+		},
+		{
+			name:       "post by banned user",
+			path:       "/posts/2",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown post",
+			path:       "/posts/100",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "invalid post id",
+			path:       "/posts/abc",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:        "more posts",
+			path:        "/posts?max_created_at=" + url.QueryEscape(time.Date(2023, 1, 1, 0, 1, 0, 0, time.Local).Format(ISO8601Format)),
+			wantStatus:  http.StatusOK,
+			wantBody:    []string{`id="pid_1"`},
+			wantNotBody: []string{`id="pid_2"`, `id="pid_3"`},
+		},
+		{
+			name:       "no more posts",
+			path:       "/posts?max_created_at=" + url.QueryEscape(time.Date(2022, 1, 1, 0, 0, 0, 0, time.Local).Format(ISO8601Format)),
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "user page",
+			path:       "/@alice",
+			wantStatus: http.StatusOK,
+			wantBody:   []string{`id="pid_1"`, `id="pid_3"`},
+		},
+		{
+			name:       "banned user page",
+			path:       "/@bob",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "unknown user page",
+			path:       "/@nobody",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	app := newTestApp(t)
+	seedTimeline(app)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := app.newClient().get(tt.path)
+			if res.status != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", res.status, tt.wantStatus)
+			}
+			assertContains(t, res.body, tt.wantBody, tt.wantNotBody)
+		})
+	}
+
+	t.Run("order", func(t *testing.T) {
+		body := app.newClient().get("/").body
+		if strings.Index(body, `id="pid_3"`) > strings.Index(body, `id="pid_1"`) {
+			t.Error("posts are not ordered by created_at desc")
+		}
+		if strings.Index(body, "comment2") > strings.Index(body, "comment4") {
+			t.Error("comments are not ordered by created_at asc")
+		}
+	})
+}
+
+var pidRe = regexp.MustCompile(`id="pid_([0-9]+)"`)
+
+func pids(body string) []int {
+	ids := []int{}
+	for _, m := range pidRe.FindAllStringSubmatch(body, -1) {
+		id, _ := strconv.Atoi(m[1])
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+func TestPostsCursor(t *testing.T) {
+	app := newTestApp(t)
+	alice := app.addUser("alice", "alicepass", 0, 0)
+	bob := app.addUser("bob", "bobpass", 0, 1)
+
+	// 5件ずつ同じ時刻に投稿し、BANされたbobの投稿を混ぜる
+	base := time.Date(2023, 1, 1, 0, 0, 0, 0, time.Local)
+	var want []int
+	for i := 0; i < 45; i++ {
+		userID := alice.ID
+		if i%10 == 3 {
+			userID = bob.ID
+		}
+		p := app.mem.AddPost(Post{UserID: userID, Mime: "image/jpeg", CreatedAt: base.Add(time.Duration(i/5) * time.Minute)})
+		if userID == alice.ID {
+			want = append([]int{p.ID}, want...)
+		}
+	}
+
+	c := app.newClient()
+	res := c.get("/")
+	got := pids(res.body)
+	cursor := res.header.Get(nextCursorHeader)
+	for pages := 0; cursor != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("too many pages")
+		}
+
+		res = c.get("/posts?cursor=" + url.QueryEscape(cursor))
+		if res.status != http.StatusOK {
+			t.Fatalf("status = %d, want %d", res.status, http.StatusOK)
+		}
+		got = append(got, pids(res.body)...)
+		cursor = res.header.Get(nextCursorHeader)
+	}
+
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("posts = %v, want %v", got, want)
+	}
+
+	res = c.get("/posts?cursor=invalid")
+	if res.status != http.StatusBadRequest {
+		t.Errorf("invalid cursor: status = %d, want %d", res.status, http.StatusBadRequest)
+	}
+}
+
+// testImage 4x3の画像をmimeの形式でエンコードする
+func testImage(t *testing.T, mime string) []byte {
+	t.Helper()
+
+	return testImageSize(t, mime, 4, 3)
+}
+
+// testImageSize 幅width、高さheightの画像をmimeの形式でエンコードする
+func testImageSize(t *testing.T, mime string, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.White, color.Black})
+	img.SetColorIndex(1, 1, 1)
+
+	buf := &bytes.Buffer{}
+	var err error
+	switch mime {
+	case "image/jpeg":
+		err = jpeg.Encode(buf, img, nil)
+	case "image/png":
+		err = png.Encode(buf, img)
+	case "image/gif":
+		err = gif.Encode(buf, img, nil)
+	default:
+		t.Fatalf("unknown mime %q", mime)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestPostIndex(t *testing.T) {
+	jpegData := testImage(t, "image/jpeg")
+	pngData := testImage(t, "image/png")
+	gifData := testImage(t, "image/gif")
+
+	tests := []struct {
+		name      string
+		login     bool
+		badCSRF   bool
+		file      *testFile
+		wantCode  int
+		wantLoc   string
+		wantFlash string
+		wantImage string
+	}{
+		{
+			name:     "not logged in",
+			file:     &testFile{contentType: "image/jpeg", data: jpegData},
+			wantCode: http.StatusFound,
+			wantLoc:  "/login",
+		},
+		{
+			name:     "invalid csrf token",
+			login:    true,
+			badCSRF:  true,
+			file:     &testFile{contentType: "image/jpeg", data: jpegData},
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "no file",
+			login:     true,
+			wantCode:  http.StatusFound,
+			wantLoc:   "/",
+			wantFlash: "画像が必須です",
+		},
+		{
+			name:      "unsupported type",
+			login:     true,
+			file:      &testFile{contentType: "text/plain", data: []byte("hello")},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/",
+			wantFlash: "投稿できる画像形式はjpgとpngとgifだけです",
+		},
+		{
+			name:      "text labelled as png",
+			login:     true,
+			file:      &testFile{contentType: "image/png", data: []byte("hello")},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/",
+			wantFlash: "投稿できる画像形式はjpgとpngとgifだけです",
+		},
+		{
+			name:      "jpeg labelled as png",
+			login:     true,
+			file:      &testFile{contentType: "image/png", data: jpegData},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/",
+			wantFlash: "画像の形式がファイルの内容と一致しません",
+		},
+		{
+			name:      "truncated png",
+			login:     true,
+			file:      &testFile{contentType: "image/png", data: pngData[:len(pngData)-20]},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/",
+			wantFlash: "画像が壊れています",
+		},
+		{
+			name:      "too large",
+			login:     true,
+			file:      &testFile{contentType: "image/png", data: append(append([]byte{}, pngData...), make([]byte, UploadLimit)...)},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/",
+			wantFlash: "ファイルサイズが大きすぎます",
+		},
+		{
+			name:      "request body too large",
+			login:     true,
+			file:      &testFile{contentType: "image/png", data: make([]byte, uploadRequestLimit)},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/",
+			wantFlash: "ファイルサイズが大きすぎます",
+		},
+		{
+			name:      "success",
+			login:     true,
+			file:      &testFile{contentType: "image/jpeg", data: jpegData},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/posts/1",
+			wantImage: "1.jpg",
+		},
+		{
+			name:      "png",
+			login:     true,
+			file:      &testFile{contentType: "image/png", data: pngData},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/posts/1",
+			wantImage: "1.png",
+		},
+		{
+			name:      "gif",
+			login:     true,
+			file:      &testFile{contentType: "image/gif", data: gifData},
+			wantCode:  http.StatusFound,
+			wantLoc:   "/posts/1",
+			wantImage: "1.gif",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.addUser("alice", "alicepass", 0, 0)
+			c := app.newClient()
+
+			token := "invalid"
+			if tt.login {
+				c.login("alice", "alicepass")
+				if !tt.badCSRF {
+					token = c.csrfToken()
+				}
+			}
+
+			res := c.postMultipart("/", map[string]string{"body": "hello", "csrf_token": token}, tt.file)
+			if res.status != tt.wantCode {
+				t.Fatalf("status = %d, want %d", res.status, tt.wantCode)
+			}
+			if res.location != tt.wantLoc {
+				t.Fatalf("location = %q, want %q", res.location, tt.wantLoc)
+			}
+
+			if tt.wantFlash != "" {
+				res = c.get(res.location)
+				assertContains(t, res.body, []string{tt.wantFlash}, nil)
+			}
+
+			if tt.wantImage == "" {
+				return
+			}
+			data, err := os.ReadFile(filepath.Join(app.imageDir, tt.wantImage))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.file.data) {
+				t.Error("saved image differs from uploaded file")
+			}
+			res = c.get(res.location)
+			assertContains(t, res.body, []string{"hello", `src="/image/` + tt.wantImage + `"`}, nil)
+		})
+	}
+}
+
+func TestPostComment(t *testing.T) {
+	tests := []struct {
+		name      string
+		login     bool
+		badCSRF   bool
+		wantCode  int
+		wantLoc   string
+		wantCount int
+	}{
+		{
+			name:     "not logged in",
+			wantCode: http.StatusFound,
+			wantLoc:  "/login",
+		},
+		{
+			name:     "invalid csrf token",
+			login:    true,
+			badCSRF:  true,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:      "success",
+			login:     true,
+			wantCode:  http.StatusFound,
+			wantLoc:   "/posts/1",
+			wantCount: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			alice := app.addUser("alice", "alicepass", 0, 0)
+			app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/jpeg", Body: "post"})
+			c := app.newClient()
+
+			token := "invalid"
+			if tt.login {
+				c.login("alice", "alicepass")
+				if !tt.badCSRF {
+					token = c.csrfToken()
+				}
+			}
+
+			res := c.postForm("/comment", url.Values{"post_id": {"1"}, "comment": {"nice photo"}, "csrf_token": {token}})
+			if res.status != tt.wantCode {
+				t.Fatalf("status = %d, want %d", res.status, tt.wantCode)
+			}
+			if res.location != tt.wantLoc {
+				t.Fatalf("location = %q, want %q", res.location, tt.wantLoc)
+			}
+
+			count, err := commentRepo.CountByPost(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if count != tt.wantCount {
+				t.Fatalf("comment count = %d, want %d", count, tt.wantCount)
+			}
+
+			if tt.wantCount > 0 {
+				res = c.get(res.location)
+				assertContains(t, res.body, []string{"nice photo", fmt.Sprintf("comments: <b>%d</b>", tt.wantCount)}, nil)
+			}
+		})
+	}
+}
+
+func TestGetImage(t *testing.T) {
+	jpeg := []byte("\xff\xd8\xff\xe0dummy jpeg")
+	png := []byte("\x89PNG\r\n\x1a\ndummy png")
+
+	tests := []struct {
+		name     string
+		path     string
+		wantCode int
+		wantType string
+		wantBody []byte
+	}{
+		{name: "jpeg in db", path: "/image/1.jpg", wantCode: http.StatusOK, wantType: "image/jpeg", wantBody: jpeg},
+		{name: "png in file", path: "/image/2.png", wantCode: http.StatusOK, wantType: "image/png", wantBody: png},
+		{name: "no image", path: "/image/3.gif", wantCode: http.StatusNotFound},
+		{name: "wrong extension", path: "/image/1.png", wantCode: http.StatusNotFound},
+		{name: "unknown post", path: "/image/100.jpg", wantCode: http.StatusNotFound},
+		{name: "invalid id", path: "/image/abc.jpg", wantCode: http.StatusNotFound},
+	}
+
+	app := newTestApp(t)
+	alice := app.addUser("alice", "alicepass", 0, 0)
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/jpeg", Imgdata: jpeg, Body: "post"})
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/png", Body: "post"})
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/gif", Body: "post"})
+	err := os.WriteFile(filepath.Join(app.imageDir, "2.png"), png, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := app.newClient().get(tt.path)
+			if res.status != tt.wantCode {
+				t.Fatalf("status = %d, want %d", res.status, tt.wantCode)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			if res.contentType != tt.wantType {
+				t.Errorf("content type = %q, want %q", res.contentType, tt.wantType)
+			}
+			if res.body != string(tt.wantBody) {
+				t.Error("body differs from image data")
+			}
+		})
+	}
+
+	// DBから配信した画像は次からnginxが返せるようファイルに書き出す
+	data, err := os.ReadFile(filepath.Join(app.imageDir, "1.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, jpeg) {
+		t.Error("written image differs from image data")
+	}
+}
+
+func TestAdminBanned(t *testing.T) {
+	tests := []struct {
+		name     string
+		login    string
+		method   string
+		badCSRF  bool
+		wantCode int
+		wantLoc  string
+		wantBody []string
+	}{
+		{
+			name:     "get not logged in",
+			method:   http.MethodGet,
+			wantCode: http.StatusFound,
+			wantLoc:  "/",
+		},
+		{
+			name:     "get not admin",
+			login:    "alice",
+			method:   http.MethodGet,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "get admin",
+			login:    "admin",
+			method:   http.MethodGet,
+			wantCode: http.StatusOK,
+			wantBody: []string{`data-account-name="alice"`},
+		},
+		{
+			name:     "post not logged in",
+			method:   http.MethodPost,
+			wantCode: http.StatusFound,
+			wantLoc:  "/",
+		},
+		{
+			name:     "post not admin",
+			login:    "alice",
+			method:   http.MethodPost,
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name:     "post invalid csrf token",
+			login:    "admin",
+			method:   http.MethodPost,
+			badCSRF:  true,
+			wantCode: http.StatusUnprocessableEntity,
+		},
+		{
+			name:     "post admin",
+			login:    "admin",
+			method:   http.MethodPost,
+			wantCode: http.StatusFound,
+			wantLoc:  "/admin/banned",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t)
+			app.addUser("admin", "adminpass", 1, 0)
+			alice := app.addUser("alice", "alicepass", 0, 0)
+			app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/jpeg", Body: "post by alice"})
+			c := app.newClient()
+
+			token := "invalid"
+			if tt.login != "" {
+				c.login(tt.login, tt.login+"pass")
+				if !tt.badCSRF {
+					token = c.csrfToken()
+				}
+			}
+
+			var res testResponse
+			if tt.method == http.MethodGet {
+				res = c.get("/admin/banned")
+			} else {
+				res = c.postForm("/admin/banned", url.Values{"uid[]": {strconv.Itoa(alice.ID)}, "csrf_token": {token}})
+			}
+			if res.status != tt.wantCode {
+				t.Fatalf("status = %d, want %d", res.status, tt.wantCode)
+			}
+			if res.location != tt.wantLoc {
+				t.Fatalf("location = %q, want %q", res.location, tt.wantLoc)
+			}
+			assertContains(t, res.body, tt.wantBody, nil)
+
+			banned := tt.method == http.MethodPost && tt.wantCode == http.StatusFound && tt.login == "admin"
+			u, err := userRepo.FindByID(alice.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (u.DelFlg != 0) != banned {
+				t.Fatalf("del_flg = %d, want banned=%v", u.DelFlg, banned)
+			}
+
+			if banned {
+				body := app.newClient().get("/").body
+				assertContains(t, body, nil, []string{"post by alice"})
+				body = c.get("/admin/banned").body
+				assertContains(t, body, nil, []string{`data-account-name="alice"`})
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package helpisu
+
+import (
+	"time"
+)
+
+// loadLocked lock(key)を取った状態で期限切れを考慮してエントリを取得
+//
+//	ローカルに無い場合、WithRemoteを指定していればmemcachedから読み込みます
+func (c *Cache[K, V]) loadLocked(key K) (*entry[V], bool) {
+	e, ok := c.backend.load(key)
+	if !ok {
+		return c.remoteGet(key)
+	}
+
+	if e.expired(time.Now().UnixNano()) || !c.valid(key, e) {
+		c.deleteLocked(key, e)
+		return nil, false
+	}
+
+	return e, true
+}
+
+// newEntry デフォルトの有効期限でエントリを作成
+//
+//	bumpについてはstampを参照
+func (c *Cache[K, V]) newEntry(key K, value V, bump bool) *entry[V] {
+	e := c.unstampedEntry(value)
+	c.stamp(key, e, bump)
+
+	return e
+}
+
+// unstampedEntry デフォルトの有効期限でエントリを作成(WithInvalidationのバージョンは記録しない)
+func (c *Cache[K, V]) unstampedEntry(value V) *entry[V] {
+	e := &entry[V]{value: value}
+	if c.ttl > 0 {
+		e.expireAt = time.Now().Add(c.ttl).UnixNano()
+	}
+
+	return e
+}
+
+// Update 指定したKeyの値をアトミックに更新する
+//
+//	fには現在の値と、値が存在したかどうかが渡されます
+//	fが返した2つ目の値がtrueなら新しい値を格納し、falseならエントリを削除します
+//	fはロックを取った状態で呼ばれるので、f内でこのCacheを操作しないでください
+func (c *Cache[K, V]) Update(key K, f func(old V, ok bool) (V, bool)) (value V, stored bool) {
+	unlock := c.lock(key)
+
+	var old V
+	e, ok := c.loadLocked(key)
+	if ok {
+		old = e.value
+	}
+
+	value, stored = f(old, ok)
+
+	var evictedEntries []evicted[K, V]
+	var ne *entry[V]
+	deleted := false
+	if stored {
+		ne = c.newEntry(key, value, true)
+		evictedEntries = c.storeLocked(key, ne)
+	} else if ok {
+		// memcachedにだけある場合もあるので、ローカルで消せたかどうかに関わらず削除を伝える
+		c.deleteLocked(key, nil)
+		deleted = true
+	}
+	// fを呼んだ時点でDBなどは書き換えられているはずなので、格納しなかった場合も記録する
+	c.wroteLocked(key)
+	unlock()
+
+	if stored {
+		c.remoteSet(key, ne)
+	}
+	if deleted {
+		c.publishDelete(key)
+		c.remoteDelete(key)
+	}
+
+	if stored {
+		c.stats.sets.Add(1)
+	}
+	if deleted {
+		c.stats.deletes.Add(1)
+	}
+	c.notifyEvicted(evictedEntries)
+
+	return
+}
+
+// CompareAndSwap 指定したKeyの値がoldと等しい場合だけnewに入れ替える
+//
+//	sync.Map.CompareAndSwapと同様に、Vが比較できない型の場合はpanicします
+func (c *Cache[K, V]) CompareAndSwap(key K, old, new V) (swapped bool) {
+	unlock := c.lock(key)
+
+	var evictedEntries []evicted[K, V]
+	var ne *entry[V]
+	e, ok := c.loadLocked(key)
+	if ok && any(e.value) == any(old) {
+		ne = c.newEntry(key, new, true)
+		evictedEntries = c.storeLocked(key, ne)
+		c.wroteLocked(key)
+		swapped = true
+	}
+	unlock()
+
+	if swapped {
+		c.remoteSet(key, ne)
+		c.stats.sets.Add(1)
+	}
+	c.notifyEvicted(evictedEntries)
+
+	return
+}
+
+// LoadOrStore 指定したKeyの値があればそれを返し、無ければvalueを格納してvalueを返す
+//
+//	loadedは既存の値を返した場合にtrueになります
+func (c *Cache[K, V]) LoadOrStore(key K, value V) (actual V, loaded bool) {
+	unlock := c.lock(key)
+
+	if e, ok := c.loadLocked(key); ok {
+		if c.policy != nil {
+			c.policy.touch(key)
+		}
+		unlock()
+
+		c.stats.hits.Add(1)
+		return e.value, true
+	}
+
+	e := c.newEntry(key, value, true)
+	evictedEntries := c.storeLocked(key, e)
+	c.wroteLocked(key)
+	unlock()
+
+	c.remoteSet(key, e)
+	c.stats.misses.Add(1)
+	c.stats.sets.Add(1)
+	c.notifyEvicted(evictedEntries)
+
+	return value, false
+}
+
+// fill DBなどから読み込んだ値をローカルのキャッシュに入れる
+//
+//	Setと異なり、WithInvalidationを指定していても他のプロセスのエントリを無効にしません
+//	WithRemoteのmemcachedには書き込まないので、必要なら入れた後にremoteSetを呼ぶこと
+//	epochは読み込む前にwriteEpoch(key)で取得した値です
+//	読み込み中にこのKeyへの書き込みがあった場合、読み込んだ値は古いかもしれないので入れずにfalseを返します
+func (c *Cache[K, V]) fill(key K, e *entry[V], epoch uint64) bool {
+	unlock := c.lock(key)
+	if c.writeEpoch(key) != epoch {
+		unlock()
+		return false
+	}
+	evictedEntries := c.storeLocked(key, e)
+	unlock()
+
+	c.stats.sets.Add(1)
+	c.notifyEvicted(evictedEntries)
+
+	return true
+}
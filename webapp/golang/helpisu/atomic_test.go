@@ -0,0 +1,267 @@
+package helpisu
+
+import (
+	"sync"
+	"testing"
+)
+
+// atomicCacheOptions ロックの取り方が異なる組み合わせ
+var atomicCacheOptions = []struct {
+	name string
+	opts []Option
+}{
+	{"SyncMap", nil},
+	{"Sharded", []Option{WithBackend(BackendSharded)}},
+	{"上限あり", []Option{WithMaxEntries(1000)}},
+}
+
+func TestUpdateConcurrent(t *testing.T) {
+	const goroutines, n = 8, 500
+
+	for _, tt := range atomicCacheOptions {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, int](t, tt.opts...)
+
+			wg := sync.WaitGroup{}
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < n; i++ {
+						c.Update(1, func(old int, _ bool) (int, bool) { return old + 1, true })
+						c.Update(i%10+2, func(old int, _ bool) (int, bool) { return old + 1, true })
+					}
+				}()
+			}
+			wg.Wait()
+
+			if v, _ := c.Get(1); v != goroutines*n {
+				t.Errorf("Get(1) = %d, want %d", v, goroutines*n)
+			}
+			total := 0
+			for k := 2; k < 12; k++ {
+				v, _ := c.Get(k)
+				total += v
+			}
+			if total != goroutines*n {
+				t.Errorf("sum of other keys = %d, want %d", total, goroutines*n)
+			}
+		})
+	}
+}
+
+func TestUpdateDelete(t *testing.T) {
+	c := newTestCache[int, string](t)
+	c.Set(1, "a")
+
+	v, stored := c.Update(1, func(old string, ok bool) (string, bool) {
+		if !ok || old != "a" {
+			t.Errorf("f got %q, %v, want %q, true", old, ok, "a")
+		}
+		return "", false
+	})
+	if stored || v != "" {
+		t.Errorf("Update() = %q, %v, want %q, false", v, stored, "")
+	}
+	if _, ok := c.Get(1); ok {
+		t.Error("Get() hit after Update returned false")
+	}
+}
+
+func TestCompareAndSwapConcurrent(t *testing.T) {
+	const goroutines, n = 8, 200
+
+	for _, tt := range atomicCacheOptions {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, int](t, tt.opts...)
+			c.Set(1, 0)
+
+			wg := sync.WaitGroup{}
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < n; i++ {
+						for {
+							old, _ := c.Get(1)
+							if c.CompareAndSwap(1, old, old+1) {
+								break
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if v, _ := c.Get(1); v != goroutines*n {
+				t.Errorf("Get(1) = %d, want %d", v, goroutines*n)
+			}
+		})
+	}
+}
+
+func TestCompareAndSwap(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	if c.CompareAndSwap(1, "", "a") {
+		t.Error("CompareAndSwap() swapped a missing key")
+	}
+	c.Set(1, "a")
+	if c.CompareAndSwap(1, "b", "c") {
+		t.Error("CompareAndSwap() swapped a different value")
+	}
+	if !c.CompareAndSwap(1, "a", "c") {
+		t.Error("CompareAndSwap() did not swap")
+	}
+	if v, _ := c.Get(1); v != "c" {
+		t.Errorf("Get() = %q, want %q", v, "c")
+	}
+}
+
+func TestLoadOrStoreConcurrent(t *testing.T) {
+	const goroutines = 16
+
+	for _, tt := range atomicCacheOptions {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, int](t, tt.opts...)
+
+			wg := sync.WaitGroup{}
+			actuals := make([]int, goroutines)
+			loadeds := make([]bool, goroutines)
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					actuals[g], loadeds[g] = c.LoadOrStore(1, g)
+				}(g)
+			}
+			wg.Wait()
+
+			stored := 0
+			for g := 0; g < goroutines; g++ {
+				if !loadeds[g] {
+					stored++
+				}
+				if actuals[g] != actuals[0] {
+					t.Errorf("LoadOrStore() returned %d and %d", actuals[0], actuals[g])
+				}
+			}
+			if stored != 1 {
+				t.Errorf("%d goroutines stored, want 1", stored)
+			}
+		})
+	}
+}
+
+// TestFillAfterWrite 読み込み中に書き込まれた場合、読み込んだ古い値をキャッシュに入れない
+func TestFillAfterWrite(t *testing.T) {
+	writes := []struct {
+		name   string
+		write  func(c *Cache[int, string])
+		want   string
+		wantOK bool
+	}{
+		{
+			name:   "Set",
+			write:  func(c *Cache[int, string]) { c.Set(1, "new") },
+			want:   "new",
+			wantOK: true,
+		},
+		{
+			name:  "Delete",
+			write: func(c *Cache[int, string]) { c.Delete(1) },
+		},
+		{
+			name: "Update",
+			write: func(c *Cache[int, string]) {
+				c.Update(1, func(string, bool) (string, bool) { return "updated", true })
+			},
+			want:   "updated",
+			wantOK: true,
+		},
+		{
+			name: "値が無いので格納しなかったUpdate",
+			write: func(c *Cache[int, string]) {
+				c.Update(1, func(old string, ok bool) (string, bool) { return old + "!", ok })
+			},
+		},
+		{
+			name:   "LoadOrStore",
+			write:  func(c *Cache[int, string]) { c.LoadOrStore(1, "stored") },
+			want:   "stored",
+			wantOK: true,
+		},
+		{
+			name:  "InvalidateTag",
+			write: func(c *Cache[int, string]) { c.InvalidateTag("tag") },
+		},
+		{
+			name:  "Reset",
+			write: func(c *Cache[int, string]) { c.Reset() },
+		},
+	}
+
+	loads := []struct {
+		name string
+		load func(c *Cache[int, string], loader func(int) (string, error))
+	}{
+		{
+			name: "GetOrLoad",
+			load: func(c *Cache[int, string], loader func(int) (string, error)) {
+				_, _ = c.GetOrLoad(1, loader)
+			},
+		},
+		{
+			name: "GetManyOrLoad",
+			load: func(c *Cache[int, string], loader func(int) (string, error)) {
+				_, _ = c.GetManyOrLoad([]int{1}, func(keys []int) (map[int]string, error) {
+					v, err := loader(keys[0])
+					return map[int]string{keys[0]: v}, err
+				})
+			},
+		},
+	}
+
+	for _, l := range loads {
+		for _, w := range writes {
+			t.Run(l.name+"/"+w.name, func(t *testing.T) {
+				c := newTestCache[int, string](t, WithTagger(func(int, string) []string { return []string{"tag"} }))
+
+				started := make(chan struct{})
+				release := make(chan struct{})
+				done := make(chan struct{})
+				go func() {
+					defer close(done)
+					l.load(c, func(int) (string, error) {
+						close(started)
+						<-release
+						return "stale", nil
+					})
+				}()
+
+				<-started
+				w.write(c)
+				close(release)
+				<-done
+
+				v, ok := c.Get(1)
+				if ok != w.wantOK || v != w.want {
+					t.Errorf("Get() = %q, %v, want %q, %v", v, ok, w.want, w.wantOK)
+				}
+			})
+		}
+	}
+}
+
+func TestFillWithoutWrite(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	// 読み込み中に書き込みが無ければ入る
+	v, err := c.GetOrLoad(1, loadString("db"))
+	if err != nil || v != "db" {
+		t.Fatalf("GetOrLoad() = %q, %v", v, err)
+	}
+	if v, ok := c.Get(1); !ok || v != "db" {
+		t.Errorf("Get() = %q, %v, want %q, true", v, ok, "db")
+	}
+}
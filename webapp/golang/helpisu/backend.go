@@ -0,0 +1,276 @@
+package helpisu
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+// Backend Cacheがエントリを保持する方法
+type Backend int
+
+const (
+	// BackendSyncMap sync.Mapで保持する(デフォルト)
+	//
+	//	読み込みが多く、書き込みが少ないキャッシュに向いています
+	BackendSyncMap Backend = iota + 1
+	// BackendSharded map + sync.RWMutexをシャードに分けて保持する
+	//
+	//	コメント数のように頻繁に書き換わるキャッシュに向いています
+	BackendSharded
+)
+
+// defaultShards BackendShardedのデフォルトのシャード数
+const defaultShards = 32
+
+// syncMapLockSlots BackendSyncMapで書き込みを直列化するロックの数
+//
+//	sync.Map自体はロックを必要としないので、Keyのハッシュ値でロックを分けて別のKeyへの書き込みを並行に行えるようにします
+const syncMapLockSlots = 64
+
+// backend エントリの格納先
+//
+//	各メソッドは並行に呼ばれても安全であること
+//	同じKeyに対するstore, deleteはCache側でslotごとのロックを取って直列化されます
+type backend[K comparable, V any] interface {
+	load(key K) (*entry[V], bool)
+	// store エントリを格納し、直前に格納されていたエントリを返す
+	store(key K, e *entry[V]) (old *entry[V], loaded bool)
+	// delete エントリを削除する。expectがnilでない場合、格納されているエントリがexpectと同じときだけ削除する
+	delete(key K, expect *entry[V]) (*entry[V], bool)
+	// rangeEntries 全てのエントリに対してfを呼ぶ。fの中でstore, deleteを呼んでも構わない
+	rangeEntries(f func(key K, e *entry[V]) bool)
+	clear()
+	// slot keyの書き込みを直列化するロックの番号(0 <= slot < slots())
+	slot(key K) int
+	slots() int
+}
+
+func newBackend[K comparable, V any](b Backend, shards int) backend[K, V] {
+	switch b {
+	case BackendSharded:
+		if shards <= 0 {
+			shards = defaultShards
+		}
+		return newShardedBackend[K, V](shards)
+	default:
+		return newSyncMapBackend[K, V]()
+	}
+}
+
+// syncMapBackend sync.Mapによるbackend
+type syncMapBackend[K comparable, V any] struct {
+	m atomic.Pointer[sync.Map]
+}
+
+func newSyncMapBackend[K comparable, V any]() *syncMapBackend[K, V] {
+	b := &syncMapBackend[K, V]{}
+	b.m.Store(&sync.Map{})
+
+	return b
+}
+
+func (b *syncMapBackend[K, V]) load(key K) (*entry[V], bool) {
+	v, ok := b.m.Load().Load(key)
+	if !ok {
+		return nil, false
+	}
+
+	e, ok := v.(*entry[V])
+	return e, ok
+}
+
+func (b *syncMapBackend[K, V]) store(key K, e *entry[V]) (*entry[V], bool) {
+	m := b.m.Load()
+	old, loaded := m.Load(key)
+	m.Store(key, e)
+	if !loaded {
+		return nil, false
+	}
+
+	oe, _ := old.(*entry[V])
+	return oe, true
+}
+
+func (b *syncMapBackend[K, V]) delete(key K, expect *entry[V]) (*entry[V], bool) {
+	m := b.m.Load()
+	v, ok := m.Load(key)
+	if !ok {
+		return nil, false
+	}
+
+	e, _ := v.(*entry[V])
+	if expect != nil && e != expect {
+		return nil, false
+	}
+
+	m.Delete(key)
+	return e, true
+}
+
+func (b *syncMapBackend[K, V]) rangeEntries(f func(key K, e *entry[V]) bool) {
+	b.m.Load().Range(func(key, value interface{}) bool {
+		k, _ := key.(K)
+		e, ok := value.(*entry[V])
+		if !ok {
+			return true
+		}
+
+		return f(k, e)
+	})
+}
+
+func (b *syncMapBackend[K, V]) clear() {
+	b.m.Store(&sync.Map{})
+}
+
+func (b *syncMapBackend[K, V]) slot(key K) int {
+	return int(hashKey(key) % syncMapLockSlots)
+}
+
+func (b *syncMapBackend[K, V]) slots() int {
+	return syncMapLockSlots
+}
+
+type shard[K comparable, V any] struct {
+	mu sync.RWMutex
+	m  map[K]*entry[V]
+}
+
+// shardedBackend map + sync.RWMutexをシャードに分けたbackend
+type shardedBackend[K comparable, V any] struct {
+	shards []shard[K, V]
+}
+
+func newShardedBackend[K comparable, V any](n int) *shardedBackend[K, V] {
+	b := &shardedBackend[K, V]{
+		shards: make([]shard[K, V], n),
+	}
+	for i := range b.shards {
+		b.shards[i].m = map[K]*entry[V]{}
+	}
+
+	return b
+}
+
+func (b *shardedBackend[K, V]) shardFor(key K) *shard[K, V] {
+	return &b.shards[b.slot(key)]
+}
+
+func (b *shardedBackend[K, V]) load(key K) (*entry[V], bool) {
+	s := b.shardFor(key)
+	s.mu.RLock()
+	e, ok := s.m[key]
+	s.mu.RUnlock()
+
+	return e, ok
+}
+
+func (b *shardedBackend[K, V]) store(key K, e *entry[V]) (*entry[V], bool) {
+	s := b.shardFor(key)
+	s.mu.Lock()
+	old, loaded := s.m[key]
+	s.m[key] = e
+	s.mu.Unlock()
+
+	return old, loaded
+}
+
+func (b *shardedBackend[K, V]) delete(key K, expect *entry[V]) (*entry[V], bool) {
+	s := b.shardFor(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.m[key]
+	if !ok || (expect != nil && e != expect) {
+		return nil, false
+	}
+
+	delete(s.m, key)
+	return e, true
+}
+
+func (b *shardedBackend[K, V]) rangeEntries(f func(key K, e *entry[V]) bool) {
+	type kv struct {
+		key K
+		e   *entry[V]
+	}
+
+	for i := range b.shards {
+		s := &b.shards[i]
+
+		// fの中で書き込めるよう、ロックを外してから呼ぶ
+		s.mu.RLock()
+		kvs := make([]kv, 0, len(s.m))
+		for k, e := range s.m {
+			kvs = append(kvs, kv{key: k, e: e})
+		}
+		s.mu.RUnlock()
+
+		for _, p := range kvs {
+			if !f(p.key, p.e) {
+				return
+			}
+		}
+	}
+}
+
+func (b *shardedBackend[K, V]) clear() {
+	for i := range b.shards {
+		s := &b.shards[i]
+		s.mu.Lock()
+		s.m = map[K]*entry[V]{}
+		s.mu.Unlock()
+	}
+}
+
+func (b *shardedBackend[K, V]) slot(key K) int {
+	return int(hashKey(key) % uint64(len(b.shards)))
+}
+
+func (b *shardedBackend[K, V]) slots() int {
+	return len(b.shards)
+}
+
+// hashKey シャードを決めるためのKeyのハッシュ値
+//
+//	整数と文字列はそのまま、それ以外はfmtで文字列にしてからハッシュします
+func hashKey[K comparable](key K) uint64 {
+	switch k := any(key).(type) {
+	case int:
+		return mix64(uint64(k))
+	case int64:
+		return mix64(uint64(k))
+	case int32:
+		return mix64(uint64(k))
+	case uint:
+		return mix64(uint64(k))
+	case uint64:
+		return mix64(k)
+	case uint32:
+		return mix64(uint64(k))
+	case string:
+		return hashString(k)
+	default:
+		return hashString(fmt.Sprintf("%#v", key))
+	}
+}
+
+// mix64 連番のIDが同じシャードに偏らないよう、ビットを混ぜる(splitmix64)
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+
+	return x
+}
+
+func hashString(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+
+	return h.Sum64()
+}
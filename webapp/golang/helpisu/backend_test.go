@@ -0,0 +1,99 @@
+package helpisu
+
+import (
+	"math/rand"
+	"testing"
+)
+
+const benchKeys = 10000
+
+func TestBackendSlots(t *testing.T) {
+	tests := []struct {
+		name    string
+		backend Backend
+		shards  int
+	}{
+		{"SyncMap", BackendSyncMap, 0},
+		{"Sharded", BackendSharded, 0},
+		{"Sharded(4)", BackendSharded, 4},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newBackend[int, int](tt.backend, tt.shards)
+
+			// 別のKeyへの書き込みが1つのロックに集まらないこと
+			if b.slots() < 2 {
+				t.Fatalf("slots() = %d, want >= 2", b.slots())
+			}
+			used := map[int]bool{}
+			for k := 0; k < 1000; k++ {
+				s := b.slot(k)
+				if s < 0 || s >= b.slots() {
+					t.Fatalf("slot(%d) = %d, out of [0, %d)", k, s, b.slots())
+				}
+				if s != b.slot(k) {
+					t.Fatalf("slot(%d) is not stable", k)
+				}
+				used[s] = true
+			}
+			if len(used) != b.slots() {
+				t.Errorf("1000 keys used %d of %d slots", len(used), b.slots())
+			}
+		})
+	}
+}
+
+func benchmarkBackends(b *testing.B, f func(b *testing.B, c *Cache[int, int])) {
+	backends := []struct {
+		name    string
+		backend Backend
+	}{
+		{"SyncMap", BackendSyncMap},
+		{"Sharded", BackendSharded},
+	}
+
+	for _, bb := range backends {
+		// b.Runの関数はb.Nを変えて何度も呼ばれるので、キャッシュは外で1度だけ作る
+		c := NewCache[int, int]("bench_"+bb.name, WithBackend(bb.backend))
+		b.Cleanup(func() { unregister(c) })
+		for k := 0; k < benchKeys; k++ {
+			c.Set(k, k)
+		}
+
+		b.Run(bb.name, func(b *testing.B) {
+			f(b, c)
+		})
+	}
+}
+
+// BenchmarkReadHeavy Get 9割、Set 1割
+func BenchmarkReadHeavy(b *testing.B) {
+	benchmarkBackends(b, func(b *testing.B, c *Cache[int, int]) {
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				k := r.Intn(benchKeys)
+				if r.Intn(10) == 0 {
+					c.Set(k, k)
+				} else {
+					c.Get(k)
+				}
+			}
+		})
+	})
+}
+
+// BenchmarkWriteHeavy コメント数のカウントアップのようにUpdateばかり呼ぶ
+func BenchmarkWriteHeavy(b *testing.B) {
+	benchmarkBackends(b, func(b *testing.B, c *Cache[int, int]) {
+		b.RunParallel(func(pb *testing.PB) {
+			r := rand.New(rand.NewSource(rand.Int63()))
+			for pb.Next() {
+				c.Update(r.Intn(benchKeys), func(n int, ok bool) (int, bool) {
+					return n + 1, true
+				})
+			}
+		})
+	})
+}
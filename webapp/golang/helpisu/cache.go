@@ -2,89 +2,566 @@ package helpisu
 
 import (
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type resetter interface {
-	Reset()
-}
-
-var generatedCaches = []resetter{}
-
 /*
 Cache ジェネリックで、スレッドセーフなマップキャッシュ
 
-	sync.Mapのジェネリックなラッパーです
+	デフォルトではsync.Mapのジェネリックなラッパーです(WithBackendで変更できます)
+	WithTTLを指定すると、期限切れのエントリはミスとして扱われます
+	WithMaxEntries, WithMaxBytesを指定すると、上限を超えた分はEvictionPolicyに従って追い出されます
 */
 type Cache[K comparable, V any] struct {
-	m *sync.Map
+	name    string
+	backend backend[K, V]
+	bus     *InvalidationBus
+	remote  *RemoteTier
+	ttl     time.Duration
+	stats   counters
+	entries atomic.Int64
+	bytes   atomic.Int64
+
+	// keyLocks 同じKeyへの書き込みを直列化する(backendのslotごと)
+	keyLocks []sync.Mutex
+	// writes slotごとの書き込みの回数
+	//
+	//	DBなどから読み込んでいる間に書き込まれたかどうかをfillで確かめるために使います
+	writes []atomic.Uint64
+
+	// mu 上限がある場合に、全ての書き込みと追い出し対象の管理を直列化する
+	mu         sync.Mutex
+	policy     evictionPolicy[K]
+	maxEntries int
+	maxBytes   int64
+	sizer      func(key, value any) int64
+	onEvict    func(key, value any)
+
+	tagMu  sync.Mutex
+	tags   tagIndex[K]
+	tagger func(key, value any) []string
+
+	flight   flightGroup[K, V]
+	errorTTL time.Duration
+
+	snapshotFormat SnapshotFormat
+	snapshotSchema int
+
+	warmUpMu sync.Mutex
+	warmUps  []WarmUpFunc[K, V]
+
+	stopJanitor chan struct{}
+	stopOnce    sync.Once
+}
+
+// entry キャッシュに格納する値と有効期限(UnixNano、0なら無期限)
+//
+//	generation, versionはWithInvalidationを指定した場合に、書き込んだ時点のmemcached上の値を記録します
+type entry[V any] struct {
+	value      V
+	expireAt   int64
+	size       int64
+	generation uint64
+	version    uint64
+	tags       []string
+}
+
+func (e *entry[V]) expired(now int64) bool {
+	return e.expireAt != 0 && now >= e.expireAt
 }
 
 // NewCache 新たなCacheを作成
-func NewCache[K comparable, V any]() *Cache[K, V] {
+//
+//	nameはStatsなどでキャッシュを区別するために使います
+func NewCache[K comparable, V any](name string, opts ...Option) *Cache[K, V] {
+	cfg := newConfig(opts)
+
 	c := Cache[K, V]{
-		m: &sync.Map{},
+		name:           name,
+		backend:        newBackend[K, V](cfg.backend, cfg.shards),
+		bus:            cfg.bus,
+		remote:         cfg.remote,
+		tagger:         cfg.tagger,
+		ttl:            cfg.ttl,
+		maxEntries:     cfg.maxEntries,
+		maxBytes:       cfg.maxBytes,
+		sizer:          cfg.sizer,
+		onEvict:        cfg.onEvict,
+		errorTTL:       cfg.errorTTL,
+		snapshotFormat: cfg.snapshotFormat,
+		snapshotSchema: cfg.snapshotSchema,
 	}
 
-	generatedCaches = append(generatedCaches, &c)
+	if c.bounded() {
+		c.policy = newEvictionPolicy[K](cfg.eviction)
+	}
+	if c.maxBytes > 0 && c.sizer == nil {
+		c.sizer = func(key, value any) int64 {
+			return estimateSize(key) + estimateSize(value)
+		}
+	}
+
+	if cfg.janitorInterval > 0 {
+		c.stopJanitor = make(chan struct{})
+		go c.runJanitor(cfg.janitorInterval)
+	}
+
+	c.keyLocks = make([]sync.Mutex, c.backend.slots())
+	c.writes = make([]atomic.Uint64, c.backend.slots())
+	register(&c)
 
 	return &c
 }
 
+// lock keyへの書き込みのロックを取り、解放する関数を返す
+//
+//	上限がある場合は追い出しのため全体のロック(mu)を、無い場合はslotごとのロックを取ります
+func (c *Cache[K, V]) lock(key K) (unlock func()) {
+	if c.policy != nil {
+		c.mu.Lock()
+		return c.mu.Unlock
+	}
+
+	l := &c.keyLocks[c.backend.slot(key)]
+	l.Lock()
+	return l.Unlock
+}
+
+// lockAll 全てのKeyの書き込みのロックを取り、解放する関数を返す
+func (c *Cache[K, V]) lockAll() (unlock func()) {
+	c.mu.Lock()
+	for i := range c.keyLocks {
+		c.keyLocks[i].Lock()
+	}
+
+	return func() {
+		for i := range c.keyLocks {
+			c.keyLocks[i].Unlock()
+		}
+		c.mu.Unlock()
+	}
+}
+
+// wroteLocked keyへの書き込みを記録する
+//
+//	lock(key)を取った状態で呼ぶこと
+func (c *Cache[K, V]) wroteLocked(key K) {
+	c.writes[c.backend.slot(key)].Add(1)
+}
+
+// wroteAllLocked 全てのKeyへの書き込みを記録する
+//
+//	lockAll()を取った状態で呼ぶこと
+func (c *Cache[K, V]) wroteAllLocked() {
+	for i := range c.writes {
+		c.writes[i].Add(1)
+	}
+}
+
+// writeEpoch keyを含むslotへの書き込みの回数
+//
+//	DBなどから読み込む前に取得してfillに渡します
+func (c *Cache[K, V]) writeEpoch(key K) uint64 {
+	return c.writes[c.backend.slot(key)].Load()
+}
+
+func (c *Cache[K, V]) bounded() bool {
+	return c.maxEntries > 0 || c.maxBytes > 0
+}
+
+// load 期限切れと他のプロセスでの書き換えを考慮してエントリを取得
+func (c *Cache[K, V]) load(key K) (*entry[V], bool) {
+	e, ok := c.loadLocal(key)
+	if !ok {
+		return nil, false
+	}
+
+	if !c.valid(key, e) {
+		// 他のプロセスで書き換えられている
+		c.drop(key, e)
+		return nil, false
+	}
+
+	c.touch(key)
+	return e, true
+}
+
+// loadMany loadと同じく複数のエントリをまとめて取得する
+//
+//	WithInvalidationのバージョンはKeyごとではなく、stampBatchSize件ずつまとめてmemcachedに問い合わせます
+func (c *Cache[K, V]) loadMany(keys []K) map[K]*entry[V] {
+	found := make(map[K]*entry[V], len(keys))
+	for _, k := range keys {
+		if _, ok := found[k]; ok {
+			continue
+		}
+		if e, ok := c.loadLocal(k); ok {
+			found[k] = e
+		}
+	}
+
+	if c.bus != nil && len(found) > 0 {
+		ks := make([]K, 0, len(found))
+		es := make([]*entry[V], 0, len(found))
+		for k, e := range found {
+			ks = append(ks, k)
+			es = append(es, e)
+		}
+		for i, ok := range c.validMany(ks, es) {
+			if !ok {
+				c.drop(ks[i], es[i])
+				delete(found, ks[i])
+			}
+		}
+	}
+
+	for k := range found {
+		c.touch(k)
+	}
+
+	return found
+}
+
+// loadLocal 期限切れを考慮してエントリを取得する(他のプロセスでの書き換えは確かめない)
+func (c *Cache[K, V]) loadLocal(key K) (*entry[V], bool) {
+	e, ok := c.backend.load(key)
+	if !ok {
+		return nil, false
+	}
+
+	if e.expired(time.Now().UnixNano()) {
+		// 遅延削除
+		c.drop(key, e)
+		return nil, false
+	}
+
+	return e, true
+}
+
+// drop 取得したエントリがまだ格納されていれば削除する
+func (c *Cache[K, V]) drop(key K, e *entry[V]) {
+	unlock := c.lock(key)
+	c.deleteLocked(key, e)
+	unlock()
+}
+
+// touch 参照されたことを追い出しの順番に記録する
+//
+//	参照のたびに全体のロックを待たないよう、他のgoroutineが持っている場合は参照の記録を諦めます
+//	(追い出す順番が多少ずれるだけで、上限は守られます)
+func (c *Cache[K, V]) touch(key K) {
+	if c.policy != nil && c.mu.TryLock() {
+		c.policy.touch(key)
+		c.mu.Unlock()
+	}
+}
+
+// storeLocked エントリを格納して、上限を超えた分を追い出す
+//
+//	lock(key)を取った状態で呼ぶこと
+//	追い出したエントリを返すので、ロックを外してからnotifyEvictedに渡すこと
+func (c *Cache[K, V]) storeLocked(key K, e *entry[V]) []evicted[K, V] {
+	if c.sizer != nil {
+		e.size = c.sizer(key, e.value)
+	}
+	if c.tagger != nil {
+		tags := append([]string(nil), e.tags...)
+		e.tags = uniqueKeys(append(tags, c.tagger(key, e.value)...))
+	}
+
+	old, loaded := c.backend.store(key, e)
+	if loaded {
+		if old != nil {
+			c.bytes.Add(-old.size)
+		}
+	} else {
+		c.entries.Add(1)
+	}
+	c.bytes.Add(e.size)
+	c.indexTags(key, old, e)
+
+	if c.policy == nil {
+		return nil
+	}
+
+	// 入れたばかりのエントリが追い出されないよう、他のエントリから追い出してから登録する
+	c.policy.remove(key)
+	evictedEntries := c.evictLocked()
+	c.policy.add(key)
+
+	// 単体で上限を超えるエントリは保持しない
+	return append(evictedEntries, c.evictLocked()...)
+}
+
+// evictLocked 上限を下回るまでエントリを追い出す
+func (c *Cache[K, V]) evictLocked() []evicted[K, V] {
+	var evictedEntries []evicted[K, V]
+	for c.overflowed() {
+		k, ok := c.policy.victim()
+		if !ok {
+			break
+		}
+
+		if e, ok := c.deleteLocked(k, nil); ok {
+			c.stats.evictions.Add(1)
+			evictedEntries = append(evictedEntries, evicted[K, V]{key: k, value: e.value})
+		}
+	}
+
+	return evictedEntries
+}
+
+func (c *Cache[K, V]) overflowed() bool {
+	return (c.maxEntries > 0 && c.entries.Load() > int64(c.maxEntries)) ||
+		(c.maxBytes > 0 && c.bytes.Load() > c.maxBytes)
+}
+
+// deleteLocked 指定したKeyのエントリを削除する
+//
+//	lock(key)を取った状態で呼ぶこと
+//	expectがnilでない場合、格納されているエントリがexpectと同じときだけ削除します
+func (c *Cache[K, V]) deleteLocked(key K, expect *entry[V]) (*entry[V], bool) {
+	e, ok := c.backend.delete(key, expect)
+	if !ok {
+		return nil, false
+	}
+
+	c.entries.Add(-1)
+	if e != nil {
+		c.bytes.Add(-e.size)
+	}
+	c.unindexTags(key, e)
+	if c.policy != nil {
+		c.policy.remove(key)
+	}
+
+	return e, e != nil
+}
+
+type evicted[K comparable, V any] struct {
+	key   K
+	value V
+}
+
+func (c *Cache[K, V]) notifyEvicted(evictedEntries []evicted[K, V]) {
+	if c.onEvict == nil {
+		return
+	}
+
+	for _, ev := range evictedEntries {
+		c.onEvict(ev.key, ev.value)
+	}
+}
+
 // Get 指定したKeyのキャッシュを取得
 func (c *Cache[K, V]) Get(key K) (value V, ok bool) {
-	v, ok := c.m.Load(key)
+	e, ok := c.load(key)
+	if ok {
+		c.stats.hits.Add(1)
+		return e.value, true
+	}
+
+	return c.getRemote(key)
+}
+
+// getRemote ローカルに無かったKeyを、WithRemoteを指定している場合はmemcachedから読む
+func (c *Cache[K, V]) getRemote(key K) (value V, ok bool) {
+	epoch := c.writeEpoch(key)
+	e, ok := c.remoteGet(key)
 	if !ok {
+		c.stats.misses.Add(1)
 		return
 	}
 
-	value, ok = v.(V)
+	// バージョンを記録しないと、WithInvalidationを指定している場合に次のGetでvalidに弾かれる
+	c.stamp(key, e, false)
 
-	return
+	// memcachedから読んでいる間に書き込まれていたら、ローカルには入れない
+	unlock := c.lock(key)
+	var evictedEntries []evicted[K, V]
+	if c.writeEpoch(key) == epoch {
+		evictedEntries = c.storeLocked(key, e)
+	}
+	unlock()
+	c.notifyEvicted(evictedEntries)
+
+	c.stats.remoteHits.Add(1)
+	return e.value, true
 }
 
 // GetAndDelete 指定したKeyのキャッシュを取得して削除
 func (c *Cache[K, V]) GetAndDelete(key K) (value V, ok bool) {
-	v, ok := c.m.LoadAndDelete(key)
-	if !ok {
-		return
-	}
+	unlock := c.lock(key)
+	e, ok := c.deleteLocked(key, nil)
+	c.wroteLocked(key)
+	unlock()
 
-	value, ok = v.(V)
+	if ok {
+		c.stats.deletes.Add(1)
+	}
+	hit := ok && !e.expired(time.Now().UnixNano()) && c.valid(key, e)
+	if !hit {
+		e, hit = c.remoteGet(key)
+	}
+	c.publishDelete(key)
+	c.remoteDelete(key)
+	if !hit {
+		c.stats.misses.Add(1)
+		return value, false
+	}
 
-	return
+	c.stats.hits.Add(1)
+	return e.value, true
 }
 
 // Set 指定したKey-Valueのセットをキャッシュに入れる
-func (c *Cache[K, V]) Set(key K, value V) {
-	c.m.Store(key, value)
+//
+//	有効期限はWithTTLで指定したデフォルト値になります
+//	tagsを指定すると、InvalidateTagでまとめて削除できます
+func (c *Cache[K, V]) Set(key K, value V, tags ...string) {
+	c.SetWithTTL(key, value, c.ttl, tags...)
+}
+
+// SetWithTTL 有効期限を指定してKey-Valueのセットをキャッシュに入れる
+//
+//	ttlが0以下の場合は無期限になります
+func (c *Cache[K, V]) SetWithTTL(key K, value V, ttl time.Duration, tags ...string) {
+	e := &entry[V]{value: value, tags: tags}
+	if ttl > 0 {
+		e.expireAt = time.Now().Add(ttl).UnixNano()
+	}
+	c.stamp(key, e, true)
+
+	unlock := c.lock(key)
+	evictedEntries := c.storeLocked(key, e)
+	c.wroteLocked(key)
+	unlock()
+
+	c.remoteSet(key, e)
+	c.stats.sets.Add(1)
+
+	c.notifyEvicted(evictedEntries)
 }
 
 // Delete 指定したKeyのキャッシュを削除
 func (c *Cache[K, V]) Delete(key K) {
-	c.m.Delete(key)
+	unlock := c.lock(key)
+	_, ok := c.deleteLocked(key, nil)
+	// 読み込み中の値も古くなったので、無かった場合も記録する
+	c.wroteLocked(key)
+	unlock()
+
+	c.publishDelete(key)
+	c.remoteDelete(key)
+	if ok {
+		c.stats.deletes.Add(1)
+	}
+}
+
+// Len キャッシュに入っているエントリ数(期限切れで未削除のものを含む)
+func (c *Cache[K, V]) Len() int {
+	return int(c.entries.Load())
 }
 
 // ForEach キャッシュの全ての要素に対して処理を行う
+//
+//	期限切れのエントリはスキップされます
 func (c *Cache[K, V]) ForEach(f func(key K, value V) error) (err error) {
-	c.m.Range(func(key, value interface{}) bool {
-		k, _ := key.(K)
-		v, _ := value.(V)
+	now := time.Now().UnixNano()
 
-		err = f(k, v)
+	c.backend.rangeEntries(func(k K, e *entry[V]) bool {
+		if e.expired(now) {
+			return true
+		}
+
+		err = f(k, e.value)
 		return err == nil
 	})
 
 	return
 }
 
+// DeleteExpired 期限切れのエントリを全て削除
+func (c *Cache[K, V]) DeleteExpired() {
+	now := time.Now().UnixNano()
+
+	c.backend.rangeEntries(func(k K, e *entry[V]) bool {
+		if e.expired(now) {
+			unlock := c.lock(k)
+			c.deleteLocked(k, e)
+			unlock()
+		}
+		return true
+	})
+}
+
+// runJanitor 一定間隔で期限切れのエントリを削除する
+func (c *Cache[K, V]) runJanitor(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.DeleteExpired()
+		case <-c.stopJanitor:
+			return
+		}
+	}
+}
+
+// StopJanitor WithJanitorで起動したgoroutineを停止
+func (c *Cache[K, V]) StopJanitor() {
+	if c.stopJanitor == nil {
+		return
+	}
+
+	c.stopOnce.Do(func() {
+		close(c.stopJanitor)
+	})
+}
+
 // Reset 全てのキャッシュを削除
+//
+//	他のgoroutineから同時に読み書きされていても安全に呼べます
 func (c *Cache[K, V]) Reset() {
-	c.m = &sync.Map{}
+	c.reset()
 }
 
-// ResetAllCache `NewCache()`で生成した全てのキャッシュをリセット
-func ResetAllCache() {
-	for _, c := range generatedCaches {
-		c.Reset()
+// reset 全てのキャッシュを削除して、削除したエントリ数を返す
+func (c *Cache[K, V]) reset() int {
+	c.publishReset()
+	c.remoteReset()
+
+	cleared := c.clearEntries()
+
+	// GetOrLoadはflight.muを取ったままlock(key)を取るので、flight.muは全てのロックを外してから取る
+	c.flight.mu.Lock()
+	c.flight.failures = nil
+	c.flight.mu.Unlock()
+
+	return cleared
+}
+
+// clearEntries 全てのロックを取ってエントリを削除し、削除したエントリ数を返す
+func (c *Cache[K, V]) clearEntries() int {
+	// 書き込み中のものが無い状態で消すため、全てのロックを取る
+	unlock := c.lockAll()
+	defer unlock()
+
+	c.wroteAllLocked()
+	cleared := int(c.entries.Load())
+	c.backend.clear()
+	c.entries.Store(0)
+	c.bytes.Store(0)
+
+	c.tagMu.Lock()
+	c.tags.reset()
+	c.tagMu.Unlock()
+	if c.policy != nil {
+		c.policy.reset()
 	}
-}
\ No newline at end of file
+
+	return cleared
+}
@@ -0,0 +1,158 @@
+package helpisu
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestCache テスト用のCacheを作成する
+//
+//	テストの終了時にjanitorを止めて、ResetAllCacheなどの対象から外します
+func newTestCache[K comparable, V any](t testing.TB, opts ...Option) *Cache[K, V] {
+	t.Helper()
+
+	c := NewCache[K, V](t.Name(), opts...)
+	t.Cleanup(func() {
+		c.StopJanitor()
+		unregister(c)
+	})
+
+	return c
+}
+
+// waitFor condがtrueになるまで待つ(1秒で諦める)
+func waitFor(t *testing.T, cond func() bool) bool {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	return cond()
+}
+
+func TestTTL(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   []Option
+		set    func(c *Cache[int, string])
+		wantOK bool
+	}{
+		{
+			name:   "期限内",
+			opts:   []Option{WithTTL(time.Hour)},
+			set:    func(c *Cache[int, string]) { c.Set(1, "a") },
+			wantOK: true,
+		},
+		{
+			name:   "期限切れ",
+			opts:   []Option{WithTTL(10 * time.Millisecond)},
+			set:    func(c *Cache[int, string]) { c.Set(1, "a") },
+			wantOK: false,
+		},
+		{
+			name:   "SetWithTTLの有効期限が優先される",
+			opts:   []Option{WithTTL(time.Hour)},
+			set:    func(c *Cache[int, string]) { c.SetWithTTL(1, "a", 10*time.Millisecond) },
+			wantOK: false,
+		},
+		{
+			name:   "SetWithTTLに0を渡すと無期限",
+			opts:   []Option{WithTTL(10 * time.Millisecond)},
+			set:    func(c *Cache[int, string]) { c.SetWithTTL(1, "a", 0) },
+			wantOK: true,
+		},
+		{
+			name:   "WithTTLが無ければ無期限",
+			set:    func(c *Cache[int, string]) { c.Set(1, "a") },
+			wantOK: true,
+		},
+		{
+			name: "Updateで書き込んだ値も期限切れになる",
+			opts: []Option{WithTTL(10 * time.Millisecond)},
+			set: func(c *Cache[int, string]) {
+				c.Update(1, func(string, bool) (string, bool) { return "a", true })
+			},
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, string](t, tt.opts...)
+
+			tt.set(c)
+			time.Sleep(30 * time.Millisecond)
+
+			v, ok := c.Get(1)
+			if ok != tt.wantOK {
+				t.Fatalf("Get() = %q, %v, want ok = %v", v, ok, tt.wantOK)
+			}
+
+			// 期限切れのエントリはGetで削除される
+			wantLen := 0
+			if tt.wantOK {
+				wantLen = 1
+			}
+			if c.Len() != wantLen {
+				t.Errorf("Len() = %d, want %d", c.Len(), wantLen)
+			}
+		})
+	}
+}
+
+func TestDeleteExpired(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	c.SetWithTTL(1, "expired", 10*time.Millisecond)
+	c.Set(2, "alive")
+	time.Sleep(30 * time.Millisecond)
+
+	// 削除するまではLenに含まれるが、ForEachでは返さない
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+	keys := []int{}
+	_ = c.ForEach(func(k int, _ string) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if len(keys) != 1 || keys[0] != 2 {
+		t.Errorf("ForEach() keys = %v, want [2]", keys)
+	}
+
+	c.DeleteExpired()
+	if c.Len() != 1 {
+		t.Errorf("Len() after DeleteExpired = %d, want 1", c.Len())
+	}
+}
+
+func TestJanitor(t *testing.T) {
+	c := newTestCache[int, string](t, WithTTL(10*time.Millisecond), WithJanitor(5*time.Millisecond))
+
+	c.Set(1, "a")
+	if !waitFor(t, func() bool { return c.Len() == 0 }) {
+		t.Fatalf("janitor did not delete the expired entry: Len() = %d", c.Len())
+	}
+
+	// 何度呼んでもよい
+	c.StopJanitor()
+	c.StopJanitor()
+
+	c.Set(2, "b")
+	time.Sleep(50 * time.Millisecond)
+	if c.Len() != 1 {
+		t.Errorf("Len() after StopJanitor = %d, want 1 (janitor is still running)", c.Len())
+	}
+}
+
+func TestStopJanitorWithoutJanitor(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	// WithJanitorを指定していなくてもpanicしない
+	c.StopJanitor()
+}
@@ -0,0 +1,184 @@
+package helpisu
+
+import (
+	"container/heap"
+	"container/list"
+)
+
+// EvictionPolicy 上限を超えたときに追い出すエントリの選び方
+type EvictionPolicy int
+
+const (
+	// LRU 最も長い間参照されていないエントリから追い出す
+	LRU EvictionPolicy = iota + 1
+	// LFU 参照回数が最も少ないエントリから追い出す(同数なら古いもの)
+	LFU
+)
+
+// evictionPolicy 追い出し対象を管理する
+//
+//	Cacheのmuを取った状態で呼ぶこと
+type evictionPolicy[K comparable] interface {
+	add(key K)
+	touch(key K)
+	remove(key K)
+	victim() (K, bool)
+	reset()
+}
+
+func newEvictionPolicy[K comparable](p EvictionPolicy) evictionPolicy[K] {
+	switch p {
+	case LFU:
+		return newLFUPolicy[K]()
+	default:
+		return newLRUPolicy[K]()
+	}
+}
+
+type lruPolicy[K comparable] struct {
+	l     *list.List
+	elems map[K]*list.Element
+}
+
+func newLRUPolicy[K comparable]() *lruPolicy[K] {
+	return &lruPolicy[K]{
+		l:     list.New(),
+		elems: map[K]*list.Element{},
+	}
+}
+
+func (p *lruPolicy[K]) add(key K) {
+	if e, ok := p.elems[key]; ok {
+		p.l.MoveToFront(e)
+		return
+	}
+
+	p.elems[key] = p.l.PushFront(key)
+}
+
+func (p *lruPolicy[K]) touch(key K) {
+	if e, ok := p.elems[key]; ok {
+		p.l.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy[K]) remove(key K) {
+	if e, ok := p.elems[key]; ok {
+		p.l.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy[K]) victim() (key K, ok bool) {
+	e := p.l.Back()
+	if e == nil {
+		return
+	}
+
+	return e.Value.(K), true
+}
+
+func (p *lruPolicy[K]) reset() {
+	p.l.Init()
+	p.elems = map[K]*list.Element{}
+}
+
+type lfuItem[K comparable] struct {
+	key   K
+	freq  uint64
+	seq   uint64
+	index int
+}
+
+// lfuHeap 参照回数、最終参照順の小さい順に並ぶヒープ
+type lfuHeap[K comparable] []*lfuItem[K]
+
+func (h lfuHeap[K]) Len() int { return len(h) }
+
+func (h lfuHeap[K]) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K]) Push(x any) {
+	item := x.(*lfuItem[K])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap[K]) Pop() any {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return item
+}
+
+type lfuPolicy[K comparable] struct {
+	h     lfuHeap[K]
+	items map[K]*lfuItem[K]
+	seq   uint64
+}
+
+func newLFUPolicy[K comparable]() *lfuPolicy[K] {
+	return &lfuPolicy[K]{
+		items: map[K]*lfuItem[K]{},
+	}
+}
+
+func (p *lfuPolicy[K]) add(key K) {
+	if _, ok := p.items[key]; ok {
+		p.touch(key)
+		return
+	}
+
+	p.seq++
+	item := &lfuItem[K]{key: key, freq: 1, seq: p.seq}
+	heap.Push(&p.h, item)
+	p.items[key] = item
+}
+
+func (p *lfuPolicy[K]) touch(key K) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	p.seq++
+	item.freq++
+	item.seq = p.seq
+	heap.Fix(&p.h, item.index)
+}
+
+func (p *lfuPolicy[K]) remove(key K) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&p.h, item.index)
+	delete(p.items, key)
+}
+
+func (p *lfuPolicy[K]) victim() (key K, ok bool) {
+	if len(p.h) == 0 {
+		return
+	}
+
+	return p.h[0].key, true
+}
+
+func (p *lfuPolicy[K]) reset() {
+	p.h = nil
+	p.items = map[K]*lfuItem[K]{}
+	p.seq = 0
+}
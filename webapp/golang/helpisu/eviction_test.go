@@ -0,0 +1,196 @@
+package helpisu
+
+import (
+	"sort"
+	"sync"
+	"testing"
+)
+
+func TestEviction(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		// ops 上限を超える直前までの操作
+		ops         func(c *Cache[int, string])
+		wantEvicted []int
+	}{
+		{
+			name: "LRUは最も長い間参照されていないものから追い出す",
+			opts: []Option{WithMaxEntries(3), WithEvictionPolicy(LRU)},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Set(2, "b")
+				c.Set(3, "c")
+				c.Get(1)
+			},
+			wantEvicted: []int{2},
+		},
+		{
+			name: "デフォルトはLRU",
+			opts: []Option{WithMaxEntries(3)},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Set(2, "b")
+				c.Set(3, "c")
+				c.Get(1)
+				c.Get(2)
+			},
+			wantEvicted: []int{3},
+		},
+		{
+			name: "LFUは参照回数が最も少ないものから追い出す",
+			opts: []Option{WithMaxEntries(3), WithEvictionPolicy(LFU)},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Set(2, "b")
+				c.Set(3, "c")
+				c.Get(1)
+				c.Get(1)
+				c.Get(3)
+			},
+			wantEvicted: []int{2},
+		},
+		{
+			name: "LFUで参照回数が同じなら古いものから追い出す",
+			opts: []Option{WithMaxEntries(3), WithEvictionPolicy(LFU)},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Set(2, "b")
+				c.Set(3, "c")
+			},
+			wantEvicted: []int{1},
+		},
+		{
+			name: "バイト数の上限を超えた分を追い出す",
+			opts: []Option{
+				WithMaxBytes(25),
+				WithSizer(func(int, string) int64 { return 10 }),
+			},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Set(2, "b")
+			},
+			wantEvicted: []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var evictedKeys []int
+			opts := append(tt.opts, WithOnEvict(func(k int, _ string) {
+				evictedKeys = append(evictedKeys, k)
+			}))
+			c := newTestCache[int, string](t, opts...)
+
+			tt.ops(c)
+			if len(evictedKeys) != 0 {
+				t.Fatalf("evicted %v before reaching the limit", evictedKeys)
+			}
+
+			c.Set(4, "d")
+			if !equalKeys(evictedKeys, tt.wantEvicted) {
+				t.Errorf("evicted %v, want %v", evictedKeys, tt.wantEvicted)
+			}
+			for _, k := range tt.wantEvicted {
+				if _, ok := c.Get(k); ok {
+					t.Errorf("Get(%d) hit after eviction", k)
+				}
+			}
+			if _, ok := c.Get(4); !ok {
+				t.Error("Get(4) missed: the new entry was evicted")
+			}
+			if got := c.Stats().Evictions; got != int64(len(tt.wantEvicted)) {
+				t.Errorf("Stats().Evictions = %d, want %d", got, len(tt.wantEvicted))
+			}
+		})
+	}
+}
+
+func TestEvictionMaxBytes(t *testing.T) {
+	c := newTestCache[int, string](t,
+		WithMaxBytes(25),
+		WithSizer(func(_ int, v string) int64 { return int64(len(v)) }),
+	)
+
+	c.Set(1, "0123456789")
+	c.Set(2, "0123456789")
+	if got := c.Stats().Bytes; got != 20 {
+		t.Errorf("Stats().Bytes = %d, want 20", got)
+	}
+
+	// 書き換えたエントリのサイズは差し替えられる
+	c.Set(1, "01234")
+	if got := c.Stats().Bytes; got != 15 {
+		t.Errorf("Stats().Bytes after overwrite = %d, want 15", got)
+	}
+
+	// 単体で上限を超えるエントリは保持しない
+	c.Set(3, "012345678901234567890123456789")
+	if _, ok := c.Get(3); ok {
+		t.Error("Get(3) hit: an entry larger than the limit is kept")
+	}
+	if got := c.Stats().Bytes; got > 25 {
+		t.Errorf("Stats().Bytes = %d, want <= 25", got)
+	}
+}
+
+func TestOnEvictCanUseCache(t *testing.T) {
+	var c *Cache[int, string]
+	evicted := map[int]string{}
+	c = newTestCache[int, string](t,
+		WithMaxEntries(1),
+		WithOnEvict(func(k int, v string) {
+			// ロックを外してから呼ばれるので、デッドロックしない
+			evicted[k] = v
+			c.Delete(k + 100)
+		}),
+	)
+
+	c.Set(1, "a")
+	c.Set(2, "b")
+
+	if len(evicted) != 1 || evicted[1] != "a" {
+		t.Errorf("OnEvict got %v, want map[1:a]", evicted)
+	}
+}
+
+func TestEvictionConcurrent(t *testing.T) {
+	const maxEntries = 100
+	c := newTestCache[int, int](t, WithMaxEntries(maxEntries), WithEvictionPolicy(LFU))
+
+	wg := sync.WaitGroup{}
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				k := (g*1000 + i) % 300
+				c.Set(k, i)
+				c.Get(k)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	if c.Len() > maxEntries {
+		t.Errorf("Len() = %d, want <= %d", c.Len(), maxEntries)
+	}
+}
+
+func equalKeys(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	a = append([]int(nil), a...)
+	b = append([]int(nil), b...)
+	sort.Ints(a)
+	sort.Ints(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,293 @@
+package helpisu
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// MemcacheClient helpisuが使うmemcachedクライアントのメソッド
+//
+//	*memcache.Clientがそのまま使えます
+type MemcacheClient interface {
+	GetMulti(keys []string) (map[string]*memcache.Item, error)
+	Add(item *memcache.Item) error
+	Increment(key string, delta uint64) (newValue uint64, err error)
+}
+
+/*
+InvalidationBus memcachedを使って複数プロセスのCacheの無効化を伝える
+
+	Set, Delete, Update等で書き込むとKeyごとのバージョンを、Resetするとキャッシュ全体の世代を
+	memcached上でインクリメントします
+	各プロセスはヒットしたエントリを返す前にmemcachedのバージョンと世代を確認し、
+	自分が書き込んだときと異なれば他のプロセスで書き換えられたとみなしてミスにします
+	memcachedに繋がらない場合は確認を諦めてローカルのエントリを返します
+	(RemoteTierと同様に、エラーが起きてからしばらくの間はmemcachedに問い合わせません)
+*/
+type InvalidationBus struct {
+	client MemcacheClient
+	prefix string
+
+	// downUntil この時刻(UnixNano)まではmemcachedを使わない
+	downUntil atomic.Int64
+}
+
+// errMemcacheUnavailable エラーが起きた直後なのでmemcachedを使わなかった
+var errMemcacheUnavailable = errors.New("helpisu: memcached is unavailable")
+
+// NewInvalidationBus 新たなInvalidationBusを作成
+//
+//	prefixはmemcachedのKeyの先頭に付けます。同じキャッシュを共有するプロセス間で揃えてください
+func NewInvalidationBus(client MemcacheClient, prefix string) *InvalidationBus {
+	return &InvalidationBus{
+		client: client,
+		prefix: prefix,
+	}
+}
+
+func (b *InvalidationBus) available() bool {
+	return time.Now().UnixNano() >= b.downUntil.Load()
+}
+
+// check memcachedのエラーを記録する(ErrCacheMiss, ErrNotStoredは正常とみなす)
+func (b *InvalidationBus) check(err error) error {
+	if err != nil && !errors.Is(err, memcache.ErrCacheMiss) && !errors.Is(err, memcache.ErrNotStored) {
+		b.downUntil.Store(time.Now().Add(remoteRetryInterval).UnixNano())
+	}
+
+	return err
+}
+
+func (b *InvalidationBus) generationKey(cache string) string {
+	return memcacheKey(b.prefix, cache, "gen")
+}
+
+func (b *InvalidationBus) versionKey(cache string, key any) string {
+	return memcacheKey(b.prefix, cache, "v", fmt.Sprint(key))
+}
+
+// bump Keyの値をインクリメントして新しい値を返す(無ければ1から始める)
+func (b *InvalidationBus) bump(key string) (uint64, error) {
+	if !b.available() {
+		return 0, errMemcacheUnavailable
+	}
+
+	for i := 0; i < 2; i++ {
+		v, err := b.client.Increment(key, 1)
+		if err == nil {
+			return v, nil
+		}
+		if !errors.Is(err, memcache.ErrCacheMiss) {
+			return 0, b.check(err)
+		}
+
+		err = b.client.Add(&memcache.Item{Key: key, Value: []byte("1")})
+		if err == nil {
+			return 1, nil
+		}
+		if !errors.Is(err, memcache.ErrNotStored) {
+			return 0, b.check(err)
+		}
+		// 他のプロセスが先にAddしたのでIncrementからやり直す
+	}
+
+	v, err := b.client.Increment(key, 1)
+	return v, b.check(err)
+}
+
+// current 世代とKeyのバージョンを取得する(無い場合は0)
+func (b *InvalidationBus) current(genKey, verKey string) (gen, ver uint64, err error) {
+	if !b.available() {
+		return 0, 0, errMemcacheUnavailable
+	}
+
+	items, err := b.client.GetMulti([]string{genKey, verKey})
+	if b.check(err) != nil {
+		return 0, 0, err
+	}
+
+	gen, err = parseCounter(items[genKey])
+	if err != nil {
+		return 0, 0, err
+	}
+	ver, err = parseCounter(items[verKey])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return gen, ver, nil
+}
+
+// currentMany 世代と複数のKeyのバージョンを1回の問い合わせで取得する(無い場合は0)
+func (b *InvalidationBus) currentMany(genKey string, verKeys []string) (gen uint64, vers []uint64, err error) {
+	if !b.available() {
+		return 0, nil, errMemcacheUnavailable
+	}
+
+	items, err := b.client.GetMulti(append([]string{genKey}, verKeys...))
+	if b.check(err) != nil {
+		return 0, nil, err
+	}
+
+	gen, err = parseCounter(items[genKey])
+	if err != nil {
+		return 0, nil, err
+	}
+	vers = make([]uint64, len(verKeys))
+	for i, k := range verKeys {
+		vers[i], err = parseCounter(items[k])
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+
+	return gen, vers, nil
+}
+
+func parseCounter(item *memcache.Item) (uint64, error) {
+	if item == nil {
+		return 0, nil
+	}
+
+	return strconv.ParseUint(strings.TrimSpace(string(item.Value)), 10, 64)
+}
+
+// stamp 書き込むエントリに現在の世代と新しいバージョンを記録する
+//
+//	bumpがfalseの場合はバージョンを上げずに現在の値を記録します(DBから読み込んだ値を入れるとき)
+func (c *Cache[K, V]) stamp(key K, e *entry[V], bump bool) {
+	if c.bus == nil {
+		return
+	}
+
+	genKey, verKey := c.bus.generationKey(c.name), c.bus.versionKey(c.name, key)
+	gen, ver, err := c.bus.current(genKey, verKey)
+	if err != nil {
+		return
+	}
+	if bump {
+		ver, err = c.bus.bump(verKey)
+		if err != nil {
+			return
+		}
+	}
+
+	e.generation = gen
+	e.version = ver
+}
+
+// stampBatchSize stampManyで1度にmemcachedに問い合わせるKeyの数
+const stampBatchSize = 500
+
+// currentBatches keysの世代とバージョンをstampBatchSize件ずつまとめて取得し、バッチごとにfを呼ぶ
+//
+//	versにはkeys[start:]のバージョンが順に入ります。memcachedに繋がらなかったバッチは飛ばします
+func (c *Cache[K, V]) currentBatches(keys []K, f func(start int, gen uint64, vers []uint64)) {
+	genKey := c.bus.generationKey(c.name)
+	for start := 0; start < len(keys); start += stampBatchSize {
+		end := start + stampBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		verKeys := make([]string, 0, end-start)
+		for _, k := range keys[start:end] {
+			verKeys = append(verKeys, c.bus.versionKey(c.name, k))
+		}
+		gen, vers, err := c.bus.currentMany(genKey, verKeys)
+		if err != nil {
+			continue
+		}
+		f(start, gen, vers)
+	}
+}
+
+// stampMany 複数のエントリにstamp(key, e, false)と同じ値を記録する
+//
+//	memcachedへの問い合わせをstampBatchSize件ずつまとめます
+func (c *Cache[K, V]) stampMany(keys []K, entries []*entry[V]) {
+	if c.bus == nil {
+		return
+	}
+
+	c.currentBatches(keys, func(start int, gen uint64, vers []uint64) {
+		for i, ver := range vers {
+			entries[start+i].generation = gen
+			entries[start+i].version = ver
+		}
+	})
+}
+
+// publishDelete Keyを削除したことを他のプロセスに伝える
+func (c *Cache[K, V]) publishDelete(key K) {
+	if c.bus == nil {
+		return
+	}
+
+	_, _ = c.bus.bump(c.bus.versionKey(c.name, key))
+}
+
+// publishReset キャッシュ全体をリセットしたことを他のプロセスに伝える
+func (c *Cache[K, V]) publishReset() {
+	if c.bus == nil {
+		return
+	}
+
+	_, _ = c.bus.bump(c.bus.generationKey(c.name))
+}
+
+// valid エントリが他のプロセスで書き換えられていないか確認する
+func (c *Cache[K, V]) valid(key K, e *entry[V]) bool {
+	if c.bus == nil {
+		return true
+	}
+
+	gen, ver, err := c.bus.current(c.bus.generationKey(c.name), c.bus.versionKey(c.name, key))
+	if err != nil {
+		// memcachedに繋がらない場合はローカルのエントリを信じる
+		return true
+	}
+
+	return e.generation == gen && e.version == ver
+}
+
+// validMany 複数のエントリにvalidと同じ確認をまとめて行う
+//
+//	memcachedへの問い合わせをstampBatchSize件ずつまとめます
+func (c *Cache[K, V]) validMany(keys []K, entries []*entry[V]) []bool {
+	valid := make([]bool, len(keys))
+	for i := range valid {
+		// memcachedに繋がらない場合はローカルのエントリを信じる
+		valid[i] = true
+	}
+	if c.bus == nil {
+		return valid
+	}
+
+	c.currentBatches(keys, func(start int, gen uint64, vers []uint64) {
+		for i, ver := range vers {
+			e := entries[start+i]
+			valid[start+i] = e.generation == gen && e.version == ver
+		}
+	})
+
+	return valid
+}
+
+// memcacheKey memcachedのKeyを組み立てる
+//
+//	memcachedのKeyに使えない文字を含む場合や長すぎる場合はハッシュ値にします
+func memcacheKey(prefix string, parts ...string) string {
+	key := prefix + strings.Join(parts, ":")
+	if len(key) <= 250 && !strings.ContainsAny(key, " \t\r\n\x00\x7f") {
+		return key
+	}
+
+	return prefix + strconv.FormatUint(hashString(key), 16)
+}
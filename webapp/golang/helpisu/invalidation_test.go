@@ -0,0 +1,330 @@
+package helpisu
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+var errFakeDown = errors.New("fake memcached is down")
+
+// fakeMemcache プロセス内で動くMemcacheClientの実装
+type fakeMemcache struct {
+	mu    sync.Mutex
+	items map[string][]byte
+	down  bool
+	// calls 呼ばれたメソッドの回数(memcachedが落ちている間の呼び出しも数える)
+	calls map[string]int
+}
+
+func newFakeMemcache() *fakeMemcache {
+	return &fakeMemcache{items: map[string][]byte{}, calls: map[string]int{}}
+}
+
+func (f *fakeMemcache) callCount(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[method]
+}
+
+func (f *fakeMemcache) GetMulti(keys []string) (map[string]*memcache.Item, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["GetMulti"]++
+	if f.down {
+		return nil, errFakeDown
+	}
+
+	items := map[string]*memcache.Item{}
+	for _, k := range keys {
+		if v, ok := f.items[k]; ok {
+			items[k] = &memcache.Item{Key: k, Value: v}
+		}
+	}
+	return items, nil
+}
+
+func (f *fakeMemcache) Add(item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["Add"]++
+	if f.down {
+		return errFakeDown
+	}
+	if _, ok := f.items[item.Key]; ok {
+		return memcache.ErrNotStored
+	}
+
+	f.items[item.Key] = item.Value
+	return nil
+}
+
+func (f *fakeMemcache) Increment(key string, delta uint64) (uint64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["Increment"]++
+	if f.down {
+		return 0, errFakeDown
+	}
+	v, ok := f.items[key]
+	if !ok {
+		return 0, memcache.ErrCacheMiss
+	}
+
+	n, err := strconv.ParseUint(string(v), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	n += delta
+	f.items[key] = []byte(strconv.FormatUint(n, 10))
+	return n, nil
+}
+
+func (f *fakeMemcache) Get(key string) (*memcache.Item, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["Get"]++
+	if f.down {
+		return nil, errFakeDown
+	}
+	v, ok := f.items[key]
+	if !ok {
+		return nil, memcache.ErrCacheMiss
+	}
+
+	return &memcache.Item{Key: key, Value: v}, nil
+}
+
+func (f *fakeMemcache) Set(item *memcache.Item) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["Set"]++
+	if f.down {
+		return errFakeDown
+	}
+
+	f.items[item.Key] = item.Value
+	return nil
+}
+
+func (f *fakeMemcache) Delete(key string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls["Delete"]++
+	if f.down {
+		return errFakeDown
+	}
+	if _, ok := f.items[key]; !ok {
+		return memcache.ErrCacheMiss
+	}
+
+	delete(f.items, key)
+	return nil
+}
+
+func (f *fakeMemcache) setDown(down bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.down = down
+}
+
+// newPeers 同じmemcachedを共有する2つのプロセスのキャッシュを作る
+func newPeers(t *testing.T) (a, b *Cache[int, string], mc *fakeMemcache) {
+	t.Helper()
+
+	mc = newFakeMemcache()
+	a = newTestCache[int, string](t, WithInvalidation(NewInvalidationBus(mc, "test_")))
+	b = newTestCache[int, string](t, WithInvalidation(NewInvalidationBus(mc, "test_")))
+
+	return a, b, mc
+}
+
+func loadString(v string) func(int) (string, error) {
+	return func(int) (string, error) {
+		return v, nil
+	}
+}
+
+func TestInvalidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		write  func(a *Cache[int, string])
+		wantOK bool
+	}{
+		{
+			name:   "Set",
+			write:  func(a *Cache[int, string]) { a.Set(1, "new") },
+			wantOK: false,
+		},
+		{
+			name:   "Delete",
+			write:  func(a *Cache[int, string]) { a.Delete(1) },
+			wantOK: false,
+		},
+		{
+			name: "Update",
+			write: func(a *Cache[int, string]) {
+				a.Update(1, func(old string, ok bool) (string, bool) { return old + "!", true })
+			},
+			wantOK: false,
+		},
+		{
+			name:   "Reset",
+			write:  func(a *Cache[int, string]) { a.Reset() },
+			wantOK: false,
+		},
+		{
+			name: "GetOrLoadは無効化しない",
+			write: func(a *Cache[int, string]) {
+				_, _ = a.GetOrLoad(1, loadString("db"))
+			},
+			wantOK: true,
+		},
+		{
+			name:   "他のKeyへの書き込みは影響しない",
+			write:  func(a *Cache[int, string]) { a.Set(2, "other") },
+			wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, _ := newPeers(t)
+
+			v, err := b.GetOrLoad(1, loadString("db"))
+			if err != nil || v != "db" {
+				t.Fatalf("GetOrLoad() = %q, %v", v, err)
+			}
+
+			tt.write(a)
+
+			_, ok := b.Get(1)
+			if ok != tt.wantOK {
+				t.Errorf("Get() ok = %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestInvalidationOwnWrite(t *testing.T) {
+	a, _, _ := newPeers(t)
+
+	a.Set(1, "a")
+	a.Set(1, "b")
+
+	v, ok := a.Get(1)
+	if !ok || v != "b" {
+		t.Errorf("Get() = %q, %v, want %q, true", v, ok, "b")
+	}
+}
+
+func TestInvalidationMemcachedDown(t *testing.T) {
+	a, b, mc := newPeers(t)
+
+	b.Set(1, "b")
+	mc.setDown(true)
+
+	// memcachedに繋がらない場合はローカルのエントリを返す
+	a.Set(1, "a")
+	v, ok := b.Get(1)
+	if !ok || v != "b" {
+		t.Errorf("Get() = %q, %v, want %q, true", v, ok, "b")
+	}
+
+	// 再び問い合わせるまでの間隔が過ぎたものとする
+	mc.setDown(false)
+	a.bus.downUntil.Store(0)
+	v, ok = a.Get(1)
+	if ok {
+		t.Errorf("Get() = %q, %v, want miss", v, ok)
+	}
+}
+
+func TestInvalidationBackoff(t *testing.T) {
+	a, _, mc := newPeers(t)
+	a.Set(1, "a")
+
+	mc.setDown(true)
+	calls := mc.callCount("GetMulti") + mc.callCount("Increment") + mc.callCount("Add")
+	for i := 0; i < 10; i++ {
+		a.Get(1)
+		a.Set(2, "b")
+	}
+
+	// 最初のエラーの後は問い合わせない
+	if got := mc.callCount("GetMulti") + mc.callCount("Increment") + mc.callCount("Add") - calls; got != 1 {
+		t.Errorf("memcached called %d times while down, want 1", got)
+	}
+	if v, ok := a.Get(1); !ok || v != "a" {
+		t.Errorf("Get() = %q, %v, want %q, true", v, ok, "a")
+	}
+}
+
+func TestInvalidationGetMany(t *testing.T) {
+	tests := []struct {
+		name      string
+		get       func(b *Cache[int, string], keys []int) (map[int]string, []int)
+		wantCalls int
+	}{
+		{
+			name:      "GetMany",
+			get:       func(b *Cache[int, string], keys []int) (map[int]string, []int) { return b.GetMany(keys) },
+			wantCalls: 2,
+		},
+		{
+			name: "GetManyOrLoad",
+			get: func(b *Cache[int, string], keys []int) (map[int]string, []int) {
+				values, err := b.GetManyOrLoad(keys, func(keys []int) (map[int]string, error) {
+					loaded := make(map[int]string, len(keys))
+					for _, k := range keys {
+						loaded[k] = "db"
+					}
+					return loaded, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return values, nil
+			},
+			wantCalls: 3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, mc := newPeers(t)
+
+			keys := make([]int, stampBatchSize+10)
+			for i := range keys {
+				keys[i] = i
+				b.Set(i, "b")
+			}
+			a.Set(3, "a")
+
+			gets := mc.callCount("GetMulti")
+			values, _ := tt.get(b, keys)
+
+			// 確認はKeyごとではなくstampBatchSize件ずつ(GetManyOrLoadは読み込んだ値の記録でもう1回)
+			if got := mc.callCount("GetMulti") - gets; got != tt.wantCalls {
+				t.Errorf("GetMulti called %d times, want %d", got, tt.wantCalls)
+			}
+			if v, ok := values[3]; ok && v == "b" {
+				t.Errorf("values[3] = %q, want the stale entry dropped", v)
+			}
+			if v := values[4]; v != "b" {
+				t.Errorf("values[4] = %q, want %q", v, "b")
+			}
+		})
+	}
+}
@@ -0,0 +1,213 @@
+package helpisu
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ErrLoaderPanicked GetOrLoadのloaderがpanicした
+//
+//	同じKeyの読み込みを待っていた呼び出しに返します(panicしたgoroutineではpanicし直します)
+var ErrLoaderPanicked = errors.New("helpisu: loader panicked")
+
+// call 実行中のloaderの呼び出し
+type call[V any] struct {
+	wg    sync.WaitGroup
+	value V
+	err   error
+}
+
+// failure キャッシュしたloaderのエラー
+type failure struct {
+	err      error
+	expireAt int64
+}
+
+// flightGroup 同じKeyに対するloaderの呼び出しを1つにまとめる
+type flightGroup[K comparable, V any] struct {
+	mu       sync.Mutex
+	calls    map[K]*call[V]
+	failures map[K]failure
+}
+
+// GetOrLoad 指定したKeyのキャッシュを取得し、無ければloaderで読み込んでキャッシュに入れる
+//
+//	同じKeyに対して同時に呼ばれた場合、loaderは1回だけ実行され、他の呼び出しはその結果を待ちます
+//	loaderのエラーはキャッシュされません(WithErrorTTLを指定した場合はその期間だけキャッシュされます)
+func (c *Cache[K, V]) GetOrLoad(key K, loader func(key K) (V, error)) (V, error) {
+	if v, ok := c.Get(key); ok {
+		return v, nil
+	}
+
+	g := &c.flight
+	g.mu.Lock()
+	if f, ok := g.failures[key]; ok {
+		if time.Now().UnixNano() < f.expireAt {
+			g.mu.Unlock()
+			var zero V
+			return zero, f.err
+		}
+		delete(g.failures, key)
+	}
+	if cl, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		cl.wg.Wait()
+		return cl.value, cl.err
+	}
+
+	cl := &call[V]{}
+	cl.wg.Add(1)
+	if g.calls == nil {
+		g.calls = map[K]*call[V]{}
+	}
+	g.calls[key] = cl
+	g.mu.Unlock()
+
+	c.doLoad(key, cl, loader)
+
+	return cl.value, cl.err
+}
+
+// doLoad loaderを実行して結果をキャッシュに入れる
+//
+//	loaderがpanicした場合は、待っている呼び出しにErrLoaderPanickedを返してからpanicし直します
+func (c *Cache[K, V]) doLoad(key K, cl *call[V], loader func(key K) (V, error)) {
+	g := &c.flight
+	returned := false
+	defer func() {
+		var panicked interface{}
+		if !returned {
+			// recoverがnilを返すのはloaderがruntime.Goexitを呼んだ場合(テストのt.FailNowなど)
+			panicked = recover()
+			cl.err = fmt.Errorf("%w: %v", ErrLoaderPanicked, panicked)
+			if panicked == nil {
+				cl.err = fmt.Errorf("%w: runtime.Goexit was called", ErrLoaderPanicked)
+			}
+		}
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		if returned && cl.err != nil && c.errorTTL > 0 {
+			if g.failures == nil {
+				g.failures = map[K]failure{}
+			}
+			g.failures[key] = failure{
+				err:      cl.err,
+				expireAt: time.Now().Add(c.errorTTL).UnixNano(),
+			}
+		}
+		g.mu.Unlock()
+
+		cl.wg.Done()
+
+		if panicked != nil {
+			panic(panicked)
+		}
+	}()
+
+	// 待っている間に他の呼び出しが読み込みを終えている場合がある
+	// (WithInvalidationではmemcachedに問い合わせるので、全てのKeyで共有するflight.muを外してから確かめる)
+	if e, ok := c.load(key); ok {
+		cl.value = e.value
+		returned = true
+		return
+	}
+
+	// 読み込み中に書き込まれた場合に古い値を入れないよう、書き込みの回数とWithInvalidationのバージョンを
+	// 読み込む前に記録しておく
+	epoch := c.writeEpoch(key)
+	e := c.newEntry(key, cl.value, false)
+
+	cl.value, cl.err = loader(key)
+	returned = true
+	if cl.err == nil {
+		e.value = cl.value
+		if c.fill(key, e, epoch) {
+			c.remoteSet(key, e)
+		}
+	}
+}
+
+// GetMany 指定したKeyのキャッシュをまとめて取得
+//
+//	見つかったものをhitsに、見つからなかったKeyをmissesに入れて返します
+//	WithInvalidationを指定している場合も、memcachedへの問い合わせはKeyごとではなくまとめて行います
+func (c *Cache[K, V]) GetMany(keys []K) (hits map[K]V, misses []K) {
+	hits = make(map[K]V, len(keys))
+	found := c.loadMany(keys)
+	for _, key := range keys {
+		if _, ok := hits[key]; ok {
+			continue
+		}
+
+		if e, ok := found[key]; ok {
+			c.stats.hits.Add(1)
+			hits[key] = e.value
+		} else if v, ok := c.getRemote(key); ok {
+			hits[key] = v
+		} else {
+			misses = append(misses, key)
+		}
+	}
+
+	return
+}
+
+// GetManyOrLoad 指定したKeyのキャッシュをまとめて取得し、無かったものはbatchLoaderでまとめて読み込む
+//
+//	batchLoaderにはキャッシュに無かったKeyが重複なしで渡されます
+//	batchLoaderが返さなかったKeyは結果に含まれません
+func (c *Cache[K, V]) GetManyOrLoad(keys []K, batchLoader func(keys []K) (map[K]V, error)) (map[K]V, error) {
+	hits, misses := c.GetMany(keys)
+	if len(misses) == 0 {
+		return hits, nil
+	}
+
+	misses = uniqueKeys(misses)
+
+	// GetOrLoadと同様に、読み込む前の状態を記録しておく
+	var zero V
+	epochs := make([]uint64, len(misses))
+	entries := make([]*entry[V], len(misses))
+	for i, k := range misses {
+		epochs[i] = c.writeEpoch(k)
+		entries[i] = c.unstampedEntry(zero)
+	}
+	c.stampMany(misses, entries)
+
+	loaded, err := batchLoader(misses)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, k := range misses {
+		v, ok := loaded[k]
+		if !ok {
+			continue
+		}
+
+		entries[i].value = v
+		if c.fill(k, entries[i], epochs[i]) {
+			c.remoteSet(k, entries[i])
+		}
+		hits[k] = v
+	}
+
+	return hits, nil
+}
+
+func uniqueKeys[K comparable](keys []K) []K {
+	seen := make(map[K]struct{}, len(keys))
+	unique := keys[:0]
+	for _, k := range keys {
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		seen[k] = struct{}{}
+		unique = append(unique, k)
+	}
+
+	return unique
+}
@@ -0,0 +1,338 @@
+package helpisu
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var errLoad = errors.New("load failed")
+
+func TestGetOrLoadSingleflight(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	var calls atomic.Int64
+	release := make(chan struct{})
+	loader := func(int) (string, error) {
+		calls.Add(1)
+		<-release
+		return "db", nil
+	}
+
+	const n = 16
+	wg := sync.WaitGroup{}
+	results := make([]string, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			v, err := c.GetOrLoad(1, loader)
+			if err != nil {
+				t.Error(err)
+			}
+			results[i] = v
+		}(i)
+	}
+
+	// 全員がloaderの結果を待つようになってから返す
+	waitFor(t, func() bool { return calls.Load() > 0 })
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("loader called %d times, want 1", got)
+	}
+	for i, v := range results {
+		if v != "db" {
+			t.Errorf("results[%d] = %q, want %q", i, v, "db")
+		}
+	}
+
+	// 読み込んだ値はキャッシュされている
+	if v, ok := c.Get(1); !ok || v != "db" {
+		t.Errorf("Get() = %q, %v, want %q, true", v, ok, "db")
+	}
+}
+
+func TestGetOrLoadError(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		// wait 2回目の呼び出しまでの時間
+		wait      time.Duration
+		wantCalls int64
+	}{
+		{
+			name:      "エラーはキャッシュしない",
+			wantCalls: 2,
+		},
+		{
+			name:      "WithErrorTTLの間はエラーを返す",
+			opts:      []Option{WithErrorTTL(time.Hour)},
+			wantCalls: 1,
+		},
+		{
+			name:      "WithErrorTTLを過ぎたら読み込み直す",
+			opts:      []Option{WithErrorTTL(10 * time.Millisecond)},
+			wait:      30 * time.Millisecond,
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, string](t, tt.opts...)
+
+			var calls atomic.Int64
+			loader := func(int) (string, error) {
+				calls.Add(1)
+				return "", errLoad
+			}
+
+			for i := 0; i < 2; i++ {
+				_, err := c.GetOrLoad(1, loader)
+				if !errors.Is(err, errLoad) {
+					t.Fatalf("GetOrLoad() err = %v, want %v", err, errLoad)
+				}
+				time.Sleep(tt.wait)
+			}
+
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("loader called %d times, want %d", got, tt.wantCalls)
+			}
+			if c.Len() != 0 {
+				t.Errorf("Len() = %d, want 0", c.Len())
+			}
+		})
+	}
+}
+
+func TestGetOrLoadResetClearsErrors(t *testing.T) {
+	c := newTestCache[int, string](t, WithErrorTTL(time.Hour))
+
+	_, err := c.GetOrLoad(1, func(int) (string, error) { return "", errLoad })
+	if !errors.Is(err, errLoad) {
+		t.Fatalf("GetOrLoad() err = %v, want %v", err, errLoad)
+	}
+
+	c.Reset()
+
+	v, err := c.GetOrLoad(1, loadString("db"))
+	if err != nil || v != "db" {
+		t.Errorf("GetOrLoad() after Reset = %q, %v, want %q, nil", v, err, "db")
+	}
+}
+
+// TestGetOrLoadPanic loaderがpanicしたら、待っている呼び出しにはエラーを返し、panicした呼び出しはpanicし直す
+func TestGetOrLoadPanic(t *testing.T) {
+	c := newTestCache[int, string](t, WithErrorTTL(time.Hour))
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	panicked := make(chan interface{})
+	go func() {
+		defer func() { panicked <- recover() }()
+		_, _ = c.GetOrLoad(1, func(int) (string, error) {
+			close(started)
+			<-release
+			panic("boom")
+		})
+	}()
+
+	<-started
+	done := make(chan error)
+	go func() {
+		_, err := c.GetOrLoad(1, func(int) (string, error) {
+			t.Error("loader called while another loader is running")
+			return "", nil
+		})
+		done <- err
+	}()
+	// 2つ目の呼び出しが結果を待つようになってからpanicさせる
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	if err := <-done; !errors.Is(err, ErrLoaderPanicked) {
+		t.Errorf("waiting GetOrLoad() err = %v, want %v", err, ErrLoaderPanicked)
+	}
+	if p := <-panicked; p != "boom" {
+		t.Errorf("recover() = %v, want boom", p)
+	}
+
+	// panicはWithErrorTTLでもキャッシュしない
+	v, err := c.GetOrLoad(1, loadString("db"))
+	if err != nil || v != "db" {
+		t.Errorf("GetOrLoad() after panic = %q, %v, want %q, nil", v, err, "db")
+	}
+}
+
+// TestGetOrLoadReset GetOrLoadとResetを同時に呼んでもデッドロックしない
+func TestGetOrLoadReset(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		// 上限があるとlock(key)が全体のロックになる
+		{"上限あり", []Option{WithMaxEntries(10), WithTTL(time.Nanosecond)}},
+		{"上限なし", []Option{WithTTL(time.Nanosecond)}},
+		{"BackendSharded", []Option{WithBackend(BackendSharded), WithTTL(time.Nanosecond)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// 期限がすぐに切れるので、GetOrLoadは毎回期限切れのエントリを削除しようとする
+			c := newTestCache[int, int](t, tt.opts...)
+
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+
+				wg := sync.WaitGroup{}
+				for g := 0; g < 8; g++ {
+					wg.Add(1)
+					go func(g int) {
+						defer wg.Done()
+						for i := 0; i < 20000; i++ {
+							_, _ = c.GetOrLoad(i%4, func(k int) (int, error) { return k, nil })
+						}
+					}(g)
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < 5000; i++ {
+						c.Reset()
+					}
+				}()
+				wg.Wait()
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("deadlock between GetOrLoad and Reset")
+			}
+		})
+	}
+}
+
+func TestGetMany(t *testing.T) {
+	c := newTestCache[int, string](t)
+	c.Set(1, "a")
+	c.Set(3, "c")
+
+	hits, misses := c.GetMany([]int{1, 2, 3, 1})
+	if len(hits) != 2 || hits[1] != "a" || hits[3] != "c" {
+		t.Errorf("hits = %v, want map[1:a 3:c]", hits)
+	}
+	if !equalKeys(misses, []int{2}) {
+		t.Errorf("misses = %v, want [2]", misses)
+	}
+}
+
+func TestGetManyOrLoad(t *testing.T) {
+	tests := []struct {
+		name   string
+		cached map[int]string
+		keys   []int
+		// db batchLoaderが返す値(無いKeyは返さない)
+		db        map[int]string
+		loaderErr error
+		// wantLoaded batchLoaderに渡されるKey(nilなら呼ばれない)
+		wantLoaded []int
+		want       map[int]string
+		// wantCached 呼び出し後にキャッシュにあるKey
+		wantCached []int
+	}{
+		{
+			name:       "全てヒットすればbatchLoaderを呼ばない",
+			cached:     map[int]string{1: "a", 2: "b"},
+			keys:       []int{1, 2},
+			want:       map[int]string{1: "a", 2: "b"},
+			wantCached: []int{1, 2},
+		},
+		{
+			name:       "ミスしたKeyだけを重複なしで読み込む",
+			cached:     map[int]string{1: "a"},
+			keys:       []int{1, 2, 3, 2, 3},
+			db:         map[int]string{2: "b", 3: "c"},
+			wantLoaded: []int{2, 3},
+			want:       map[int]string{1: "a", 2: "b", 3: "c"},
+			wantCached: []int{1, 2, 3},
+		},
+		{
+			name:       "batchLoaderが返さなかったKeyは結果にもキャッシュにも入らない",
+			keys:       []int{1, 2},
+			db:         map[int]string{1: "a"},
+			wantLoaded: []int{1, 2},
+			want:       map[int]string{1: "a"},
+			wantCached: []int{1},
+		},
+		{
+			name:       "batchLoaderのエラーはそのまま返す",
+			cached:     map[int]string{1: "a"},
+			keys:       []int{1, 2},
+			loaderErr:  errLoad,
+			wantLoaded: []int{2},
+			wantCached: []int{1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, string](t)
+			for k, v := range tt.cached {
+				c.Set(k, v)
+			}
+
+			var loaded []int
+			got, err := c.GetManyOrLoad(tt.keys, func(keys []int) (map[int]string, error) {
+				loaded = append(loaded, keys...)
+				if tt.loaderErr != nil {
+					return nil, tt.loaderErr
+				}
+
+				m := map[int]string{}
+				for _, k := range keys {
+					if v, ok := tt.db[k]; ok {
+						m[k] = v
+					}
+				}
+				return m, nil
+			})
+
+			if !equalKeys(loaded, tt.wantLoaded) {
+				t.Errorf("batchLoader got %v, want %v", loaded, tt.wantLoaded)
+			}
+			if tt.loaderErr != nil {
+				if !errors.Is(err, tt.loaderErr) || got != nil {
+					t.Errorf("GetManyOrLoad() = %v, %v, want nil, %v", got, err, tt.loaderErr)
+				}
+			} else {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(got) != len(tt.want) {
+					t.Errorf("GetManyOrLoad() = %v, want %v", got, tt.want)
+				}
+				for k, v := range tt.want {
+					if got[k] != v {
+						t.Errorf("GetManyOrLoad()[%d] = %q, want %q", k, got[k], v)
+					}
+				}
+			}
+
+			cached := []int{}
+			_ = c.ForEach(func(k int, _ string) error {
+				cached = append(cached, k)
+				return nil
+			})
+			if !equalKeys(cached, tt.wantCached) {
+				t.Errorf("cached keys = %v, want %v", cached, tt.wantCached)
+			}
+		})
+	}
+}
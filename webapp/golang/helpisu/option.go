@@ -0,0 +1,168 @@
+package helpisu
+
+import (
+	"time"
+)
+
+// Option NewCacheに渡す設定
+type Option func(*config)
+
+type config struct {
+	ttl             time.Duration
+	janitorInterval time.Duration
+
+	maxEntries int
+	maxBytes   int64
+	eviction   EvictionPolicy
+	sizer      func(key, value any) int64
+	onEvict    func(key, value any)
+
+	errorTTL time.Duration
+
+	snapshotFormat SnapshotFormat
+	snapshotSchema int
+
+	backend Backend
+	shards  int
+
+	bus    *InvalidationBus
+	remote *RemoteTier
+
+	tagger func(key, value any) []string
+}
+
+func newConfig(opts []Option) config {
+	cfg := config{}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	return cfg
+}
+
+// WithTTL エントリのデフォルトの有効期限を指定
+//
+//	0以下の場合は無期限になります
+func WithTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.ttl = ttl
+	}
+}
+
+// WithJanitor 期限切れのエントリを定期的に削除するgoroutineを起動
+//
+//	停止するには`StopJanitor()`を呼んでください
+func WithJanitor(interval time.Duration) Option {
+	return func(c *config) {
+		c.janitorInterval = interval
+	}
+}
+
+// WithMaxEntries キャッシュに保持するエントリ数の上限を指定
+//
+//	上限を超えるとWithEvictionPolicyで指定した方針で追い出されます
+func WithMaxEntries(n int) Option {
+	return func(c *config) {
+		c.maxEntries = n
+	}
+}
+
+// WithMaxBytes キャッシュに保持するエントリの推定サイズの合計の上限を指定
+//
+//	サイズはWithSizerで指定した関数、指定がなければreflectによる見積もりで計算します
+func WithMaxBytes(n int64) Option {
+	return func(c *config) {
+		c.maxBytes = n
+	}
+}
+
+// WithSizer WithMaxBytesで使うエントリのサイズの計算方法を指定
+func WithSizer[K comparable, V any](f func(key K, value V) int64) Option {
+	return func(c *config) {
+		c.sizer = func(key, value any) int64 {
+			return f(key.(K), value.(V))
+		}
+	}
+}
+
+// WithEvictionPolicy 上限を超えたときの追い出し方針を指定(デフォルトはLRU)
+func WithEvictionPolicy(p EvictionPolicy) Option {
+	return func(c *config) {
+		c.eviction = p
+	}
+}
+
+// WithOnEvict 上限を超えてエントリが追い出されたときに呼ばれる関数を指定
+//
+//	Cacheのロックを外した後に呼ばれるので、関数内でCacheを操作しても構いません
+func WithOnEvict[K comparable, V any](f func(key K, value V)) Option {
+	return func(c *config) {
+		c.onEvict = func(key, value any) {
+			f(key.(K), value.(V))
+		}
+	}
+}
+
+// WithErrorTTL GetOrLoadのloaderが返したエラーをキャッシュする期間を指定
+//
+//	指定しない場合エラーはキャッシュされず、次の呼び出しで再度loaderが実行されます
+func WithErrorTTL(ttl time.Duration) Option {
+	return func(c *config) {
+		c.errorTTL = ttl
+	}
+}
+
+// WithSnapshot SaveAllSnapshots, LoadAllSnapshotsの対象にする
+//
+//	schemaVersionはキーや値の型を変更したときに上げてください
+//	バージョンが異なるスナップショットは読み込まれません
+func WithSnapshot(format SnapshotFormat, schemaVersion int) Option {
+	return func(c *config) {
+		c.snapshotFormat = format
+		c.snapshotSchema = schemaVersion
+	}
+}
+
+// WithBackend エントリの保持方法を指定(デフォルトはBackendSyncMap)
+func WithBackend(b Backend) Option {
+	return func(c *config) {
+		c.backend = b
+	}
+}
+
+// WithShards BackendShardedのシャード数を指定(デフォルトは32)
+func WithShards(n int) Option {
+	return func(c *config) {
+		c.shards = n
+	}
+}
+
+// WithInvalidation busを通して他のプロセスと書き込みを伝え合う
+//
+//	ヒットのたびにmemcachedへの問い合わせが発生します
+//	busがnilの場合は何もしません
+func WithInvalidation(bus *InvalidationBus) Option {
+	return func(c *config) {
+		c.bus = bus
+	}
+}
+
+// WithRemote ローカルのキャッシュの2段目としてmemcachedを使う
+//
+//	rがnilの場合は何もしません
+func WithRemote(r *RemoteTier) Option {
+	return func(c *config) {
+		c.remote = r
+	}
+}
+
+// WithTagger エントリを格納するたびにfで計算したタグを付ける
+//
+//	GetOrLoadなどで読み込んだエントリにもタグが付くので、InvalidateTagでまとめて削除できます
+func WithTagger[K comparable, V any](f func(key K, value V) []string) Option {
+	return func(c *config) {
+		c.tagger = func(key, value any) []string {
+			return f(key.(K), value.(V))
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package helpisu
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// managedCache `NewCache()`で生成したキャッシュをまとめて操作するためのインターフェース
+type managedCache interface {
+	Name() string
+	Reset()
+	Stats() Stats
+	InvalidateTag(tag string) int
+	SaveSnapshot(w io.Writer) error
+	LoadSnapshot(r io.Reader) error
+	reset() int
+	snapshotFileName() string
+	warmUpFuncs() []func(ctx context.Context) error
+}
+
+var (
+	registryMu      sync.RWMutex
+	generatedCaches = []managedCache{}
+)
+
+func register(c managedCache) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	generatedCaches = append(generatedCaches, c)
+}
+
+// unregister 登録を外す(ベンチマークやテストで作ったキャッシュを片付けるため)
+func unregister(c managedCache) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	for i, gc := range generatedCaches {
+		if gc == c {
+			generatedCaches = append(generatedCaches[:i], generatedCaches[i+1:]...)
+			return
+		}
+	}
+}
+
+// registeredCaches 登録済みのキャッシュの一覧のコピーを取得
+func registeredCaches() []managedCache {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	caches := make([]managedCache, len(generatedCaches))
+	copy(caches, generatedCaches)
+
+	return caches
+}
+
+// ResetAllCache `NewCache()`で生成した全てのキャッシュをリセット
+func ResetAllCache() {
+	for _, c := range registeredCaches() {
+		c.Reset()
+	}
+}
+
+// ResetReport ResetAllCacheWithReportでリセットしたキャッシュの情報
+type ResetReport struct {
+	Name    string `json:"name"`
+	Entries int    `json:"entries"`
+}
+
+// ResetAllCacheWithReport `NewCache()`で生成した全てのキャッシュをリセットし、
+// リセットしたキャッシュの名前と削除したエントリ数を返す
+func ResetAllCacheWithReport() []ResetReport {
+	caches := registeredCaches()
+	reports := make([]ResetReport, 0, len(caches))
+	for _, c := range caches {
+		reports = append(reports, ResetReport{
+			Name:    c.Name(),
+			Entries: c.reset(),
+		})
+	}
+
+	return reports
+}
+
+// AllStats `NewCache()`で生成した全てのキャッシュの統計情報を取得
+func AllStats() []Stats {
+	caches := registeredCaches()
+	stats := make([]Stats, 0, len(caches))
+	for _, c := range caches {
+		stats = append(stats, c.Stats())
+	}
+
+	return stats
+}
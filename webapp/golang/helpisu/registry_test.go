@@ -0,0 +1,102 @@
+package helpisu
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestResetAllCacheWithReport(t *testing.T) {
+	a := newTestCache[int, string](t, WithMaxEntries(10))
+	b := NewCache[string, int](t.Name()+"_b", WithBackend(BackendSharded))
+	t.Cleanup(func() { unregister(b) })
+
+	a.Set(1, "a")
+	a.Set(2, "b")
+	b.Set("x", 1)
+	b.Set("y", 2)
+	b.Set("z", 3)
+
+	want := map[string]int{a.Name(): 2, b.Name(): 3}
+	got := map[string]int{}
+	for _, r := range ResetAllCacheWithReport() {
+		if _, ok := want[r.Name]; ok {
+			got[r.Name] = r.Entries
+		}
+	}
+	for name, n := range want {
+		if got[name] != n {
+			t.Errorf("report for %s: entries = %d, want %d", name, got[name], n)
+		}
+	}
+
+	if a.Len() != 0 || b.Len() != 0 {
+		t.Errorf("Len() after reset = %d, %d, want 0, 0", a.Len(), b.Len())
+	}
+	if _, ok := a.Get(1); ok {
+		t.Error("Get() hit after reset")
+	}
+
+	// もう一度リセットすると0件
+	for _, r := range ResetAllCacheWithReport() {
+		if _, ok := want[r.Name]; ok && r.Entries != 0 {
+			t.Errorf("second report for %s: entries = %d, want 0", r.Name, r.Entries)
+		}
+	}
+}
+
+func TestUnregister(t *testing.T) {
+	c := NewCache[int, int](t.Name())
+	unregister(c)
+
+	for _, s := range AllStats() {
+		if s.Name == t.Name() {
+			t.Fatalf("AllStats() includes %q after unregister", t.Name())
+		}
+	}
+}
+
+// TestResetConcurrent 書き込み中にResetしても、エントリ数などの集計がずれない
+func TestResetConcurrent(t *testing.T) {
+	for _, tt := range atomicCacheOptions {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, int](t, append(tt.opts, WithTagger(func(k, _ int) []string {
+				return []string{"tag"}
+			}))...)
+
+			wg := sync.WaitGroup{}
+			for g := 0; g < 4; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for i := 0; i < 1000; i++ {
+						k := (g*1000 + i) % 100
+						c.Set(k, i)
+						c.Update(k+100, func(old int, _ bool) (int, bool) { return old + 1, true })
+						c.Get(k)
+						c.Delete(k + 1)
+					}
+				}(g)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 50; i++ {
+					c.Reset()
+				}
+			}()
+			wg.Wait()
+
+			n := 0
+			_ = c.ForEach(func(int, int) error {
+				n++
+				return nil
+			})
+			if c.Len() != n {
+				t.Errorf("Len() = %d, but ForEach found %d entries", c.Len(), n)
+			}
+			if got := c.InvalidateTag("tag"); got != n {
+				t.Errorf("InvalidateTag() = %d, want %d", got, n)
+			}
+		})
+	}
+}
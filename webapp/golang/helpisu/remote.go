@@ -0,0 +1,194 @@
+package helpisu
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+// RemoteClient RemoteTierが使うmemcachedクライアントのメソッド
+//
+//	*memcache.Clientがそのまま使えます
+type RemoteClient interface {
+	Get(key string) (*memcache.Item, error)
+	Set(item *memcache.Item) error
+	Delete(key string) error
+	Increment(key string, delta uint64) (newValue uint64, err error)
+	Add(item *memcache.Item) error
+}
+
+// remoteRetryInterval memcachedでエラーが起きてから再び使うまでの間隔
+const remoteRetryInterval = 3 * time.Second
+
+/*
+RemoteTier Cacheの2段目としてmemcachedに値を保存する
+
+	ローカルに無いエントリはmemcachedから読み込み、書き込みはmemcachedにも反映します
+	memcachedでエラーが起きた場合、しばらくの間はローカルだけで動きます
+*/
+type RemoteTier struct {
+	client RemoteClient
+	prefix string
+	codec  Codec
+
+	// downUntil この時刻(UnixNano)まではmemcachedを使わない
+	downUntil atomic.Int64
+}
+
+// NewRemoteTier 新たなRemoteTierを作成
+//
+//	prefixはmemcachedのKeyの先頭に付けます。同じキャッシュを共有するプロセス間で揃えてください
+//	codecがnilの場合はGobCodecを使います
+func NewRemoteTier(client RemoteClient, prefix string, codec Codec) *RemoteTier {
+	if codec == nil {
+		codec = GobCodec
+	}
+
+	return &RemoteTier{
+		client: client,
+		prefix: prefix,
+		codec:  codec,
+	}
+}
+
+// remoteEntry memcachedに保存する値
+type remoteEntry[V any] struct {
+	Value    V     `json:"value" msgpack:"value"`
+	ExpireAt int64 `json:"expire_at" msgpack:"expire_at"`
+}
+
+func (r *RemoteTier) available() bool {
+	return time.Now().UnixNano() >= r.downUntil.Load()
+}
+
+// check memcachedのエラーを記録する(ErrCacheMiss, ErrNotStoredは正常とみなす)
+func (r *RemoteTier) check(err error) error {
+	if err != nil && !errors.Is(err, memcache.ErrCacheMiss) && !errors.Is(err, memcache.ErrNotStored) {
+		r.downUntil.Store(time.Now().Add(remoteRetryInterval).UnixNano())
+	}
+
+	return err
+}
+
+func (r *RemoteTier) namespaceKey(cache string) string {
+	return memcacheKey(r.prefix, cache, "ns")
+}
+
+// namespace キャッシュの名前空間(Resetのたびに変わる)
+func (r *RemoteTier) namespace(cache string) (string, error) {
+	item, err := r.client.Get(r.namespaceKey(cache))
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return "0", nil
+	}
+	if r.check(err) != nil {
+		return "", err
+	}
+
+	return string(item.Value), nil
+}
+
+func (r *RemoteTier) dataKey(cache string, key any) (string, error) {
+	ns, err := r.namespace(cache)
+	if err != nil {
+		return "", err
+	}
+
+	return memcacheKey(r.prefix, cache, ns, fmt.Sprint(key)), nil
+}
+
+// remoteGet memcachedからエントリを読み込む
+func (c *Cache[K, V]) remoteGet(key K) (*entry[V], bool) {
+	r := c.remote
+	if r == nil || !r.available() {
+		return nil, false
+	}
+
+	dataKey, err := r.dataKey(c.name, key)
+	if err != nil {
+		return nil, false
+	}
+
+	item, err := r.client.Get(dataKey)
+	if r.check(err) != nil {
+		return nil, false
+	}
+
+	re := remoteEntry[V]{}
+	err = r.codec.Unmarshal(item.Value, &re)
+	if err != nil {
+		return nil, false
+	}
+
+	e := &entry[V]{value: re.Value, expireAt: re.ExpireAt}
+	if e.expired(time.Now().UnixNano()) {
+		return nil, false
+	}
+
+	return e, true
+}
+
+// remoteSet memcachedにエントリを書き込む
+func (c *Cache[K, V]) remoteSet(key K, e *entry[V]) {
+	r := c.remote
+	if r == nil || !r.available() {
+		return
+	}
+
+	data, err := r.codec.Marshal(remoteEntry[V]{Value: e.value, ExpireAt: e.expireAt})
+	if err != nil {
+		return
+	}
+
+	dataKey, err := r.dataKey(c.name, key)
+	if err != nil {
+		return
+	}
+
+	item := &memcache.Item{Key: dataKey, Value: data}
+	if e.expireAt != 0 {
+		// memcachedの有効期限は秒単位なので切り上げる
+		ttl := time.Until(time.Unix(0, e.expireAt))
+		item.Expiration = int32((ttl + time.Second - 1) / time.Second)
+		if item.Expiration <= 0 {
+			return
+		}
+	}
+
+	_ = r.check(r.client.Set(item))
+}
+
+// remoteDelete memcachedからエントリを削除する
+func (c *Cache[K, V]) remoteDelete(key K) {
+	r := c.remote
+	if r == nil || !r.available() {
+		return
+	}
+
+	dataKey, err := r.dataKey(c.name, key)
+	if err != nil {
+		return
+	}
+
+	_ = r.check(r.client.Delete(dataKey))
+}
+
+// remoteReset 名前空間を変えてmemcached上のエントリを全て読めなくする
+func (c *Cache[K, V]) remoteReset() {
+	r := c.remote
+	if r == nil || !r.available() {
+		return
+	}
+
+	nsKey := r.namespaceKey(c.name)
+	_, err := r.client.Increment(nsKey, 1)
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		err = r.client.Add(&memcache.Item{Key: nsKey, Value: []byte("1")})
+		if errors.Is(err, memcache.ErrNotStored) {
+			_, err = r.client.Increment(nsKey, 1)
+		}
+	}
+	_ = r.check(err)
+}
@@ -0,0 +1,192 @@
+package helpisu
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+type remoteValue struct {
+	ID   int
+	Name string
+	Tags []string
+	At   time.Time
+}
+
+// equal Atは形式によってLocationが変わるので時刻として比べる
+func (v remoteValue) equal(o remoteValue) bool {
+	return v.ID == o.ID && v.Name == o.Name && reflect.DeepEqual(v.Tags, o.Tags) && v.At.Equal(o.At)
+}
+
+var codecs = []struct {
+	name  string
+	codec Codec
+}{
+	{"gob", GobCodec},
+	{"json", JSONCodec},
+	{"msgpack", MsgpackCodec},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	want := remoteEntry[remoteValue]{
+		Value: remoteValue{
+			ID:   1,
+			Name: "ユーザー",
+			Tags: []string{"a", "b"},
+			At:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		},
+		ExpireAt: time.Date(2024, 1, 2, 4, 0, 0, 0, time.UTC).UnixNano(),
+	}
+
+	for _, tt := range codecs {
+		t.Run(tt.name, func(t *testing.T) {
+			data, err := tt.codec.Marshal(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got := remoteEntry[remoteValue]{}
+			err = tt.codec.Unmarshal(data, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !got.Value.equal(want.Value) || got.ExpireAt != want.ExpireAt {
+				t.Errorf("round trip = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+// newRemotePeers 同じmemcachedを2段目に使う2つのプロセスのキャッシュを作る
+func newRemotePeers(t *testing.T, codec Codec, opts ...Option) (a, b *Cache[int, remoteValue], mc *fakeMemcache) {
+	t.Helper()
+
+	mc = newFakeMemcache()
+	a = newTestCache[int, remoteValue](t, append(opts, WithRemote(NewRemoteTier(mc, "remote_", codec)))...)
+	b = newTestCache[int, remoteValue](t, append(opts, WithRemote(NewRemoteTier(mc, "remote_", codec)))...)
+
+	return a, b, mc
+}
+
+func TestRemoteTier(t *testing.T) {
+	v := remoteValue{ID: 1, Name: "a", Tags: []string{"x"}, At: time.Now().Truncate(time.Second)}
+
+	for _, tt := range codecs {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, _ := newRemotePeers(t, tt.codec)
+
+			a.Set(1, v)
+
+			// ローカルに無いのでmemcachedから読み、2回目はローカルでヒットする
+			for i := 0; i < 2; i++ {
+				got, ok := b.Get(1)
+				if !ok || !got.equal(v) {
+					t.Fatalf("Get() = %+v, %v, want %+v, true", got, ok, v)
+				}
+			}
+			if s := b.Stats(); s.RemoteHits != 1 || s.Hits != 1 || s.Misses != 0 {
+				t.Errorf("Stats() = %+v, want remote_hits=1 hits=1 misses=0", s)
+			}
+		})
+	}
+}
+
+func TestRemoteTierWrites(t *testing.T) {
+	tests := []struct {
+		name   string
+		write  func(a *Cache[int, remoteValue])
+		wantOK bool
+	}{
+		{
+			name:   "書き込まなければ読める",
+			write:  func(*Cache[int, remoteValue]) {},
+			wantOK: true,
+		},
+		{
+			name:  "Delete",
+			write: func(a *Cache[int, remoteValue]) { a.Delete(1) },
+		},
+		{
+			name:  "GetAndDelete",
+			write: func(a *Cache[int, remoteValue]) { a.GetAndDelete(1) },
+		},
+		{
+			name:  "Reset",
+			write: func(a *Cache[int, remoteValue]) { a.Reset() },
+		},
+		{
+			name: "Updateで削除",
+			write: func(a *Cache[int, remoteValue]) {
+				a.Update(1, func(remoteValue, bool) (remoteValue, bool) { return remoteValue{}, false })
+			},
+		},
+		{
+			name:  "期限切れ",
+			write: func(a *Cache[int, remoteValue]) { time.Sleep(30 * time.Millisecond) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b, _ := newRemotePeers(t, GobCodec)
+
+			a.SetWithTTL(1, remoteValue{ID: 1}, 20*time.Millisecond)
+			tt.write(a)
+
+			if _, ok := b.Get(1); ok != tt.wantOK {
+				t.Errorf("Get() ok = %v, want %v", ok, tt.wantOK)
+			}
+		})
+	}
+}
+
+// TestRemoteTierWithInvalidation memcachedから読んだエントリもローカルでヒットし、他のプロセスの書き込みで無効になる
+func TestRemoteTierWithInvalidation(t *testing.T) {
+	mc := newFakeMemcache()
+	newCache := func() *Cache[int, string] {
+		return newTestCache[int, string](t,
+			WithInvalidation(NewInvalidationBus(mc, "bus_")),
+			WithRemote(NewRemoteTier(mc, "remote_", GobCodec)),
+		)
+	}
+	a, b := newCache(), newCache()
+
+	a.Set(1, "a")
+	for i := 0; i < 2; i++ {
+		if v, ok := b.Get(1); !ok || v != "a" {
+			t.Fatalf("Get() = %q, %v, want %q, true", v, ok, "a")
+		}
+	}
+	if s := b.Stats(); s.RemoteHits != 1 || s.Hits != 1 {
+		t.Errorf("Stats() = %+v, want remote_hits=1 hits=1", s)
+	}
+
+	a.Set(1, "new")
+	if v, ok := b.Get(1); !ok || v != "new" {
+		t.Errorf("Get() after peer Set = %q, %v, want %q, true", v, ok, "new")
+	}
+}
+
+func TestRemoteTierDown(t *testing.T) {
+	a, b, mc := newRemotePeers(t, GobCodec)
+	a.Set(1, remoteValue{ID: 1})
+
+	mc.setDown(true)
+	gets := mc.callCount("Get")
+	for i := 0; i < 10; i++ {
+		if _, ok := b.Get(1); ok {
+			t.Fatal("Get() hit while memcached is down")
+		}
+	}
+	// 最初のエラーの後はしばらく問い合わせない
+	if got := mc.callCount("Get") - gets; got != 1 {
+		t.Errorf("memcached Get called %d times while down, want 1", got)
+	}
+
+	// memcachedが落ちていてもローカルでは動く
+	b.Set(2, remoteValue{ID: 2})
+	if _, ok := b.Get(2); !ok {
+		t.Error("Get() of a local entry missed while memcached is down")
+	}
+}
@@ -0,0 +1,74 @@
+package helpisu
+
+import (
+	"reflect"
+)
+
+// estimateSize 値のおおよそのメモリ使用量(バイト)を見積もる
+//
+//	ポインタ、スライス、文字列、マップの参照先も含めて数えます
+//	循環参照は一度しか数えません
+func estimateSize(v any) int64 {
+	if v == nil {
+		return 0
+	}
+
+	rv := reflect.ValueOf(v)
+	return int64(rv.Type().Size()) + indirectSize(rv, map[uintptr]struct{}{})
+}
+
+// indirectSize 値そのもの以外に確保されている領域のサイズ
+func indirectSize(v reflect.Value, seen map[uintptr]struct{}) int64 {
+	switch v.Kind() {
+	case reflect.String:
+		return int64(v.Len())
+	case reflect.Pointer:
+		if v.IsNil() {
+			return 0
+		}
+		if _, ok := seen[v.Pointer()]; ok {
+			return 0
+		}
+		seen[v.Pointer()] = struct{}{}
+		return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+	case reflect.Slice:
+		if v.IsNil() {
+			return 0
+		}
+		size := int64(v.Cap()) * int64(v.Type().Elem().Size())
+		for i := 0; i < v.Len(); i++ {
+			size += indirectSize(v.Index(i), seen)
+		}
+		return size
+	case reflect.Array:
+		var size int64
+		for i := 0; i < v.Len(); i++ {
+			size += indirectSize(v.Index(i), seen)
+		}
+		return size
+	case reflect.Struct:
+		var size int64
+		for i := 0; i < v.NumField(); i++ {
+			size += indirectSize(v.Field(i), seen)
+		}
+		return size
+	case reflect.Map:
+		if v.IsNil() {
+			return 0
+		}
+		var size int64
+		iter := v.MapRange()
+		for iter.Next() {
+			size += int64(iter.Key().Type().Size()) + indirectSize(iter.Key(), seen)
+			size += int64(iter.Value().Type().Size()) + indirectSize(iter.Value(), seen)
+		}
+		return size
+	case reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		return int64(v.Elem().Type().Size()) + indirectSize(v.Elem(), seen)
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,297 @@
+package helpisu
+
+import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SnapshotFormat スナップショットのエンコード形式
+type SnapshotFormat int
+
+const (
+	// SnapshotGob encoding/gobで保存する
+	SnapshotGob SnapshotFormat = iota + 1
+	// SnapshotJSON encoding/jsonで保存する
+	SnapshotJSON
+)
+
+func (f SnapshotFormat) ext() string {
+	if f == SnapshotJSON {
+		return ".json"
+	}
+	return ".gob"
+}
+
+// snapshotFormatVersion スナップショットのファイル形式のバージョン
+//
+//	snapshotHeaderやsnapshotEntryを変更したら上げること
+const snapshotFormatVersion = 2
+
+var (
+	// ErrSnapshotDisabled WithSnapshotを指定していないCacheでスナップショットを使おうとした
+	ErrSnapshotDisabled = errors.New("helpisu: snapshot is not enabled for this cache")
+	// ErrSnapshotVersion スナップショットのバージョンが一致しない
+	ErrSnapshotVersion = errors.New("helpisu: snapshot version mismatch")
+)
+
+type snapshotHeader struct {
+	FormatVersion int       `json:"format_version"`
+	SchemaVersion int       `json:"schema_version"`
+	Name          string    `json:"name"`
+	SavedAt       time.Time `json:"saved_at"`
+	Entries       int       `json:"entries"`
+}
+
+type snapshotEntry[K comparable, V any] struct {
+	Key      K        `json:"key"`
+	Value    V        `json:"value"`
+	ExpireAt int64    `json:"expire_at"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+type encoder interface {
+	Encode(v any) error
+}
+
+type decoder interface {
+	Decode(v any) error
+}
+
+func newEncoder(f SnapshotFormat, w io.Writer) encoder {
+	if f == SnapshotJSON {
+		return json.NewEncoder(w)
+	}
+	return gob.NewEncoder(w)
+}
+
+func newDecoder(f SnapshotFormat, r io.Reader) decoder {
+	if f == SnapshotJSON {
+		return json.NewDecoder(r)
+	}
+	return gob.NewDecoder(r)
+}
+
+// SaveSnapshot キャッシュの中身をwに書き出す
+//
+//	期限切れのエントリは書き出しません
+func (c *Cache[K, V]) SaveSnapshot(w io.Writer) error {
+	if c.snapshotFormat == 0 {
+		return ErrSnapshotDisabled
+	}
+
+	now := time.Now().UnixNano()
+	entries := make([]snapshotEntry[K, V], 0, c.Len())
+	c.backend.rangeEntries(func(k K, e *entry[V]) bool {
+		if e.expired(now) {
+			return true
+		}
+
+		entries = append(entries, snapshotEntry[K, V]{Key: k, Value: e.value, ExpireAt: e.expireAt, Tags: e.tags})
+		return true
+	})
+
+	enc := newEncoder(c.snapshotFormat, w)
+	err := enc.Encode(snapshotHeader{
+		FormatVersion: snapshotFormatVersion,
+		SchemaVersion: c.snapshotSchema,
+		Name:          c.name,
+		SavedAt:       time.Now(),
+		Entries:       len(entries),
+	})
+	if err != nil {
+		return err
+	}
+
+	return enc.Encode(entries)
+}
+
+// LoadSnapshot SaveSnapshotで書き出した内容をキャッシュに読み込む
+//
+//	ファイル形式やWithSnapshotで指定したスキーマのバージョンが異なる場合はErrSnapshotVersionを返し、何も読み込みません
+func (c *Cache[K, V]) LoadSnapshot(r io.Reader) error {
+	if c.snapshotFormat == 0 {
+		return ErrSnapshotDisabled
+	}
+
+	dec := newDecoder(c.snapshotFormat, r)
+
+	header := snapshotHeader{}
+	err := dec.Decode(&header)
+	if err != nil {
+		return err
+	}
+	if header.FormatVersion != snapshotFormatVersion || header.SchemaVersion != c.snapshotSchema {
+		return fmt.Errorf("%w: cache=%s format=%d schema=%d, want format=%d schema=%d",
+			ErrSnapshotVersion, c.name,
+			header.FormatVersion, header.SchemaVersion,
+			snapshotFormatVersion, c.snapshotSchema)
+	}
+	if header.Name != c.name {
+		return fmt.Errorf("helpisu: snapshot is for cache %q, not %q", header.Name, c.name)
+	}
+
+	entries := make([]snapshotEntry[K, V], 0, header.Entries)
+	err = dec.Decode(&entries)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	keys := make([]K, 0, len(entries))
+	loaded := make([]*entry[V], 0, len(entries))
+	for _, se := range entries {
+		e := &entry[V]{value: se.Value, expireAt: se.ExpireAt, tags: se.Tags}
+		if e.expired(now) {
+			continue
+		}
+		keys = append(keys, se.Key)
+		loaded = append(loaded, e)
+	}
+
+	// バージョンを記録しないと、WithInvalidationを指定している場合に最初のGetでvalidに弾かれる
+	c.stampMany(keys, loaded)
+
+	for i, key := range keys {
+		unlock := c.lock(key)
+		evictedEntries := c.storeLocked(key, loaded[i])
+		unlock()
+
+		c.notifyEvicted(evictedEntries)
+	}
+
+	return nil
+}
+
+// snapshotFileName スナップショットを保存するファイル名(WithSnapshotを指定していない場合は空)
+func (c *Cache[K, V]) snapshotFileName() string {
+	if c.snapshotFormat == 0 {
+		return ""
+	}
+
+	return c.name + c.snapshotFormat.ext()
+}
+
+// SaveAllSnapshots WithSnapshotを指定した全てのキャッシュをdirに書き出す
+//
+//	書き出し途中で落ちても壊れたファイルが残らないよう、一時ファイルに書いてからrenameします
+func SaveAllSnapshots(dir string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, c := range registeredCaches() {
+		name := c.snapshotFileName()
+		if name == "" {
+			continue
+		}
+
+		err := saveSnapshotFile(c, filepath.Join(dir, name))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name(), err))
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+func saveSnapshotFile(c managedCache, path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	err = c.SaveSnapshot(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// LoadAllSnapshots WithSnapshotを指定した全てのキャッシュにdirのスナップショットを読み込む
+//
+//	ファイルが無いキャッシュは何もしません
+func LoadAllSnapshots(dir string) error {
+	var errs []error
+	for _, c := range registeredCaches() {
+		name := c.snapshotFileName()
+		if name == "" {
+			continue
+		}
+
+		err := loadSnapshotFile(c, filepath.Join(dir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("%s: %w", c.Name(), err))
+		}
+	}
+
+	return joinErrors(errs)
+}
+
+func loadSnapshotFile(c managedCache, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return c.LoadSnapshot(f)
+}
+
+// multiError 複数のキャッシュで起きたエラーをまとめたもの
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, 0, len(m))
+	for _, err := range m {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Is まとめたエラーのどれかがtargetに当たるか(errors.Isから呼ばれる)
+func (m multiError) Is(target error) bool {
+	for _, err := range m {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// As まとめたエラーのうち最初にtargetに当たるものを入れる(errors.Asから呼ばれる)
+func (m multiError) As(target any) bool {
+	for _, err := range m {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func joinErrors(errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+
+	return multiError(errs)
+}
@@ -0,0 +1,219 @@
+package helpisu
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var snapshotFormats = []struct {
+	name   string
+	format SnapshotFormat
+}{
+	{"gob", SnapshotGob},
+	{"json", SnapshotJSON},
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	for _, f := range snapshotFormats {
+		t.Run(f.name, func(t *testing.T) {
+			src := newTestCache[int, string](t, WithSnapshot(f.format, 1))
+			src.Set(1, "a", "tag")
+			src.Set(2, "b")
+			src.SetWithTTL(3, "expired", time.Millisecond)
+			time.Sleep(10 * time.Millisecond)
+
+			buf := &bytes.Buffer{}
+			err := src.SaveSnapshot(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dst := newTestCache[int, string](t, WithSnapshot(f.format, 1))
+			err = dst.LoadSnapshot(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if dst.Len() != 2 {
+				t.Errorf("Len() = %d, want 2 (expired entries are not saved)", dst.Len())
+			}
+			for k, want := range map[int]string{1: "a", 2: "b"} {
+				if v, ok := dst.Get(k); !ok || v != want {
+					t.Errorf("Get(%d) = %q, %v, want %q, true", k, v, ok, want)
+				}
+			}
+			// タグも復元される
+			if n := dst.InvalidateTag("tag"); n != 1 {
+				t.Errorf("InvalidateTag() = %d, want 1", n)
+			}
+		})
+	}
+}
+
+func TestLoadSnapshotRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		// write スナップショットを書き出す
+		write   func(t *testing.T, buf *bytes.Buffer)
+		wantErr error
+	}{
+		{
+			name: "スキーマのバージョンが異なる",
+			write: func(t *testing.T, buf *bytes.Buffer) {
+				c := newTestCache[int, string](t, WithSnapshot(SnapshotGob, 1))
+				c.Set(1, "old schema")
+				if err := c.SaveSnapshot(buf); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantErr: ErrSnapshotVersion,
+		},
+		{
+			name: "ファイル形式のバージョンが異なる",
+			write: func(t *testing.T, buf *bytes.Buffer) {
+				enc := newEncoder(SnapshotGob, buf)
+				_ = enc.Encode(snapshotHeader{FormatVersion: snapshotFormatVersion - 1, SchemaVersion: 2, Name: t.Name(), Entries: 1})
+				_ = enc.Encode([]snapshotEntry[int, string]{{Key: 1, Value: "old format"}})
+			},
+			wantErr: ErrSnapshotVersion,
+		},
+		{
+			name: "別のキャッシュのスナップショット",
+			write: func(t *testing.T, buf *bytes.Buffer) {
+				enc := newEncoder(SnapshotGob, buf)
+				_ = enc.Encode(snapshotHeader{FormatVersion: snapshotFormatVersion, SchemaVersion: 2, Name: "other", Entries: 1})
+				_ = enc.Encode([]snapshotEntry[int, string]{{Key: 1, Value: "other cache"}})
+			},
+		},
+		{
+			name: "壊れている",
+			write: func(t *testing.T, buf *bytes.Buffer) {
+				buf.WriteString("broken")
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			tt.write(t, buf)
+
+			c := newTestCache[int, string](t, WithSnapshot(SnapshotGob, 2))
+			err := c.LoadSnapshot(buf)
+			if err == nil {
+				t.Fatal("LoadSnapshot() succeeded")
+			}
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("LoadSnapshot() err = %v, want %v", err, tt.wantErr)
+			}
+			if c.Len() != 0 {
+				t.Errorf("Len() = %d, want 0 (nothing is loaded)", c.Len())
+			}
+		})
+	}
+}
+
+func TestSnapshotDisabled(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	if err := c.SaveSnapshot(&bytes.Buffer{}); !errors.Is(err, ErrSnapshotDisabled) {
+		t.Errorf("SaveSnapshot() err = %v, want %v", err, ErrSnapshotDisabled)
+	}
+	if err := c.LoadSnapshot(&bytes.Buffer{}); !errors.Is(err, ErrSnapshotDisabled) {
+		t.Errorf("LoadSnapshot() err = %v, want %v", err, ErrSnapshotDisabled)
+	}
+}
+
+func TestSaveAndLoadAllSnapshots(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "snapshots")
+
+	// 前のプロセス
+	src := NewCache[int, string](t.Name(), WithSnapshot(SnapshotJSON, 1))
+	src.Set(1, "a")
+	err := SaveAllSnapshots(dir)
+	unregister(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, t.Name()+".json")); err != nil {
+		t.Fatal(err)
+	}
+
+	// 再起動後のプロセス(スナップショットの無いキャッシュは何もしない)
+	dst := newTestCache[int, string](t, WithSnapshot(SnapshotJSON, 1))
+	other := NewCache[int, string](t.Name()+"_new", WithSnapshot(SnapshotJSON, 1))
+	t.Cleanup(func() { unregister(other) })
+
+	err = LoadAllSnapshots(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := dst.Get(1); !ok || v != "a" {
+		t.Errorf("Get() = %q, %v, want %q, true", v, ok, "a")
+	}
+	if other.Len() != 0 {
+		t.Errorf("Len() of a cache without a snapshot = %d, want 0", other.Len())
+	}
+}
+
+func TestLoadSnapshotInvalidation(t *testing.T) {
+	mc := newFakeMemcache()
+	src := newTestCache[int, string](t, WithInvalidation(NewInvalidationBus(mc, "test_")), WithSnapshot(SnapshotGob, 1))
+	dst := newTestCache[int, string](t, WithInvalidation(NewInvalidationBus(mc, "test_")), WithSnapshot(SnapshotGob, 1))
+
+	src.Set(1, "a")
+	src.Set(2, "b")
+	buf := &bytes.Buffer{}
+	err := src.SaveSnapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gets := mc.callCount("GetMulti")
+	err = dst.LoadSnapshot(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := mc.callCount("GetMulti") - gets; got != 1 {
+		t.Errorf("GetMulti called %d times, want 1", got)
+	}
+
+	// 読み込んだ時点のバージョンを記録しているので、validに弾かれない
+	for k, want := range map[int]string{1: "a", 2: "b"} {
+		if v, ok := dst.Get(k); !ok || v != want {
+			t.Errorf("Get(%d) = %q, %v, want %q, true", k, v, ok, want)
+		}
+	}
+
+	// 読み込んだ後に他のプロセスで書き換えられたら無効になる
+	src.Set(1, "new")
+	if v, ok := dst.Get(1); ok {
+		t.Errorf("Get(1) = %q, %v, want miss", v, ok)
+	}
+}
+
+func TestLoadAllSnapshotsVersion(t *testing.T) {
+	dir := t.TempDir()
+
+	src := NewCache[int, string](t.Name(), WithSnapshot(SnapshotJSON, 1))
+	src.Set(1, "a")
+	err := SaveAllSnapshots(dir)
+	unregister(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// スキーマのバージョンを上げたキャッシュは読み込まない
+	dst := newTestCache[int, string](t, WithSnapshot(SnapshotJSON, 2))
+	err = LoadAllSnapshots(dir)
+	if !errors.Is(err, ErrSnapshotVersion) {
+		t.Errorf("LoadAllSnapshots() err = %v, want %v", err, ErrSnapshotVersion)
+	}
+	if dst.Len() != 0 {
+		t.Errorf("Len() = %d, want 0", dst.Len())
+	}
+}
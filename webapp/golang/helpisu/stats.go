@@ -0,0 +1,58 @@
+package helpisu
+
+import (
+	"sync/atomic"
+)
+
+// Stats キャッシュの統計情報のスナップショット
+type Stats struct {
+	Name string `json:"name"`
+	Hits int64  `json:"hits"`
+	// RemoteHits ローカルに無く、WithRemoteで指定したmemcachedにあった回数
+	RemoteHits int64 `json:"remote_hits"`
+	Misses     int64 `json:"misses"`
+	Sets       int64 `json:"sets"`
+	Deletes    int64 `json:"deletes"`
+	Evictions  int64 `json:"evictions"`
+	Entries    int   `json:"entries"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// HitRate ヒット率(Get系の呼び出しが無い場合は0)
+func (s Stats) HitRate() float64 {
+	total := s.Hits + s.RemoteHits + s.Misses
+	if total == 0 {
+		return 0
+	}
+
+	return float64(s.Hits+s.RemoteHits) / float64(total)
+}
+
+type counters struct {
+	hits       atomic.Int64
+	remoteHits atomic.Int64
+	misses     atomic.Int64
+	sets       atomic.Int64
+	deletes    atomic.Int64
+	evictions  atomic.Int64
+}
+
+// Name NewCacheで指定したキャッシュの名前
+func (c *Cache[K, V]) Name() string {
+	return c.name
+}
+
+// Stats キャッシュの統計情報を取得
+func (c *Cache[K, V]) Stats() Stats {
+	return Stats{
+		Name:       c.name,
+		Hits:       c.stats.hits.Load(),
+		RemoteHits: c.stats.remoteHits.Load(),
+		Misses:     c.stats.misses.Load(),
+		Sets:       c.stats.sets.Load(),
+		Deletes:    c.stats.deletes.Load(),
+		Evictions:  c.stats.evictions.Load(),
+		Entries:    int(c.entries.Load()),
+		Bytes:      c.bytes.Load(),
+	}
+}
@@ -0,0 +1,136 @@
+package helpisu
+
+import (
+	"testing"
+)
+
+func TestStats(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		ops  func(c *Cache[int, string])
+		want Stats
+	}{
+		{
+			name: "Get",
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Get(1)
+				c.Get(1)
+				c.Get(2)
+			},
+			want: Stats{Hits: 2, Misses: 1, Sets: 1, Entries: 1},
+		},
+		{
+			name: "Delete",
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Delete(1)
+				// 無いKeyの削除は数えない
+				c.Delete(2)
+			},
+			want: Stats{Sets: 1, Deletes: 1},
+		},
+		{
+			name: "GetAndDelete",
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.GetAndDelete(1)
+				c.GetAndDelete(1)
+			},
+			want: Stats{Hits: 1, Misses: 1, Sets: 1, Deletes: 1},
+		},
+		{
+			name: "GetOrLoad",
+			ops: func(c *Cache[int, string]) {
+				_, _ = c.GetOrLoad(1, loadString("db"))
+				_, _ = c.GetOrLoad(1, loadString("db"))
+			},
+			want: Stats{Hits: 1, Misses: 1, Sets: 1, Entries: 1},
+		},
+		{
+			name: "LoadOrStore",
+			ops: func(c *Cache[int, string]) {
+				c.LoadOrStore(1, "a")
+				c.LoadOrStore(1, "b")
+			},
+			want: Stats{Hits: 1, Misses: 1, Sets: 1, Entries: 1},
+		},
+		{
+			name: "Update",
+			ops: func(c *Cache[int, string]) {
+				c.Update(1, func(string, bool) (string, bool) { return "a", true })
+				c.Update(1, func(string, bool) (string, bool) { return "", false })
+				// 無いKeyにfalseを返しても数えない
+				c.Update(2, func(string, bool) (string, bool) { return "", false })
+			},
+			want: Stats{Sets: 1, Deletes: 1},
+		},
+		{
+			name: "Evictions",
+			opts: []Option{WithMaxEntries(2)},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a")
+				c.Set(2, "b")
+				c.Set(3, "c")
+			},
+			want: Stats{Sets: 3, Evictions: 1, Entries: 2},
+		},
+		{
+			name: "Bytes",
+			opts: []Option{WithMaxBytes(100), WithSizer(func(_ int, v string) int64 { return int64(len(v)) })},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "abc")
+				c.Set(2, "de")
+			},
+			want: Stats{Sets: 2, Entries: 2, Bytes: 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, string](t, tt.opts...)
+
+			tt.ops(c)
+
+			tt.want.Name = t.Name()
+			if got := c.Stats(); got != tt.want {
+				t.Errorf("Stats() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHitRate(t *testing.T) {
+	tests := []struct {
+		stats Stats
+		want  float64
+	}{
+		{Stats{}, 0},
+		{Stats{Hits: 3, Misses: 1}, 0.75},
+		{Stats{Hits: 1, RemoteHits: 1, Misses: 2}, 0.5},
+	}
+
+	for _, tt := range tests {
+		if got := tt.stats.HitRate(); got != tt.want {
+			t.Errorf("%+v.HitRate() = %v, want %v", tt.stats, got, tt.want)
+		}
+	}
+}
+
+func TestAllStats(t *testing.T) {
+	c := newTestCache[int, string](t)
+	c.Set(1, "a")
+	c.Get(1)
+
+	for _, s := range AllStats() {
+		if s.Name != c.Name() {
+			continue
+		}
+		if s.Hits != 1 || s.Sets != 1 {
+			t.Errorf("AllStats() has %+v, want hits=1 sets=1", s)
+		}
+		return
+	}
+	t.Errorf("AllStats() does not include %q", c.Name())
+}
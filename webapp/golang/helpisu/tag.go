@@ -0,0 +1,109 @@
+package helpisu
+
+// tagIndex タグからKeyを引くための索引
+type tagIndex[K comparable] struct {
+	keys map[string]map[K]struct{}
+}
+
+func (t *tagIndex[K]) add(key K, tags []string) {
+	if len(tags) == 0 {
+		return
+	}
+	if t.keys == nil {
+		t.keys = map[string]map[K]struct{}{}
+	}
+
+	for _, tag := range tags {
+		ks, ok := t.keys[tag]
+		if !ok {
+			ks = map[K]struct{}{}
+			t.keys[tag] = ks
+		}
+		ks[key] = struct{}{}
+	}
+}
+
+func (t *tagIndex[K]) remove(key K, tags []string) {
+	for _, tag := range tags {
+		ks, ok := t.keys[tag]
+		if !ok {
+			continue
+		}
+
+		delete(ks, key)
+		if len(ks) == 0 {
+			delete(t.keys, tag)
+		}
+	}
+}
+
+func (t *tagIndex[K]) lookup(tag string) []K {
+	ks := t.keys[tag]
+	keys := make([]K, 0, len(ks))
+	for k := range ks {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
+
+func (t *tagIndex[K]) reset() {
+	t.keys = nil
+}
+
+// indexTags エントリのタグを索引に登録する(oldがあれば置き換える)
+func (c *Cache[K, V]) indexTags(key K, old, e *entry[V]) {
+	if (old == nil || len(old.tags) == 0) && len(e.tags) == 0 {
+		return
+	}
+
+	c.tagMu.Lock()
+	defer c.tagMu.Unlock()
+
+	if old != nil {
+		c.tags.remove(key, old.tags)
+	}
+	c.tags.add(key, e.tags)
+}
+
+// unindexTags 削除したエントリのタグを索引から外す
+func (c *Cache[K, V]) unindexTags(key K, e *entry[V]) {
+	if e == nil || len(e.tags) == 0 {
+		return
+	}
+
+	c.tagMu.Lock()
+	defer c.tagMu.Unlock()
+
+	c.tags.remove(key, e.tags)
+}
+
+// InvalidateTag 指定したタグが付いたエントリを全て削除し、削除した数を返す
+//
+//	読み込み中の値にどのタグが付くかは分からないので、読み込み中の値は全てキャッシュに入れずに捨てます
+func (c *Cache[K, V]) InvalidateTag(tag string) int {
+	// 先に記録しておけば、この後に入るエントリは無く、既に入ったエントリは索引から引ける
+	unlock := c.lockAll()
+	c.wroteAllLocked()
+	unlock()
+
+	c.tagMu.Lock()
+	keys := c.tags.lookup(tag)
+	c.tagMu.Unlock()
+
+	for _, key := range keys {
+		c.Delete(key)
+	}
+
+	return len(keys)
+}
+
+// InvalidateTag `NewCache()`で生成した全てのキャッシュから、指定したタグが付いたエントリを削除し、削除した数を返す
+func InvalidateTag(tag string) int {
+	n := 0
+	for _, c := range registeredCaches() {
+		n += c.InvalidateTag(tag)
+	}
+
+	return n
+}
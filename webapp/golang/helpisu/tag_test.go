@@ -0,0 +1,152 @@
+package helpisu
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestInvalidateTag(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+		ops  func(c *Cache[int, string])
+		tag  string
+		want int
+		// wantKeys InvalidateTagの後に残っているKey
+		wantKeys []int
+	}{
+		{
+			name: "タグが付いたエントリだけを削除する",
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a", "user:1")
+				c.Set(2, "b", "user:1", "user:2")
+				c.Set(3, "c", "user:2")
+				c.Set(4, "d")
+			},
+			tag:      "user:1",
+			want:     2,
+			wantKeys: []int{3, 4},
+		},
+		{
+			name: "上書きするとタグも置き換わる",
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a", "user:1")
+				c.Set(1, "b", "user:2")
+			},
+			tag:      "user:1",
+			want:     0,
+			wantKeys: []int{1},
+		},
+		{
+			name: "削除したエントリは索引からも消える",
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a", "user:1")
+				c.Delete(1)
+			},
+			tag:  "user:1",
+			want: 0,
+		},
+		{
+			name: "追い出したエントリは索引からも消える",
+			opts: []Option{WithMaxEntries(1)},
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a", "user:1")
+				c.Set(2, "b", "user:2")
+			},
+			tag:      "user:1",
+			want:     0,
+			wantKeys: []int{2},
+		},
+		{
+			name: "WithTaggerで読み込んだエントリにもタグが付く",
+			opts: []Option{WithTagger(func(_ int, v string) []string { return []string{"user:" + v} })},
+			ops: func(c *Cache[int, string]) {
+				_, _ = c.GetOrLoad(1, loadString("1"))
+				_, _ = c.GetManyOrLoad([]int{2, 3}, func(keys []int) (map[int]string, error) {
+					return map[int]string{2: "1", 3: "2"}, nil
+				})
+			},
+			tag:      "user:1",
+			want:     2,
+			wantKeys: []int{3},
+		},
+		{
+			name: "Resetで索引も消える",
+			ops: func(c *Cache[int, string]) {
+				c.Set(1, "a", "user:1")
+				c.Reset()
+			},
+			tag:  "user:1",
+			want: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, string](t, tt.opts...)
+			tt.ops(c)
+
+			if got := c.InvalidateTag(tt.tag); got != tt.want {
+				t.Errorf("InvalidateTag() = %d, want %d", got, tt.want)
+			}
+
+			keys := []int{}
+			_ = c.ForEach(func(k int, _ string) error {
+				keys = append(keys, k)
+				return nil
+			})
+			if !equalKeys(keys, tt.wantKeys) {
+				t.Errorf("keys = %v, want %v", keys, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestInvalidateTagAllCaches(t *testing.T) {
+	users := newTestCache[int, string](t)
+	comments := NewCache[int, []string](t.Name()+"_comments", WithTagger(func(_ int, userIDs []string) []string {
+		tags := make([]string, 0, len(userIDs))
+		for _, id := range userIDs {
+			tags = append(tags, "user:"+id)
+		}
+		return tags
+	}))
+	t.Cleanup(func() { unregister(comments) })
+
+	users.Set(1, "alice", "user:1")
+	users.Set(2, "bob", "user:2")
+	comments.Set(10, []string{"1", "2"})
+	comments.Set(11, []string{"2"})
+
+	if got := InvalidateTag("user:1"); got != 2 {
+		t.Errorf("InvalidateTag() = %d, want 2", got)
+	}
+	if _, ok := users.Get(1); ok {
+		t.Error("users.Get(1) hit after InvalidateTag")
+	}
+	if _, ok := comments.Get(10); ok {
+		t.Error("comments.Get(10) hit after InvalidateTag")
+	}
+	if users.Len() != 1 || comments.Len() != 1 {
+		t.Errorf("Len() = %d, %d, want 1, 1", users.Len(), comments.Len())
+	}
+}
+
+// TestInvalidateTagPeers InvalidateTagで削除したことは他のプロセスにも伝わる
+func TestInvalidateTagPeers(t *testing.T) {
+	a, b, _ := newPeers(t)
+
+	for k := 1; k <= 3; k++ {
+		a.Set(k, strconv.Itoa(k), "tag")
+		_, _ = b.GetOrLoad(k, loadString(strconv.Itoa(k)))
+	}
+
+	if got := a.InvalidateTag("tag"); got != 3 {
+		t.Errorf("InvalidateTag() = %d, want 3", got)
+	}
+	for k := 1; k <= 3; k++ {
+		if _, ok := b.Get(k); ok {
+			t.Errorf("peer Get(%d) hit after InvalidateTag", k)
+		}
+	}
+}
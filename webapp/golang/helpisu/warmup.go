@@ -0,0 +1,153 @@
+package helpisu
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// WarmUpFunc キャッシュを事前に温める関数
+//
+//	読み込んだ値はSetではなくBeginFillで作ったFillerで入れてください
+//	ctxがキャンセルされたら(WarmUpAllのtimeoutを過ぎたら)すぐに戻ること
+type WarmUpFunc[K comparable, V any] func(ctx context.Context, c *Cache[K, V]) error
+
+// fillBatchSize FillManyでctxのキャンセルを確かめる間隔
+const fillBatchSize = stampBatchSize
+
+/*
+Filler DBなどからまとめて読み込んだ値をキャッシュに入れる
+
+	BeginFillを呼んだ後に書き込まれたKeyには入れないので、読み込んだ値で新しい値を上書きしません
+	(書き込みの回数はslotごとに記録しているので、同じslotの他のKeyも入れずに次の読み込みに任せます)
+	Setと異なり他のプロセスのエントリを無効にせず、WithRemoteのmemcachedにも書き込みません
+*/
+type Filler[K comparable, V any] struct {
+	c      *Cache[K, V]
+	epochs []uint64
+}
+
+// BeginFill DBなどから読み込む前に呼び、読み込んだ値は返したFillerで入れる
+func (c *Cache[K, V]) BeginFill() *Filler[K, V] {
+	epochs := make([]uint64, len(c.writes))
+	for i := range c.writes {
+		epochs[i] = c.writes[i].Load()
+	}
+
+	return &Filler[K, V]{c: c, epochs: epochs}
+}
+
+// FillMany valuesをキャッシュに入れ、入れた数を返す
+//
+//	WithInvalidationを指定している場合、memcachedへの問い合わせはまとめて行います
+//	ctxがキャンセルされたら、そこで止めてctx.Err()を返します
+func (f *Filler[K, V]) FillMany(ctx context.Context, values map[K]V) (int, error) {
+	c := f.c
+	filled := 0
+	keys := make([]K, 0, fillBatchSize)
+	entries := make([]*entry[V], 0, fillBatchSize)
+	flush := func() error {
+		err := ctx.Err()
+		if err != nil {
+			return err
+		}
+
+		c.stampMany(keys, entries)
+		for i, k := range keys {
+			if c.fill(k, entries[i], f.epochs[c.backend.slot(k)]) {
+				filled++
+			}
+		}
+		keys, entries = keys[:0], entries[:0]
+
+		return nil
+	}
+
+	for k, v := range values {
+		keys = append(keys, k)
+		entries = append(entries, c.unstampedEntry(v))
+		if len(keys) == fillBatchSize {
+			err := flush()
+			if err != nil {
+				return filled, err
+			}
+		}
+	}
+
+	return filled, flush()
+}
+
+// RegisterWarmUp WarmUpAllで実行する関数を登録
+func (c *Cache[K, V]) RegisterWarmUp(f WarmUpFunc[K, V]) {
+	c.warmUpMu.Lock()
+	defer c.warmUpMu.Unlock()
+
+	c.warmUps = append(c.warmUps, f)
+}
+
+// warmUpFuncs 登録されたWarmUpFuncをCacheに束縛して返す
+func (c *Cache[K, V]) warmUpFuncs() []func(ctx context.Context) error {
+	c.warmUpMu.Lock()
+	defer c.warmUpMu.Unlock()
+
+	fs := make([]func(ctx context.Context) error, 0, len(c.warmUps))
+	for _, f := range c.warmUps {
+		f := f
+		fs = append(fs, func(ctx context.Context) error {
+			return f(ctx, c)
+		})
+	}
+
+	return fs
+}
+
+// WarmUpAll `NewCache()`で生成した全てのキャッシュに登録されたWarmUpFuncを並行に実行する
+//
+//	timeoutを過ぎると、実行中の関数の終了を待たずにcontext.DeadlineExceededを含むエラーを返します
+//	関数に渡されるctxはその時点でキャンセルされるので、関数はそれを見て止まってください
+func WarmUpAll(ctx context.Context, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	for _, c := range registeredCaches() {
+		for _, f := range c.warmUpFuncs() {
+			wg.Add(1)
+			go func(name string, f func(ctx context.Context) error) {
+				defer wg.Done()
+
+				err := f(ctx)
+				if err != nil {
+					mu.Lock()
+					errs = append(errs, fmt.Errorf("%s: %w", name, err))
+					mu.Unlock()
+				}
+			}(c.Name(), f)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		mu.Lock()
+		errs = append(errs, fmt.Errorf("helpisu: warm up: %w", ctx.Err()))
+		mu.Unlock()
+	}
+
+	// timeout後も実行中の関数がerrsに追記するのでコピーして返す
+	mu.Lock()
+	defer mu.Unlock()
+
+	return joinErrors(append([]error(nil), errs...))
+}
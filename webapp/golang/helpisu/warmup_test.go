@@ -0,0 +1,180 @@
+package helpisu
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWarmUpAll(t *testing.T) {
+	c := newTestCache[int, string](t)
+	c.RegisterWarmUp(func(ctx context.Context, c *Cache[int, string]) error {
+		_, err := c.BeginFill().FillMany(ctx, map[int]string{1: "a", 2: "b"})
+		return err
+	})
+	c.RegisterWarmUp(func(context.Context, *Cache[int, string]) error {
+		return errLoad
+	})
+
+	err := WarmUpAll(context.Background(), time.Second)
+	if err == nil || !strings.Contains(err.Error(), c.Name()+": "+errLoad.Error()) {
+		t.Errorf("WarmUpAll() err = %v, want the error of %s", err, c.Name())
+	}
+	if c.Len() != 2 {
+		t.Errorf("Len() = %d, want 2", c.Len())
+	}
+}
+
+func TestWarmUpAllTimeout(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	canceled := make(chan struct{})
+	c.RegisterWarmUp(func(ctx context.Context, _ *Cache[int, string]) error {
+		<-ctx.Done()
+		close(canceled)
+		return ctx.Err()
+	})
+	// ctxを見ない関数の終了も待たない
+	release := make(chan struct{})
+	defer close(release)
+	c.RegisterWarmUp(func(context.Context, *Cache[int, string]) error {
+		<-release
+		return nil
+	})
+
+	start := time.Now()
+	err := WarmUpAll(context.Background(), 20*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("WarmUpAll() took %s, want about 20ms", elapsed)
+	}
+	if err == nil || !strings.Contains(err.Error(), context.DeadlineExceeded.Error()) {
+		t.Errorf("WarmUpAll() err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	select {
+	case <-canceled:
+	case <-time.After(time.Second):
+		t.Error("ctx passed to the warm-up function was not canceled")
+	}
+}
+
+func TestFiller(t *testing.T) {
+	tests := []struct {
+		name string
+		// write BeginFillとFillManyの間の書き込み
+		write     func(c *Cache[int, string])
+		want      string
+		wantOK    bool
+		wantOther bool
+	}{
+		{
+			name:      "書き込みが無ければ入れる",
+			write:     func(*Cache[int, string]) {},
+			want:      "db",
+			wantOK:    true,
+			wantOther: true,
+		},
+		{
+			name:      "Setした値を上書きしない",
+			write:     func(c *Cache[int, string]) { c.Set(1, "new") },
+			want:      "new",
+			wantOK:    true,
+			wantOther: true,
+		},
+		{
+			name:      "Deleteしたら入れない",
+			write:     func(c *Cache[int, string]) { c.Delete(1) },
+			wantOther: true,
+		},
+		{
+			name: "Updateした値を上書きしない",
+			write: func(c *Cache[int, string]) {
+				c.Update(1, func(old string, ok bool) (string, bool) { return old + "!", ok })
+			},
+			wantOther: true,
+		},
+		{
+			name:  "Resetしたら何も入れない",
+			write: func(c *Cache[int, string]) { c.Reset() },
+		},
+		{
+			name:  "InvalidateTagしたら何も入れない",
+			write: func(c *Cache[int, string]) { c.InvalidateTag("tag") },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestCache[int, string](t)
+
+			// 同じslotのKeyは書き込まれたKeyと一緒に捨てられるので、別のslotのKeyを選ぶ
+			other := 2
+			for c.backend.slot(other) == c.backend.slot(1) {
+				other++
+			}
+
+			f := c.BeginFill()
+			tt.write(c)
+			_, err := f.FillMany(context.Background(), map[int]string{1: "db", other: "other"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, ok := c.Get(1)
+			if v != tt.want || ok != tt.wantOK {
+				t.Errorf("Get(1) = %q, %v, want %q, %v", v, ok, tt.want, tt.wantOK)
+			}
+			if _, ok := c.Get(other); ok != tt.wantOther {
+				t.Errorf("Get(%d) ok = %v, want %v", other, ok, tt.wantOther)
+			}
+		})
+	}
+}
+
+func TestFillerCanceled(t *testing.T) {
+	c := newTestCache[int, string](t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	n, err := c.BeginFill().FillMany(ctx, map[int]string{1: "a"})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("FillMany() err = %v, want %v", err, context.Canceled)
+	}
+	if n != 0 || c.Len() != 0 {
+		t.Errorf("FillMany() filled %d entries (Len() = %d), want 0", n, c.Len())
+	}
+}
+
+// TestFillerInvalidation Fillerは他のプロセスのエントリを無効にせず、memcachedへの問い合わせをまとめる
+func TestFillerInvalidation(t *testing.T) {
+	a, b, mc := newPeers(t)
+	b.Set(1, "b")
+
+	values := map[int]string{}
+	for k := 1; k <= 1000; k++ {
+		values[k] = "a"
+	}
+	gets, incrs := mc.callCount("GetMulti"), mc.callCount("Increment")
+
+	n, err := a.BeginFill().FillMany(context.Background(), values)
+	if err != nil || n != len(values) {
+		t.Fatalf("FillMany() = %d, %v, want %d, nil", n, err, len(values))
+	}
+
+	if got := mc.callCount("GetMulti") - gets; got != len(values)/stampBatchSize {
+		t.Errorf("GetMulti called %d times, want %d", got, len(values)/stampBatchSize)
+	}
+	if got := mc.callCount("Increment") - incrs; got != 0 {
+		t.Errorf("Increment called %d times, want 0", got)
+	}
+
+	if v, ok := b.Get(1); !ok || v != "b" {
+		t.Errorf("peer Get() = %q, %v, want %q, true", v, ok, "b")
+	}
+	if v, ok := a.Get(1); !ok || v != "a" {
+		t.Errorf("Get() = %q, %v, want %q, true", v, ok, "a")
+	}
+}
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/catatsuy/private-isu/webapp/golang/repository"
+)
+
+const (
+	// uploadFieldLimit 投稿のbodyなど、ファイル以外のフォームの値の上限
+	uploadFieldLimit = 1024 * 1024
+	// uploadRequestLimit 投稿のリクエストボディの上限(画像にbodyなどのフォームの分を足したもの)
+	uploadRequestLimit = UploadLimit + uploadFieldLimit
+	// maxImagePixels 投稿できる画像の画素数の上限(小さなファイルで大量のメモリを使わせないため)
+	//
+	//	アニメーションGIFは全てのフレームの画素数の合計に対する上限です
+	maxImagePixels = 50 * 1000 * 1000
+	// variantJPEGQuality 縮小したJPEGの画質
+	variantJPEGQuality = 85
+)
+
+// imageVariantWidths ?w= で指定できる縮小後の幅
+//
+//	任意の幅を許すと、幅を変えたリクエストでいくらでもファイルを作らせられるので決めた幅だけにします
+var imageVariantWidths = []int{160, 320, 640}
+
+// imageMagics 画像の形式ごとのファイルの先頭のバイト列
+var imageMagics = []struct {
+	mime  string
+	magic []byte
+}{
+	{"image/jpeg", []byte("\xff\xd8\xff")},
+	{"image/png", []byte("\x89PNG\r\n\x1a\n")},
+	{"image/gif", []byte("GIF87a")},
+	{"image/gif", []byte("GIF89a")},
+}
+
+// sniffImage ファイルの先頭のバイト列から画像の形式を判定する(対応していない形式なら空文字列)
+func sniffImage(data []byte) string {
+	for _, m := range imageMagics {
+		if bytes.HasPrefix(data, m.magic) {
+			return m.mime
+		}
+	}
+
+	return ""
+}
+
+// uploadForm 投稿のフォーム
+type uploadForm struct {
+	CSRFToken string
+	Body      string
+	// ContentType fileのパートのContent-Type
+	ContentType string
+	// File アップロードされたファイル(fileが無ければnil)
+	File []byte
+}
+
+// readUploadForm 投稿のフォームをパートごとに読む
+//
+//	ParseMultipartFormのようにリクエスト全体を溜めず、fileはUploadLimit、それ以外の値はuploadFieldLimitを超えた時点で読むのをやめます
+//	リクエストボディもuploadRequestLimitまでしか読みません
+//	大きすぎる場合はerrImageTooLarge、フォームが読めなかった場合はerrImageRequiredを返します
+func readUploadForm(w http.ResponseWriter, r *http.Request) (uploadForm, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, uploadRequestLimit)
+
+	form := uploadForm{}
+	mr, err := r.MultipartReader()
+	if errors.Is(err, http.ErrNotMultipart) {
+		// ファイルの無いフォームとして読む
+		// MultipartReaderを呼んだ後はPostFormValueがフォームを読まないので、ParseFormを呼ぶ
+		err = r.ParseForm()
+		if err != nil {
+			return form, uploadError(err)
+		}
+		form.CSRFToken = r.PostForm.Get("csrf_token")
+		form.Body = r.PostForm.Get("body")
+		return form, nil
+	}
+	if err != nil {
+		return form, errImageRequired
+	}
+
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return form, nil
+		}
+		if err != nil {
+			return form, uploadError(err)
+		}
+
+		switch part.FormName() {
+		case "file":
+			// ファイルを選ばずに送ったフォームはfilenameが空になる
+			if part.FileName() == "" {
+				break
+			}
+			form.ContentType = part.Header.Get("Content-Type")
+			form.File, err = readLimited(part, UploadLimit)
+		case "csrf_token":
+			form.CSRFToken, err = readUploadField(part)
+		case "body":
+			form.Body, err = readUploadField(part)
+		}
+		if err != nil {
+			return form, uploadError(err)
+		}
+	}
+}
+
+// uploadError フォームを読んだときのエラーを利用者に見せるエラーに置き換える
+func uploadError(err error) error {
+	var mbe *http.MaxBytesError
+	if errors.As(err, &mbe) || errors.Is(err, errImageTooLarge) {
+		return errImageTooLarge
+	}
+
+	return errImageRequired
+}
+
+func readUploadField(r io.Reader) (string, error) {
+	data, err := readLimited(r, uploadFieldLimit)
+	return string(data), err
+}
+
+// readLimited limitバイトまで読む
+//
+//	limitを超えた時点で読むのをやめてerrImageTooLargeを返します
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errImageTooLarge
+	}
+
+	return data, nil
+}
+
+// validateImage 画像を最後までデコードして、壊れていないか確かめる
+func validateImage(mime string, data []byte) error {
+	var decodeConfig func(io.Reader) (image.Config, error)
+	var decode func(io.Reader) error
+	switch mime {
+	case "image/jpeg":
+		decodeConfig = jpeg.DecodeConfig
+		decode = func(r io.Reader) error {
+			_, err := jpeg.Decode(r)
+			return err
+		}
+	case "image/png":
+		decodeConfig = png.DecodeConfig
+		decode = func(r io.Reader) error {
+			_, err := png.Decode(r)
+			return err
+		}
+	case "image/gif":
+		decodeConfig = gif.DecodeConfig
+		decode = func(r io.Reader) error {
+			// アニメーションGIFは全てのフレームを確かめる
+			_, err := gif.DecodeAll(r)
+			return err
+		}
+	default:
+		return errImageType
+	}
+
+	cfg, err := decodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return errImageBroken
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return errImageBroken
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > maxImagePixels {
+		return errImageDimensions
+	}
+	if mime == "image/gif" {
+		// DecodeAllはフレームごとに画像を確保するので、デコードする前にフレームの画素数の合計を確かめる
+		_, pixels, err := gifFrames(data)
+		if err != nil {
+			return errImageBroken
+		}
+		if pixels > maxImagePixels {
+			return errImageDimensions
+		}
+	}
+
+	if decode(bytes.NewReader(data)) != nil {
+		return errImageBroken
+	}
+
+	return nil
+}
+
+// gifFrames GIFのブロックを読み飛ばして、フレームの数と全てのフレームの画素数の合計を返す
+//
+//	画素のデータは展開しないので、大きなGIFでもメモリを使わずに確かめられます
+func gifFrames(data []byte) (frames int, pixels int64, err error) {
+	// ヘッダー(6 byte)と論理画面記述子(7 byte)
+	if len(data) < 13 || !bytes.HasPrefix(data, []byte("GIF8")) {
+		return 0, 0, errMalformedImage
+	}
+	i := 13
+	if data[10]&0x80 != 0 {
+		// グローバルカラーテーブル
+		i += 3 << (data[10]&0x07 + 1)
+	}
+
+	for i < len(data) {
+		switch data[i] {
+		case 0x3b: // トレーラー
+			return frames, pixels, nil
+		case 0x21: // 拡張ブロック(導入子とラベルの後にサブブロックが続く)
+			i += 2
+		case 0x2c: // イメージ記述子
+			if i+10 > len(data) {
+				return 0, 0, errMalformedImage
+			}
+			w := int64(binary.LittleEndian.Uint16(data[i+5 : i+7]))
+			h := int64(binary.LittleEndian.Uint16(data[i+7 : i+9]))
+			frames++
+			pixels += w * h
+
+			packed := data[i+9]
+			i += 10
+			if packed&0x80 != 0 {
+				// ローカルカラーテーブル
+				i += 3 << (packed&0x07 + 1)
+			}
+			// LZWの最小コードサイズの後に画素のデータのサブブロックが続く
+			i++
+		default:
+			return 0, 0, errMalformedImage
+		}
+
+		// サブブロックは長さが0のブロックで終わる
+		for {
+			if i >= len(data) {
+				return 0, 0, errMalformedImage
+			}
+			n := int(data[i])
+			i += 1 + n
+			if n == 0 {
+				break
+			}
+		}
+	}
+
+	// トレーラーが無くてもデコーダーに任せる
+	return frames, pixels, nil
+}
+
+// parseVariantWidth ?w= の値を幅にする(imageVariantWidthsに無ければfalse)
+func parseVariantWidth(s string) (int, bool) {
+	width, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, false
+	}
+	for _, w := range imageVariantWidths {
+		if w == width {
+			return width, true
+		}
+	}
+
+	return 0, false
+}
+
+// variantPath 縮小した画像のファイルのパス(例: 123_w320.jpg)
+//
+//	元の画像と同じディレクトリに置きます。/image/{id}.{ext} のidにはならない名前なので、アプリから直接は見えません
+func variantPath(key repository.ImageKey, width int) string {
+	return filepath.Join(imageVariantDir, fmt.Sprintf("%d_w%d.%s", key.PostID, width, repository.ImageExt(key.Mime)))
+}
+
+// loadImageVariant 幅をwidthに縮小した画像を取得する
+//
+//	作った画像はファイルに置き、次からはそれを返します
+//	元の画像の方が小さい場合やアニメーションGIFは縮小せず、元の画像をそのまま返します
+func loadImageVariant(key repository.ImageKey, width int) ([]byte, error) {
+	p := variantPath(key, width)
+	data, err := os.ReadFile(p)
+	if err == nil {
+		return data, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	orig, err := imageStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err = resizeImageData(key.Mime, orig, width)
+	if err != nil {
+		return nil, err
+	}
+
+	// 置けなくても次のリクエストで作り直せばよいので、縮小した画像は返す
+	err = repository.WriteFileAtomic(p, data)
+	if err != nil {
+		log.Print(err)
+	}
+
+	return data, nil
+}
+
+// resizeImageData mimeの画像を幅widthに縮小して同じ形式でエンコードする
+func resizeImageData(mime string, data []byte, width int) ([]byte, error) {
+	var img image.Image
+	var err error
+	switch mime {
+	case "image/jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "image/gif":
+		// アニメーションGIFは縮小しないので、フレームを数えるだけでデコードしない
+		var frames int
+		var pixels int64
+		frames, pixels, err = gifFrames(data)
+		if err == nil && frames > 1 {
+			return data, nil
+		}
+		if err == nil && pixels > maxImagePixels {
+			err = errImageDimensions
+		}
+		if err == nil {
+			img, err = gif.Decode(bytes.NewReader(data))
+		}
+	default:
+		return nil, fmt.Errorf("resize: unsupported mime %q", mime)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if img.Bounds().Dx() <= width {
+		return data, nil
+	}
+
+	resized := resizeImage(img, width)
+	buf := &bytes.Buffer{}
+	switch mime {
+	case "image/jpeg":
+		err = jpeg.Encode(buf, resized, &jpeg.Options{Quality: variantJPEGQuality})
+	case "image/png":
+		err = png.Encode(buf, resized)
+	case "image/gif":
+		err = gif.Encode(buf, resized, nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// resizeImage 縦横比を保ったまま幅がwidthになるよう縮小する
+//
+//	縮小先の1画素に対応する元の画像の範囲の平均をとります(面積平均法)
+//	拡大には使わないこと
+func resizeImage(src image.Image, width int) *image.RGBA64 {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	height := sh * width / sw
+	if height < 1 {
+		height = 1
+	}
+
+	dst := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy0, sy1 := y*sh/height, (y+1)*sh/height
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < width; x++ {
+			sx0, sx1 := x*sw/width, (x+1)*sw/width
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			// RGBA()はアルファ乗算済みの値なので、そのまま平均してよい
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					cr, cg, cb, ca := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r += uint64(cr)
+					g += uint64(cg)
+					bl += uint64(cb)
+					a += uint64(ca)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(bl / n), A: uint16(a / n)})
+		}
+	}
+
+	return dst
+}
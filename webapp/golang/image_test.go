@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResizeImage(t *testing.T) {
+	// 左半分が黒、右半分が白の4x2の画像を2x1に縮小すると、それぞれの半分の平均になる
+	src := image.NewGray(image.Rect(0, 0, 4, 2))
+	for y := 0; y < 2; y++ {
+		for x := 2; x < 4; x++ {
+			src.SetGray(x, y, color.Gray{Y: 0xff})
+		}
+	}
+
+	dst := resizeImage(src, 2)
+	if dst.Bounds() != image.Rect(0, 0, 2, 1) {
+		t.Fatalf("bounds = %v, want 2x1", dst.Bounds())
+	}
+	if got := dst.RGBA64At(0, 0); got.R != 0 || got.A != 0xffff {
+		t.Errorf("left = %v, want black", got)
+	}
+	if got := dst.RGBA64At(1, 0); got.R != 0xffff || got.A != 0xffff {
+		t.Errorf("right = %v, want white", got)
+	}
+}
+
+func TestGetImageVariant(t *testing.T) {
+	app := newTestApp(t)
+	alice := app.addUser("alice", "alicepass", 0, 0)
+	pngData := testImageSize(t, "image/png", 800, 600)
+	gifData := testImageSize(t, "image/gif", 100, 50)
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/png", Imgdata: pngData, Body: "post"})
+	app.mem.AddPost(Post{UserID: alice.ID, Mime: "image/gif", Imgdata: gifData, Body: "post"})
+	c := app.newClient()
+
+	tests := []struct {
+		name      string
+		path      string
+		wantCode  int
+		wantSize  image.Point
+		wantBody  []byte
+		wantCache string
+	}{
+		{name: "original", path: "/image/1.png", wantCode: http.StatusOK, wantBody: pngData},
+		{name: "w=320", path: "/image/1.png?w=320", wantCode: http.StatusOK, wantSize: image.Pt(320, 240), wantCache: "1_w320.png"},
+		{name: "w=160", path: "/image/1.png?w=160", wantCode: http.StatusOK, wantSize: image.Pt(160, 120), wantCache: "1_w160.png"},
+		{name: "smaller than width", path: "/image/2.gif?w=640", wantCode: http.StatusOK, wantBody: gifData},
+		{name: "width not allowed", path: "/image/1.png?w=321", wantCode: http.StatusBadRequest},
+		{name: "invalid width", path: "/image/1.png?w=abc", wantCode: http.StatusBadRequest},
+		{name: "wrong extension", path: "/image/1.jpg?w=320", wantCode: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			res := c.get(tt.path)
+			if res.status != tt.wantCode {
+				t.Fatalf("status = %d, want %d", res.status, tt.wantCode)
+			}
+			if tt.wantBody != nil && res.body != string(tt.wantBody) {
+				t.Error("body differs from original image")
+			}
+			if tt.wantSize != (image.Point{}) {
+				if res.contentType != "image/png" {
+					t.Errorf("content type = %q, want image/png", res.contentType)
+				}
+				cfg, _, err := image.DecodeConfig(bytes.NewReader([]byte(res.body)))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := image.Pt(cfg.Width, cfg.Height); got != tt.wantSize {
+					t.Errorf("size = %v, want %v", got, tt.wantSize)
+				}
+			}
+			if tt.wantCache != "" {
+				cached, err := os.ReadFile(filepath.Join(app.imageDir, tt.wantCache))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(cached) != res.body {
+					t.Error("cached variant differs from response")
+				}
+			}
+		})
+	}
+
+	// 2回目からはファイルに置いた画像を返す
+	err := os.WriteFile(filepath.Join(app.imageDir, "1_w320.png"), []byte("cached"), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := c.get("/image/1.png?w=320"); res.body != "cached" {
+		t.Error("variant is not served from the cache")
+	}
+}
+
+func TestResizeAnimatedGIF(t *testing.T) {
+	frame := func() *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 1000, 10), color.Palette{color.White, color.Black})
+	}
+	buf := &bytes.Buffer{}
+	err := gif.EncodeAll(buf, &gif.GIF{Image: []*image.Paletted{frame(), frame()}, Delay: []int{10, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// アニメーションGIFは縮小せずにそのまま返す
+	data, err := resizeImageData("image/gif", buf.Bytes(), 320)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, buf.Bytes()) {
+		t.Error("animated gif is resized")
+	}
+}
+
+// multipartBody フォームの値とファイルをmultipartにする(filenameが空ならファイルを選ばなかったフォーム)
+func multipartBody(t *testing.T, fields [][2]string, filename string, file []byte) (body []byte, contentType string) {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	mw := multipart.NewWriter(buf)
+	for _, f := range fields {
+		err := mw.WriteField(f[0], f[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if file != nil {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", `form-data; name="file"; filename="`+filename+`"`)
+		h.Set("Content-Type", "image/png")
+		part, err := mw.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = part.Write(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes(), mw.FormDataContentType()
+}
+
+func TestReadUploadForm(t *testing.T) {
+	fields := [][2]string{{"csrf_token", "token"}, {"body", "hello"}}
+
+	tests := []struct {
+		name string
+		// body リクエストボディとContent-Type
+		body     func(t *testing.T) ([]byte, string)
+		want     uploadForm
+		wantErr  error
+		wantRead int
+	}{
+		{
+			name: "フォームとファイル",
+			body: func(t *testing.T) ([]byte, string) { return multipartBody(t, fields, "a.png", []byte("png")) },
+			want: uploadForm{CSRFToken: "token", Body: "hello", ContentType: "image/png", File: []byte("png")},
+		},
+		{
+			name: "ファイルを選ばなかった",
+			body: func(t *testing.T) ([]byte, string) { return multipartBody(t, fields, "", []byte{}) },
+			want: uploadForm{CSRFToken: "token", Body: "hello"},
+		},
+		{
+			name: "multipartでない",
+			body: func(*testing.T) ([]byte, string) {
+				return []byte("csrf_token=token&body=hello"), "application/x-www-form-urlencoded"
+			},
+			want: uploadForm{CSRFToken: "token", Body: "hello"},
+		},
+		{
+			name: "壊れたmultipart",
+			body: func(*testing.T) ([]byte, string) {
+				return []byte("--x\r\nbroken"), "multipart/form-data; boundary=x"
+			},
+			wantErr: errImageRequired,
+		},
+		{
+			name: "ファイルが大きすぎる",
+			body: func(t *testing.T) ([]byte, string) {
+				return multipartBody(t, fields, "a.png", make([]byte, UploadLimit+1))
+			},
+			wantErr: errImageTooLarge,
+		},
+		{
+			name: "ファイル以外の値が大きすぎる",
+			body: func(t *testing.T) ([]byte, string) {
+				return multipartBody(t, [][2]string{{"body", strings.Repeat("a", uploadFieldLimit+1)}}, "a.png", []byte("png"))
+			},
+			wantErr: errImageTooLarge,
+		},
+		{
+			name: "リクエストが大きすぎる",
+			body: func(t *testing.T) ([]byte, string) {
+				return multipartBody(t, [][2]string{{"body", strings.Repeat("a", uploadFieldLimit)}}, "a.png", make([]byte, UploadLimit))
+			},
+			wantErr: errImageTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, contentType := tt.body(t)
+			body := &countingReader{r: bytes.NewReader(data)}
+			req := httptest.NewRequest(http.MethodPost, "/", body)
+			req.Header.Set("Content-Type", contentType)
+
+			got, err := readUploadForm(httptest.NewRecorder(), req)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readUploadForm() err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && (got.CSRFToken != tt.want.CSRFToken || got.Body != tt.want.Body ||
+				got.ContentType != tt.want.ContentType || !bytes.Equal(got.File, tt.want.File) || (got.File == nil) != (tt.want.File == nil)) {
+				t.Errorf("readUploadForm() = %+v, want %+v", got, tt.want)
+			}
+			// 上限を超えたら残りを読まない(multipartのバッファの分は読む)
+			if body.n > uploadRequestLimit+64*1024 {
+				t.Errorf("read %d bytes, want at most about %d", body.n, uploadRequestLimit)
+			}
+		})
+	}
+}
+
+// TestReadUploadFormStopsEarly 大きすぎるファイルはUploadLimitを超えた時点で読むのをやめる
+func TestReadUploadFormStopsEarly(t *testing.T) {
+	data, contentType := multipartBody(t, nil, "a.png", make([]byte, 2*UploadLimit))
+	body := &countingReader{r: bytes.NewReader(data)}
+	req := httptest.NewRequest(http.MethodPost, "/", body)
+	req.Header.Set("Content-Type", contentType)
+
+	_, err := readUploadForm(httptest.NewRecorder(), req)
+	if !errors.Is(err, errImageTooLarge) {
+		t.Fatalf("readUploadForm() err = %v, want %v", err, errImageTooLarge)
+	}
+	if body.n > UploadLimit+64*1024 {
+		t.Errorf("read %d bytes, want about %d", body.n, UploadLimit)
+	}
+}
+
+func TestValidateGIF(t *testing.T) {
+	// animatedGIF 同じフレームをn枚並べたwidth x heightのGIF
+	//
+	//	エンコードは1枚だけにして、グローバルカラーテーブルからトレーラーまでのフレームのブロックを繰り返す
+	animatedGIF := func(width, height, n int) []byte {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), color.Palette{color.White, color.Black})
+		buf := &bytes.Buffer{}
+		err := gif.Encode(buf, frame, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := buf.Bytes()
+
+		start := 13
+		if data[10]&0x80 != 0 {
+			start += 3 << (data[10]&0x07 + 1)
+		}
+		out := append([]byte{}, data[:start]...)
+		for i := 0; i < n; i++ {
+			out = append(out, data[start:len(data)-1]...)
+		}
+		return append(out, data[len(data)-1])
+	}
+	small := animatedGIF(10, 10, 3)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		wantFrames int
+		wantErr    error
+	}{
+		{
+			name:       "1枚",
+			data:       animatedGIF(10, 10, 1),
+			wantFrames: 1,
+		},
+		{
+			name:       "アニメーション",
+			data:       small,
+			wantFrames: 3,
+		},
+		{
+			// 1枚ずつは上限より小さいが、合計で上限を超える
+			name:       "フレームの合計が上限を超える",
+			data:       animatedGIF(5000, 1000, maxImagePixels/(5000*1000)+1),
+			wantFrames: maxImagePixels/(5000*1000) + 1,
+			wantErr:    errImageDimensions,
+		},
+		{
+			name:    "途中で切れている",
+			data:    small[:len(small)/2],
+			wantErr: errImageBroken,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frames, _, err := gifFrames(tt.data)
+			if tt.wantFrames > 0 && (err != nil || frames != tt.wantFrames) {
+				t.Errorf("gifFrames() = %d, %v, want %d", frames, err, tt.wantFrames)
+			}
+
+			err = validateImage("image/gif", tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("validateImage() err = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
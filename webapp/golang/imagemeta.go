@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+)
+
+// orientedJPEGQuality Orientationを反映するために再エンコードするJPEGの画質
+const orientedJPEGQuality = 90
+
+var errMalformedImage = errors.New("malformed image")
+
+// JPEGのマーカー
+const (
+	jpegSOI   = 0xd8
+	jpegEOI   = 0xd9
+	jpegSOS   = 0xda
+	jpegAPP1  = 0xe1 // EXIF, XMP
+	jpegAPP13 = 0xed // Photoshop, IPTC
+	jpegCOM   = 0xfe
+)
+
+// pngMetadataChunks 投稿から取り除くPNGのチャンク(テキストとEXIF)
+var pngMetadataChunks = map[string]bool{
+	"tEXt": true,
+	"zTXt": true,
+	"iTXt": true,
+	"eXIf": true,
+}
+
+// stripImageMetadata 位置情報などが入っている画像のメタデータを取り除く
+//
+//	JPEG: APP1(EXIF, XMP), APP13(IPTC), COMを取り除きます。EXIFのOrientationが回転や反転を示す場合は
+//	      画素に反映して再エンコードします(再エンコードしたJPEGにはメタデータは残りません)
+//	PNG: tEXt, zTXt, iTXt, eXIfチャンクを取り除きます
+//	GIF: そのまま返します
+func stripImageMetadata(mime string, data []byte) ([]byte, error) {
+	switch mime {
+	case "image/jpeg":
+		stripped, orientation, err := stripJPEGMetadata(data)
+		if err != nil {
+			return nil, err
+		}
+		if orientation <= 1 {
+			return stripped, nil
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(stripped))
+		if err != nil {
+			return nil, err
+		}
+		buf := &bytes.Buffer{}
+		err = jpeg.Encode(buf, applyOrientation(img, orientation), &jpeg.Options{Quality: orientedJPEGQuality})
+		if err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "image/png":
+		return stripPNGMetadata(data)
+	default:
+		return data, nil
+	}
+}
+
+// stripJPEGMetadata JPEGのメタデータのセグメントを取り除き、EXIFのOrientation(無ければ1)を返す
+//
+//	スキャンの画像のデータには触れないので、画質は変わりません
+//	EOIより後ろ(MPFで連結された2枚目以降の画像などで、それぞれがEXIFを持てる)は取り除きます
+func stripJPEGMetadata(data []byte) ([]byte, int, error) {
+	if len(data) < 2 || data[0] != 0xff || data[1] != jpegSOI {
+		return nil, 0, errMalformedImage
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	orientation := 1
+	i := 2
+	for {
+		if i+1 >= len(data) || data[i] != 0xff {
+			return nil, 0, errMalformedImage
+		}
+		// マーカーの前には0xffを詰め物として置ける
+		if data[i+1] == 0xff {
+			i++
+			continue
+		}
+
+		marker := data[i+1]
+		if marker == jpegEOI {
+			out = append(out, data[i:i+2]...)
+			return out, orientation, nil
+		}
+		// 長さを持たないマーカー
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+
+		if i+4 > len(data) {
+			return nil, 0, errMalformedImage
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:i+4]))
+		if end > len(data) || end < i+4 {
+			return nil, 0, errMalformedImage
+		}
+
+		switch marker {
+		case jpegSOS:
+			// スキャンのデータは次のマーカーまで続く(プログレッシブJPEGはスキャンが複数ある)
+			next := jpegScanEnd(data, end)
+			out = append(out, data[i:next]...)
+			if next == len(data) {
+				// EOIの無いJPEGもデコーダーは受け付けるので、そのまま返す
+				return out, orientation, nil
+			}
+			end = next
+		case jpegAPP1:
+			// Orientationだけ読んで、セグメントは取り除く
+			if o, ok := exifOrientation(data[i+4 : end]); ok {
+				orientation = o
+			}
+		case jpegAPP13, jpegCOM:
+			// 取り除く
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+}
+
+// jpegScanEnd startから始まるスキャンのデータの後ろにある、次のマーカーの位置を返す
+//
+//	データの中の0xffの後には0x00(0xffそのもの)かRSTが続くので、それ以外が続く0xffをマーカーとみなします
+//	マーカーが無ければlen(data)を返します
+func jpegScanEnd(data []byte, start int) int {
+	for j := start; j+1 < len(data); j++ {
+		if data[j] != 0xff {
+			continue
+		}
+		next := data[j+1]
+		if next == 0x00 || next == 0xff || (next >= 0xd0 && next <= 0xd7) {
+			continue
+		}
+		return j
+	}
+
+	return len(data)
+}
+
+// exifOrientation APP1セグメントの中身がEXIFなら、IFD0のOrientationを返す
+func exifOrientation(payload []byte) (int, bool) {
+	if !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+		return 0, false
+	}
+	tiff := payload[6:]
+	if len(tiff) < 8 {
+		return 0, false
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0, false
+	}
+	if order.Uint16(tiff[2:4]) != 42 {
+		return 0, false
+	}
+
+	ifd := int(order.Uint32(tiff[4:8]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, false
+	}
+	n := int(order.Uint16(tiff[ifd : ifd+2]))
+	for e := 0; e < n; e++ {
+		off := ifd + 2 + e*12
+		if off+12 > len(tiff) {
+			return 0, false
+		}
+		// Orientation(0x0112)はSHORT(3)が1つ
+		if order.Uint16(tiff[off:off+2]) != 0x0112 || order.Uint16(tiff[off+2:off+4]) != 3 {
+			continue
+		}
+		o := int(order.Uint16(tiff[off+8 : off+10]))
+		if o < 1 || o > 8 {
+			return 0, false
+		}
+		return o, true
+	}
+
+	return 0, false
+}
+
+// applyOrientation EXIFのOrientation(1〜8)に従って画像を回転、反転する
+func applyOrientation(src image.Image, orientation int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	// dst(x, y)に置く元の画像の画素の位置
+	var at func(x, y int) (int, int)
+	switch orientation {
+	case 2: // 左右反転
+		at = func(x, y int) (int, int) { return w - 1 - x, y }
+	case 3: // 180度回転
+		at = func(x, y int) (int, int) { return w - 1 - x, h - 1 - y }
+	case 4: // 上下反転
+		at = func(x, y int) (int, int) { return x, h - 1 - y }
+	case 5: // 左上と右下を結ぶ線で反転
+		at = func(x, y int) (int, int) { return y, x }
+	case 6: // 時計回りに90度回転
+		at = func(x, y int) (int, int) { return y, h - 1 - x }
+	case 7: // 右上と左下を結ぶ線で反転
+		at = func(x, y int) (int, int) { return w - 1 - y, h - 1 - x }
+	case 8: // 反時計回りに90度回転
+		at = func(x, y int) (int, int) { return w - 1 - y, x }
+	default:
+		return src
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			sx, sy := at(x, y)
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+
+	return dst
+}
+
+// stripPNGMetadata PNGからpngMetadataChunksのチャンクを取り除く
+//
+//	他のチャンクはCRCも含めてそのまま残すので、画像は変わりません
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	const signature = "\x89PNG\r\n\x1a\n"
+	if !bytes.HasPrefix(data, []byte(signature)) {
+		return nil, errMalformedImage
+	}
+
+	out := make([]byte, 0, len(data))
+	out = append(out, signature...)
+	i := len(signature)
+	for i < len(data) {
+		// 長さ(4) + 種類(4) + データ + CRC(4)
+		if i+8 > len(data) {
+			return nil, errMalformedImage
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:i+4]))
+		if end > len(data) || end < i+12 {
+			return nil, errMalformedImage
+		}
+
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+
+	return out, nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// exifSegment OrientationとGPSInfoを持つEXIFのAPP1セグメント
+func exifSegment(orientation uint16) []byte {
+	tiff := []byte("MM\x00\x2a\x00\x00\x00\x08")
+	tiff = binary.BigEndian.AppendUint16(tiff, 2)
+	// Orientation SHORT 1
+	tiff = append(tiff, 0x01, 0x12, 0x00, 0x03, 0x00, 0x00, 0x00, 0x01)
+	tiff = binary.BigEndian.AppendUint16(tiff, orientation)
+	tiff = append(tiff, 0x00, 0x00)
+	// GPSInfo LONG 1
+	tiff = append(tiff, 0x88, 0x25, 0x00, 0x04, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00)
+	tiff = append(tiff, 0x00, 0x00, 0x00, 0x00)
+
+	payload := append([]byte("Exif\x00\x00"), tiff...)
+	seg := []byte{0xff, jpegAPP1}
+	seg = binary.BigEndian.AppendUint16(seg, uint16(len(payload)+2))
+	return append(seg, payload...)
+}
+
+// insertAfter dataのn byte目の後ろにsegを入れる
+func insertAfter(data []byte, n int, seg []byte) []byte {
+	out := append([]byte{}, data[:n]...)
+	out = append(out, seg...)
+	return append(out, data[n:]...)
+}
+
+func pngChunk(typ string, body []byte) []byte {
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(chunk, typ...)
+	chunk = append(chunk, body...)
+	return binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+}
+
+// halfImageJPEG 左半分が黒、右半分が白の16x8のJPEG
+func halfImageJPEG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewGray(image.Rect(0, 0, 16, 8))
+	for y := 0; y < 8; y++ {
+		for x := 8; x < 16; x++ {
+			img.SetGray(x, y, color.Gray{Y: 0xff})
+		}
+	}
+	buf := &bytes.Buffer{}
+	err := jpeg.Encode(buf, img, &jpeg.Options{Quality: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestStripImageMetadata(t *testing.T) {
+	jpegData := testImage(t, "image/jpeg")
+	pngData := testImage(t, "image/png")
+	gifData := testImage(t, "image/gif")
+	comment := []byte{0xff, jpegCOM, 0x00, 0x07, 'h', 'e', 'l', 'l', 'o'}
+
+	tests := []struct {
+		name    string
+		mime    string
+		data    []byte
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "jpeg with exif and comment",
+			mime: "image/jpeg",
+			data: insertAfter(insertAfter(jpegData, 2, exifSegment(1)), 2, comment),
+			want: jpegData,
+		},
+		{
+			name: "jpeg with padding before marker",
+			mime: "image/jpeg",
+			data: insertAfter(jpegData, 2, append([]byte{0xff}, exifSegment(1)...)),
+			want: jpegData,
+		},
+		{
+			name: "jpeg without metadata",
+			mime: "image/jpeg",
+			data: jpegData,
+			want: jpegData,
+		},
+		{
+			// MPFのように、EOIの後ろにEXIFを持つ2枚目の画像を連結する
+			name: "jpeg with data after EOI",
+			mime: "image/jpeg",
+			data: append(append([]byte{}, jpegData...), insertAfter(jpegData, 2, exifSegment(1))...),
+			want: jpegData,
+		},
+		{
+			// プログレッシブJPEGのように、スキャンの後ろにもセグメントが続く
+			name: "jpeg with comment after scan",
+			mime: "image/jpeg",
+			data: insertAfter(jpegData, len(jpegData)-2, comment),
+			want: jpegData,
+		},
+		{
+			name: "jpeg without EOI",
+			mime: "image/jpeg",
+			data: jpegData[:len(jpegData)-2],
+			want: jpegData[:len(jpegData)-2],
+		},
+		{
+			name:    "jpeg with broken segment",
+			mime:    "image/jpeg",
+			data:    insertAfter(jpegData, 2, []byte{0xff, jpegAPP1, 0xff, 0xff}),
+			wantErr: true,
+		},
+		{
+			// IHDR(8 + 25 byte)の後ろにテキストとEXIFを入れる
+			name: "png with text chunks",
+			mime: "image/png",
+			data: insertAfter(insertAfter(pngData, 33, pngChunk("tEXt", []byte("Comment\x00hello"))), 33, pngChunk("eXIf", exifSegment(1)[10:])),
+			want: pngData,
+		},
+		{
+			name:    "truncated png",
+			mime:    "image/png",
+			data:    pngData[:30],
+			wantErr: true,
+		},
+		{
+			name: "gif",
+			mime: "image/gif",
+			data: gifData,
+			want: gifData,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := stripImageMetadata(tt.mime, tt.data)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Error("metadata is not stripped losslessly")
+			}
+		})
+	}
+}
+
+func TestStripImageMetadataOrientation(t *testing.T) {
+	src := halfImageJPEG(t)
+
+	tests := []struct {
+		orientation uint16
+		wantSize    image.Point
+		// dark 黒くなるべき位置、light 白くなるべき位置
+		dark, light image.Point
+	}{
+		{orientation: 2, wantSize: image.Pt(16, 8), dark: image.Pt(15, 4), light: image.Pt(0, 4)},
+		{orientation: 3, wantSize: image.Pt(16, 8), dark: image.Pt(15, 0), light: image.Pt(0, 7)},
+		{orientation: 4, wantSize: image.Pt(16, 8), dark: image.Pt(0, 0), light: image.Pt(15, 7)},
+		{orientation: 5, wantSize: image.Pt(8, 16), dark: image.Pt(4, 0), light: image.Pt(4, 15)},
+		{orientation: 6, wantSize: image.Pt(8, 16), dark: image.Pt(4, 0), light: image.Pt(4, 15)},
+		{orientation: 7, wantSize: image.Pt(8, 16), dark: image.Pt(4, 15), light: image.Pt(4, 0)},
+		{orientation: 8, wantSize: image.Pt(8, 16), dark: image.Pt(4, 15), light: image.Pt(4, 0)},
+	}
+
+	for _, tt := range tests {
+		got, err := stripImageMetadata("image/jpeg", insertAfter(src, 2, exifSegment(tt.orientation)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Contains(got, []byte("Exif")) {
+			t.Errorf("orientation %d: exif remains", tt.orientation)
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(got))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if size := img.Bounds().Size(); size != tt.wantSize {
+			t.Errorf("orientation %d: size = %v, want %v", tt.orientation, size, tt.wantSize)
+			continue
+		}
+		gray := func(p image.Point) uint8 {
+			return color.GrayModel.Convert(img.At(p.X, p.Y)).(color.Gray).Y
+		}
+		if gray(tt.dark) > 0x40 || gray(tt.light) < 0xc0 {
+			t.Errorf("orientation %d: %v = %d, %v = %d", tt.orientation, tt.dark, gray(tt.dark), tt.light, gray(tt.light))
+		}
+	}
+}
+
+func TestPostIndexImageMetadata(t *testing.T) {
+	jpegData := testImage(t, "image/jpeg")
+	upload := insertAfter(jpegData, 2, exifSegment(1))
+
+	tests := []struct {
+		name string
+		keep bool
+		want []byte
+	}{
+		{name: "strip", want: jpegData},
+		{name: "keep", keep: true, want: upload},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := keepImageMetadata
+			keepImageMetadata = tt.keep
+			t.Cleanup(func() { keepImageMetadata = orig })
+
+			app := newTestApp(t)
+			app.addUser("alice", "alicepass", 0, 0)
+			c := app.newClient()
+			c.login("alice", "alicepass")
+
+			res := c.postMultipart("/", map[string]string{"body": "hello", "csrf_token": c.csrfToken()}, &testFile{contentType: "image/jpeg", data: upload})
+			if res.status != http.StatusFound || res.location != "/posts/1" {
+				t.Fatalf("status = %d, location = %q", res.status, res.location)
+			}
+
+			data, err := os.ReadFile(filepath.Join(app.imageDir, "1.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(data, tt.want) {
+				t.Error("saved image differs")
+			}
+		})
+	}
+}
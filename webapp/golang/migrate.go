@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/catatsuy/private-isu/webapp/golang/repository"
+)
+
+// migrateImagesBatch 1度に一覧する投稿の数
+const migrateImagesBatch = 1000
+
+// imageChecksummer 画像を読み込まずにチェックサムを計算できるImageStore(repository.FileImageStoreなど)
+type imageChecksummer interface {
+	Checksum(key repository.ImageKey) (string, error)
+}
+
+// imageMigrationSource migrate-imagesで画像を読み出す元(repository.MySQLImageStoreが満たす)
+type imageMigrationSource interface {
+	repository.ImageStore
+	imageChecksummer
+	ListKeys(afterID, limit int) ([]repository.ImageKey, error)
+}
+
+// imageChecksum 画像のImageChecksum(sがChecksumを持たなければ画像を読んで計算する)
+func imageChecksum(s repository.ImageStore, key repository.ImageKey) (string, error) {
+	if c, ok := s.(imageChecksummer); ok {
+		return c.Checksum(key)
+	}
+
+	data, err := s.Get(key)
+	if err != nil {
+		return "", err
+	}
+
+	return repository.ImageChecksum(data), nil
+}
+
+type migrateImagesOptions struct {
+	Concurrency int
+	// ClearSource 書き出して確かめた画像を読み出し元から消す
+	ClearSource bool
+	// LogEvery 何件ごとに進捗をログに出すか(0なら出さない)
+	LogEvery int
+}
+
+type migrateImagesResult struct {
+	// Migrated 書き出した画像の数
+	Migrated int64
+	// Skipped 既に同じ画像が書き出されていた数
+	Skipped int64
+	// Missing どちらにも画像が無かった数
+	Missing int64
+	// Cleared 読み出し元から消した数
+	Cleared int64
+	// Failed エラーになった数
+	Failed int64
+}
+
+func (r *migrateImagesResult) String() string {
+	return fmt.Sprintf("migrated=%d skipped=%d missing=%d cleared=%d failed=%d",
+		atomic.LoadInt64(&r.Migrated), atomic.LoadInt64(&r.Skipped), atomic.LoadInt64(&r.Missing),
+		atomic.LoadInt64(&r.Cleared), atomic.LoadInt64(&r.Failed))
+}
+
+// migrateImages srcの全ての画像をdstに書き出す
+//
+//	dstに同じチェックサムの画像があればそのまま使うので、途中で止めても最初から実行し直せば続きから進みます
+//	書き出した画像は読み直してチェックサムを確かめます
+//	1件ずつのエラーはログに出して続け、最後にまとめてエラーを返します
+//
+//	画像は1件ずつメモリに読み込みます。posts.imgdataはdatabase/sqlでは少しずつ読めず(ドライバが行全体を読み込む)、
+//	画像はUploadLimit以下なので、同時にメモリに置くのはConcurrency件分までです
+//	書き出し先のチェックサムは、FileImageStoreならファイルを読みながら計算するのでメモリに置きません
+func migrateImages(ctx context.Context, src imageMigrationSource, dst repository.ImageStore, opts migrateImagesOptions) (*migrateImagesResult, error) {
+	if opts.Concurrency < 1 {
+		opts.Concurrency = 1
+	}
+
+	result := &migrateImagesResult{}
+	keys := make(chan repository.ImageKey)
+	var done int64
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < opts.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				err := migrateImage(src, dst, key, opts.ClearSource, result)
+				if err != nil {
+					atomic.AddInt64(&result.Failed, 1)
+					log.Printf("migrate-images: post %d: %s", key.PostID, err)
+				}
+
+				n := atomic.AddInt64(&done, 1)
+				if opts.LogEvery > 0 && n%int64(opts.LogEvery) == 0 {
+					log.Printf("migrate-images: %d posts done (%s)", n, result)
+				}
+			}
+		}()
+	}
+
+	listErr := func() error {
+		defer close(keys)
+
+		afterID := 0
+		for {
+			batch, err := src.ListKeys(afterID, migrateImagesBatch)
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				return nil
+			}
+
+			for _, key := range batch {
+				select {
+				case keys <- key:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+			afterID = batch[len(batch)-1].PostID
+		}
+	}()
+	wg.Wait()
+
+	if listErr != nil {
+		return result, listErr
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("migrate-images: %d posts failed", result.Failed)
+	}
+
+	return result, nil
+}
+
+func migrateImage(src imageMigrationSource, dst repository.ImageStore, key repository.ImageKey, clearSource bool, result *migrateImagesResult) error {
+	sum, err := src.Checksum(key)
+	if errors.Is(err, repository.ErrNotFound) {
+		// 既に消してある(前回の実行で移し終えた)か、初めから画像が無い
+		_, err = dst.Stat(key)
+		if errors.Is(err, repository.ErrNotFound) {
+			atomic.AddInt64(&result.Missing, 1)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		atomic.AddInt64(&result.Skipped, 1)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	existing, err := imageChecksum(dst, key)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		return err
+	}
+
+	if err == nil && existing == sum {
+		atomic.AddInt64(&result.Skipped, 1)
+	} else {
+		data, err := src.Get(key)
+		if err != nil {
+			return err
+		}
+		if repository.ImageChecksum(data) != sum {
+			return errors.New("image changed while reading")
+		}
+
+		err = dst.Put(key, data)
+		if err != nil {
+			return err
+		}
+
+		written, err := imageChecksum(dst, key)
+		if err != nil {
+			return err
+		}
+		if written != sum {
+			return errors.New("checksum mismatch after writing")
+		}
+
+		atomic.AddInt64(&result.Migrated, 1)
+	}
+
+	if clearSource {
+		err = src.Delete(key)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt64(&result.Cleared, 1)
+	}
+
+	return nil
+}
+
+// runMigrateImages `app migrate-images` サブコマンド
+//
+//	posts.imgdataの画像をISUCONP_IMAGE_DIRに<投稿ID>.<拡張子>として書き出します
+//	-clear-imgdataを付けると、書き出して確かめた投稿のimgdataを空にします
+//	(imgdataはNOT NULLなので、NULLではなく空のデータにします。アプリは空のimgdataを画像が無いものとして扱います)
+func runMigrateImages(args []string) error {
+	flags := flag.NewFlagSet("migrate-images", flag.ContinueOnError)
+	concurrency := flags.Int("concurrency", 8, "number of images migrated in parallel")
+	clearImgdata := flags.Bool("clear-imgdata", false, "empty posts.imgdata after the file is written and verified")
+	dir := flags.String("dir", imageDirFromEnv(), "directory to write images to")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(*dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	log.Printf("migrate-images: writing to %s (concurrency=%d clear-imgdata=%t)", *dir, *concurrency, *clearImgdata)
+	result, err := migrateImages(ctx, repository.NewMySQLImageStore(db), repository.NewFileImageStore(*dir), migrateImagesOptions{
+		Concurrency: *concurrency,
+		ClearSource: *clearImgdata,
+		LogEvery:    1000,
+	})
+	log.Printf("migrate-images: finished (%s)", result)
+
+	return err
+}
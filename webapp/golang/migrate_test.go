@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/catatsuy/private-isu/webapp/golang/repository"
+)
+
+func TestMigrateImages(t *testing.T) {
+	mem := repository.NewMemory()
+	dir := t.TempDir()
+	dst := repository.NewFileImageStore(dir)
+
+	jpeg := []byte("\xff\xd8\xff\xe0jpeg")
+	png := []byte("\x89PNG\r\n\x1a\npng")
+	gif := []byte("GIF89agif")
+
+	mem.AddPost(Post{ID: 1, Mime: "image/jpeg", Imgdata: jpeg})
+	// 前回の実行で書き出し済み
+	mem.AddPost(Post{ID: 2, Mime: "image/png", Imgdata: png})
+	// 書きかけで止まった
+	mem.AddPost(Post{ID: 3, Mime: "image/gif", Imgdata: gif})
+	// 画像が無い
+	mem.AddPost(Post{ID: 4, Mime: "image/jpeg"})
+	// ファイルにだけある(ImageStoreに切り替えた後の投稿)
+	mem.AddPost(Post{ID: 5, Mime: "image/png"})
+
+	for name, data := range map[string][]byte{"2.png": png, "3.gif": gif[:3], "5.png": png} {
+		err := os.WriteFile(filepath.Join(dir, name), data, 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := migrateImages(context.Background(), mem.Images, dst, migrateImagesOptions{Concurrency: 2, ClearSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := migrateImagesResult{Migrated: 2, Skipped: 2, Missing: 1, Cleared: 3}
+	if *result != want {
+		t.Errorf("result = %s, want %s", result, &want)
+	}
+
+	for name, data := range map[string][]byte{"1.jpg": jpeg, "2.png": png, "3.gif": gif} {
+		got, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s differs from imgdata", name)
+		}
+	}
+	for _, key := range []repository.ImageKey{{PostID: 1, Mime: "image/jpeg"}, {PostID: 2, Mime: "image/png"}, {PostID: 3, Mime: "image/gif"}} {
+		_, err = mem.Images.Get(key)
+		if !errors.Is(err, repository.ErrNotFound) {
+			t.Errorf("imgdata of post %d is not cleared: %v", key.PostID, err)
+		}
+	}
+
+	// もう一度実行しても何も書き出さない
+	result, err = migrateImages(context.Background(), mem.Images, dst, migrateImagesOptions{Concurrency: 2, ClearSource: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = migrateImagesResult{Skipped: 4, Missing: 1}
+	if *result != want {
+		t.Errorf("second run: result = %s, want %s", result, &want)
+	}
+}
+
+func TestMigrateImagesBatches(t *testing.T) {
+	mem := repository.NewMemory()
+	n := migrateImagesBatch*2 + 1
+	for i := 0; i < n; i++ {
+		mem.AddPost(Post{Mime: "image/gif", Imgdata: []byte("GIF89a")})
+	}
+
+	result, err := migrateImages(context.Background(), mem.Images, repository.NewFileImageStore(t.TempDir()), migrateImagesOptions{Concurrency: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Migrated != int64(n) || result.Cleared != 0 {
+		t.Errorf("result = %s, want migrated=%d", result, n)
+	}
+
+	// 書き出せなかった投稿は消さずにエラーを返す
+	result, err = migrateImages(context.Background(), mem.Images, repository.NewFileImageStore(filepath.Join(t.TempDir(), "missing")), migrateImagesOptions{Concurrency: 4, ClearSource: true})
+	if err == nil {
+		t.Fatal("want error when the directory does not exist")
+	}
+	if result.Failed != int64(n) || result.Cleared != 0 {
+		t.Errorf("result = %s, want failed=%d", result, n)
+	}
+}
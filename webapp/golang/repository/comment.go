@@ -0,0 +1,258 @@
+package repository
+
+import (
+	"context"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/helpisu"
+	"github.com/jmoiron/sqlx"
+)
+
+// MySQLCommentRepo MySQLとhelpisu.CacheによるCommentRepo
+type MySQLCommentRepo struct {
+	db *sqlx.DB
+	// countCache 投稿IDごとのコメント数
+	countCache *helpisu.Cache[int, int]
+	// latestCache 投稿IDごとの新しいコメント(LatestComments件まで)
+	latestCache *helpisu.Cache[int, []Comment]
+}
+
+// NewMySQLCommentRepo 新たなMySQLCommentRepoを作成
+//
+//	キャッシュを登録するので、プロセスで1度だけ呼ぶこと
+func NewMySQLCommentRepo(db *sqlx.DB, cfg CacheConfig) *MySQLCommentRepo {
+	r := &MySQLCommentRepo{
+		db: db,
+		countCache: helpisu.NewCache[int, int](
+			"comment_count",
+			helpisu.WithInvalidation(cfg.Bus),
+			helpisu.WithBackend(helpisu.BackendSharded),
+			helpisu.WithSnapshot(helpisu.SnapshotGob, cacheSchemaVersion),
+		),
+		latestCache: helpisu.NewCache[int, []Comment](
+			"comment",
+			helpisu.WithInvalidation(cfg.Bus),
+			helpisu.WithTagger(func(_ int, comments []Comment) []string {
+				tags := make([]string, 0, len(comments))
+				for _, c := range comments {
+					tags = append(tags, userTag(c.UserID))
+				}
+				return tags
+			}),
+			helpisu.WithTTL(cacheTTL),
+			helpisu.WithJanitor(time.Minute),
+			helpisu.WithMaxBytes(64*1024*1024), // 64mb
+			helpisu.WithSnapshot(helpisu.SnapshotGob, cacheSchemaVersion),
+		),
+	}
+	r.countCache.RegisterWarmUp(r.warmUpCount)
+
+	return r
+}
+
+func (r *MySQLCommentRepo) warmUpCount(ctx context.Context, c *helpisu.Cache[int, int]) error {
+	// 読み込み中に増えたコメント数を古い値で上書きしないよう、読み込む前に始める
+	f := c.BeginFill()
+
+	counts := []struct {
+		PostID int `db:"post_id"`
+		Count  int `db:"count"`
+	}{}
+	err := r.db.SelectContext(ctx, &counts, "SELECT posts.id AS `post_id`, COUNT(comments.id) AS `count` FROM `posts` LEFT JOIN `comments` ON comments.post_id = posts.id GROUP BY posts.id")
+	if err != nil {
+		return err
+	}
+
+	m := make(map[int]int, len(counts))
+	for _, cc := range counts {
+		m[cc.PostID] = cc.Count
+	}
+	_, err = f.FillMany(ctx, m)
+
+	return err
+}
+
+func (r *MySQLCommentRepo) loadCount(postID int) (int, error) {
+	count := 0
+	err := r.db.Get(&count, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `post_id` = ?", postID)
+
+	return count, err
+}
+
+func (r *MySQLCommentRepo) loadLatest(postID int) ([]Comment, error) {
+	comments := []Comment{}
+	err := r.db.Select(&comments, "SELECT * FROM `comments` WHERE `post_id` = ? ORDER BY `created_at` DESC, `id` DESC LIMIT ?", postID, LatestComments)
+
+	return comments, err
+}
+
+func (r *MySQLCommentRepo) loadCounts(postIDs []int) (map[int]int, error) {
+	query, args, err := sqlx.In("SELECT `post_id`, COUNT(*) AS `count` FROM `comments` WHERE `post_id` IN (?) GROUP BY `post_id`", postIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	counts := []struct {
+		PostID int `db:"post_id"`
+		Count  int `db:"count"`
+	}{}
+	err = r.db.Select(&counts, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// コメントの無い投稿も0件としてキャッシュする
+	m := make(map[int]int, len(postIDs))
+	for _, id := range postIDs {
+		m[id] = 0
+	}
+	for _, cc := range counts {
+		m[cc.PostID] = cc.Count
+	}
+
+	return m, nil
+}
+
+func (r *MySQLCommentRepo) loadLatestMany(postIDs []int) (map[int][]Comment, error) {
+	query, args, err := sqlx.In(
+		"SELECT `id`, `post_id`, `user_id`, `comment`, `created_at` FROM ("+
+			"SELECT *, ROW_NUMBER() OVER (PARTITION BY `post_id` ORDER BY `created_at` DESC, `id` DESC) AS `rn`"+
+			" FROM `comments` WHERE `post_id` IN (?)"+
+			") AS `c` WHERE `rn` <= ? ORDER BY `post_id`, `rn`",
+		postIDs, LatestComments)
+	if err != nil {
+		return nil, err
+	}
+
+	comments := []Comment{}
+	err = r.db.Select(&comments, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[int][]Comment, len(postIDs))
+	for _, id := range postIDs {
+		m[id] = []Comment{}
+	}
+	for _, c := range comments {
+		m[c.PostID] = append(m[c.PostID], c)
+	}
+
+	return m, nil
+}
+
+func (r *MySQLCommentRepo) CountByPost(postID int) (int, error) {
+	return r.countCache.GetOrLoad(postID, r.loadCount)
+}
+
+func (r *MySQLCommentRepo) LatestByPost(postID int) ([]Comment, error) {
+	comments, err := r.latestCache.GetOrLoad(postID, r.loadLatest)
+	if err != nil {
+		return nil, err
+	}
+
+	// キャッシュの中身を書き換えられないようコピーを返す
+	return append([]Comment(nil), comments...), nil
+}
+
+func (r *MySQLCommentRepo) CountByPosts(postIDs []int) (map[int]int, error) {
+	if len(postIDs) == 0 {
+		return map[int]int{}, nil
+	}
+
+	return r.countCache.GetManyOrLoad(postIDs, r.loadCounts)
+}
+
+func (r *MySQLCommentRepo) LatestByPosts(postIDs []int) (map[int][]Comment, error) {
+	if len(postIDs) == 0 {
+		return map[int][]Comment{}, nil
+	}
+
+	m, err := r.latestCache.GetManyOrLoad(postIDs, r.loadLatestMany)
+	if err != nil {
+		return nil, err
+	}
+
+	// キャッシュの中身を書き換えられないようコピーを返す
+	for id, comments := range m {
+		m[id] = append([]Comment(nil), comments...)
+	}
+
+	return m, nil
+}
+
+func (r *MySQLCommentRepo) ListByPost(postID int) ([]Comment, error) {
+	comments := []Comment{}
+	err := r.db.Select(&comments, "SELECT * FROM `comments` WHERE `post_id` = ? ORDER BY `created_at` DESC, `id` DESC", postID)
+	if err != nil {
+		return nil, err
+	}
+
+	return comments, nil
+}
+
+func (r *MySQLCommentRepo) CountByUser(userID int) (int, error) {
+	count := 0
+	err := r.db.Get(&count, "SELECT COUNT(*) AS `count` FROM `comments` WHERE `user_id` = ?", userID)
+
+	return count, err
+}
+
+func (r *MySQLCommentRepo) CountOnUserPosts(userID int) (int, error) {
+	count := 0
+	err := r.db.Get(&count, "SELECT COUNT(*) AS `count` FROM `comments` JOIN `posts` ON comments.post_id = posts.id WHERE posts.user_id = ?", userID)
+
+	return count, err
+}
+
+func (r *MySQLCommentRepo) Create(postID, userID int, comment string) (Comment, error) {
+	result, err := r.db.Exec("INSERT INTO `comments` (`post_id`, `user_id`, `comment`) VALUES (?,?,?)", postID, userID, comment)
+	if err != nil {
+		return Comment{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Comment{}, err
+	}
+
+	// created_atはMySQLが決めるので、保存した行を読み直す
+	c := Comment{}
+	err = r.db.Get(&c, "SELECT * FROM `comments` WHERE `id` = ?", id)
+	if err != nil {
+		// 次に読むときにDBから取り直す
+		r.countCache.Delete(postID)
+		r.latestCache.Delete(postID)
+		return Comment{}, err
+	}
+
+	r.created(c)
+
+	return c, nil
+}
+
+// created 保存したコメントをキャッシュに反映する
+//
+//	INSERTの後に別のリクエストがDBから読み込んだ値は既にcを含んでいるので、
+//	件数は足さずに消して次に読むときに数え直し、新しいコメントの一覧には含まれていない場合だけ追加します
+func (r *MySQLCommentRepo) created(c Comment) {
+	r.countCache.Delete(c.PostID)
+
+	r.latestCache.Update(c.PostID, func(comments []Comment, ok bool) ([]Comment, bool) {
+		if !ok {
+			return nil, false
+		}
+		for _, cc := range comments {
+			if cc.ID == c.ID {
+				return comments, true
+			}
+		}
+
+		// 先頭に追加してLatestComments件に切り詰める
+		newComments := append([]Comment{c}, comments...)
+		if len(newComments) > LatestComments {
+			newComments = newComments[:LatestComments]
+		}
+		return newComments, true
+	})
+}
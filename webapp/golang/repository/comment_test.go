@@ -0,0 +1,84 @@
+package repository
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMySQLCommentRepoCreated(t *testing.T) {
+	old := []Comment{{ID: 2, PostID: 10, CreatedAt: at(2)}, {ID: 1, PostID: 10, CreatedAt: at(1)}}
+	c := Comment{ID: 3, PostID: 10, CreatedAt: at(3)}
+
+	tests := []struct {
+		name string
+		// fill Createの前後にCountByPost、LatestByPostなどが読み込んだキャッシュ
+		fill       func(t *testing.T, r *MySQLCommentRepo)
+		wantLatest []Comment
+	}{
+		{
+			name: "INSERTの前に読み込んだ",
+			fill: func(t *testing.T, r *MySQLCommentRepo) {
+				r.countCache.Set(10, len(old))
+				r.latestCache.Set(10, old)
+			},
+			wantLatest: []Comment{c, old[0], old[1]},
+		},
+		{
+			name: "INSERTの後に読み込んだ",
+			fill: func(t *testing.T, r *MySQLCommentRepo) {
+				_, err := r.countCache.GetOrLoad(10, func(int) (int, error) { return len(old) + 1, nil })
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = r.latestCache.GetOrLoad(10, func(int) ([]Comment, error) {
+					return []Comment{c, old[0], old[1]}, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantLatest: []Comment{c, old[0], old[1]},
+		},
+		{
+			name: "INSERTの後にまとめて読み込んだ",
+			fill: func(t *testing.T, r *MySQLCommentRepo) {
+				_, err := r.countCache.GetManyOrLoad([]int{10}, func([]int) (map[int]int, error) {
+					return map[int]int{10: len(old) + 1}, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = r.latestCache.GetManyOrLoad([]int{10}, func([]int) (map[int][]Comment, error) {
+					return map[int][]Comment{10: {c, old[0], old[1]}}, nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantLatest: []Comment{c, old[0], old[1]},
+		},
+		{
+			name:       "キャッシュに無い",
+			fill:       func(*testing.T, *MySQLCommentRepo) {},
+			wantLatest: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// DBには触らないので、キャッシュだけを使う
+			r := NewMySQLCommentRepo(nil, CacheConfig{})
+			tt.fill(t, r)
+
+			r.created(c)
+
+			if n, ok := r.countCache.Get(10); ok {
+				t.Errorf("count = %d, want deleted", n)
+			}
+			got, _ := r.latestCache.Get(10)
+			if !reflect.DeepEqual(got, tt.wantLatest) {
+				t.Errorf("latest = %v, want %v", got, tt.wantLatest)
+			}
+		})
+	}
+}
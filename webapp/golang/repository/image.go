@@ -0,0 +1,312 @@
+package repository
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// imageExts 投稿できる画像のmimeと拡張子
+var imageExts = map[string]string{
+	"image/jpeg": "jpg",
+	"image/png":  "png",
+	"image/gif":  "gif",
+}
+
+// ImageExt mimeに対応する拡張子(投稿できない形式なら空文字列)
+func ImageExt(mime string) string {
+	return imageExts[mime]
+}
+
+// ImageKey 画像を識別するキー
+type ImageKey struct {
+	PostID int    `db:"id"`
+	Mime   string `db:"mime"`
+}
+
+// Filename 画像のファイル名(例: 123.jpg)
+func (k ImageKey) Filename() string {
+	return strconv.Itoa(k.PostID) + "." + ImageExt(k.Mime)
+}
+
+// ImageInfo 画像のサイズと更新日時
+type ImageInfo struct {
+	Size    int64
+	ModTime time.Time
+}
+
+// ImageStore 投稿の画像の読み書き
+//
+//	画像が無い場合、GetとStatはErrNotFoundを返します
+//	Deleteは画像が無くてもエラーにしません
+type ImageStore interface {
+	Put(key ImageKey, data []byte) error
+	Get(key ImageKey) ([]byte, error)
+	Delete(key ImageKey) error
+	Stat(key ImageKey) (ImageInfo, error)
+}
+
+// FileImageStore ディレクトリに<投稿ID>.<拡張子>のファイルとして画像を置くImageStore
+type FileImageStore struct {
+	root string
+}
+
+// NewFileImageStore rootに画像を置くFileImageStoreを作成
+func NewFileImageStore(root string) *FileImageStore {
+	return &FileImageStore{root: root}
+}
+
+// Path 画像のファイルのパス
+func (s *FileImageStore) Path(key ImageKey) string {
+	return filepath.Join(s.root, key.Filename())
+}
+
+// Put 画像を書き込む
+//
+//	読み込み中のリクエストに書きかけのファイルを見せないよう、WriteFileAtomicで書き込みます
+func (s *FileImageStore) Put(key ImageKey, data []byte) error {
+	return WriteFileAtomic(s.Path(key), data)
+}
+
+func (s *FileImageStore) Get(key ImageKey) ([]byte, error) {
+	data, err := os.ReadFile(s.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return data, err
+}
+
+func (s *FileImageStore) Delete(key ImageKey) error {
+	err := os.Remove(s.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+func (s *FileImageStore) Stat(key ImageKey) (ImageInfo, error) {
+	fi, err := os.Stat(s.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return ImageInfo{}, ErrNotFound
+	}
+	if err != nil {
+		return ImageInfo{}, err
+	}
+
+	return ImageInfo{Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Checksum 画像のImageChecksumを返す
+//
+//	ファイルを読みながら計算するので、画像全体をメモリに置きません
+func (s *FileImageStore) Checksum(key ImageKey) (string, error) {
+	f, err := os.Open(s.Path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// WriteFileAtomic 同じディレクトリの一時ファイルに書いてからrenameする
+//
+//	途中で失敗しても、pathには書きかけのファイルが残りません
+func WriteFileAtomic(path string, data []byte) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-"+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(f.Name()) }()
+
+	_, err = f.Write(data)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Chmod(0o644)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// MySQLImageStore posts.imgdataに画像を置くImageStore
+//
+//	投稿の行はPostRepo.Createが画像と一緒に作るので、Putは既にある投稿のimgdataを書き換えるだけです(投稿が無ければ何もしません)
+//	imgdataが空の投稿は画像が無いものとして扱います
+type MySQLImageStore struct {
+	db *sqlx.DB
+}
+
+// NewMySQLImageStore 新たなMySQLImageStoreを作成
+func NewMySQLImageStore(db *sqlx.DB) *MySQLImageStore {
+	return &MySQLImageStore{db: db}
+}
+
+func (s *MySQLImageStore) Put(key ImageKey, data []byte) error {
+	_, err := s.db.Exec("UPDATE `posts` SET `imgdata` = ? WHERE `id` = ? AND `mime` = ?", data, key.PostID, key.Mime)
+
+	return err
+}
+
+func (s *MySQLImageStore) Get(key ImageKey) ([]byte, error) {
+	data := []byte{}
+	err := s.db.Get(&data, "SELECT `imgdata` FROM `posts` WHERE `id` = ? AND `mime` = ?", key.PostID, key.Mime)
+	if err != nil {
+		return nil, notFound(err)
+	}
+	if len(data) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return data, nil
+}
+
+func (s *MySQLImageStore) Delete(key ImageKey) error {
+	_, err := s.db.Exec("UPDATE `posts` SET `imgdata` = '' WHERE `id` = ? AND `mime` = ?", key.PostID, key.Mime)
+
+	return err
+}
+
+func (s *MySQLImageStore) Stat(key ImageKey) (ImageInfo, error) {
+	info := struct {
+		Size      int64     `db:"size"`
+		CreatedAt time.Time `db:"created_at"`
+	}{}
+	err := s.db.Get(&info, "SELECT LENGTH(`imgdata`) AS `size`, `created_at` FROM `posts` WHERE `id` = ? AND `mime` = ?", key.PostID, key.Mime)
+	if err != nil {
+		return ImageInfo{}, notFound(err)
+	}
+	if info.Size == 0 {
+		return ImageInfo{}, ErrNotFound
+	}
+
+	return ImageInfo{Size: info.Size, ModTime: info.CreatedAt}, nil
+}
+
+// ImageChecksum 画像のSHA-256(16進数)
+func ImageChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// ListKeys IDがafterIDより大きい投稿の画像のキーをIDの昇順にlimit件取得する(画像が空の投稿も含む)
+func (s *MySQLImageStore) ListKeys(afterID, limit int) ([]ImageKey, error) {
+	keys := []ImageKey{}
+	err := s.db.Select(&keys, "SELECT `id`, `mime` FROM `posts` WHERE `id` > ? ORDER BY `id` LIMIT ?", afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// Checksum 画像のImageChecksumを返す
+//
+//	MySQLで計算するので、画像を転送せずに確かめられます
+func (s *MySQLImageStore) Checksum(key ImageKey) (string, error) {
+	sum := sql.NullString{}
+	err := s.db.Get(&sum, "SELECT IF(LENGTH(`imgdata`) > 0, SHA2(`imgdata`, 256), NULL) FROM `posts` WHERE `id` = ? AND `mime` = ?", key.PostID, key.Mime)
+	if err != nil {
+		return "", notFound(err)
+	}
+	if !sum.Valid {
+		return "", ErrNotFound
+	}
+
+	return sum.String, nil
+}
+
+// storesInPostRow imagesが投稿の行に画像を置くかどうか
+//
+//	投稿の行に置く場合、PostRepo.Createは行を作るときに画像も一緒に書きます
+func storesInPostRow(images ImageStore) bool {
+	switch s := images.(type) {
+	case *MySQLImageStore, *MemoryImageStore:
+		return true
+	case *MigratingImageStore:
+		return storesInPostRow(s.to)
+	}
+
+	return false
+}
+
+// MigratingImageStore fromからtoへ画像を移している途中に使うImageStore
+//
+//	読み込みはtoを先に見て、無ければfromから読んでtoに書き写します
+//	書き込みはtoだけに、削除は両方に行います
+type MigratingImageStore struct {
+	from ImageStore
+	to   ImageStore
+}
+
+// NewMigratingImageStore fromからtoへ移すMigratingImageStoreを作成
+func NewMigratingImageStore(from, to ImageStore) *MigratingImageStore {
+	return &MigratingImageStore{from: from, to: to}
+}
+
+func (s *MigratingImageStore) Put(key ImageKey, data []byte) error {
+	return s.to.Put(key, data)
+}
+
+func (s *MigratingImageStore) Get(key ImageKey) ([]byte, error) {
+	data, err := s.to.Get(key)
+	if !errors.Is(err, ErrNotFound) {
+		return data, err
+	}
+
+	data, err = s.from.Get(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 書き写せなくても次のリクエストでやり直せばよいので、読み込みは成功させる
+	_ = s.to.Put(key, data)
+
+	return data, nil
+}
+
+func (s *MigratingImageStore) Delete(key ImageKey) error {
+	err := s.to.Delete(key)
+	if err != nil {
+		return err
+	}
+
+	return s.from.Delete(key)
+}
+
+func (s *MigratingImageStore) Stat(key ImageKey) (ImageInfo, error) {
+	info, err := s.to.Stat(key)
+	if !errors.Is(err, ErrNotFound) {
+		return info, err
+	}
+
+	return s.from.Stat(key)
+}
@@ -0,0 +1,48 @@
+package repository
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestFileImageStoreChecksum(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr error
+	}{
+		{
+			name: "画像",
+			data: []byte("\x89PNG\r\n\x1a\npng"),
+		},
+		{
+			name: "空のファイル",
+			data: []byte{},
+		},
+		{
+			name:    "ファイルが無い",
+			wantErr: ErrNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewFileImageStore(t.TempDir())
+			key := ImageKey{PostID: 1, Mime: "image/png"}
+			if tt.data != nil {
+				err := s.Put(key, tt.data)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := s.Checksum(key)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Checksum() err = %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && got != ImageChecksum(tt.data) {
+				t.Errorf("Checksum() = %s, want %s", got, ImageChecksum(tt.data))
+			}
+		})
+	}
+}
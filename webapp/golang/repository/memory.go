@@ -0,0 +1,619 @@
+package repository
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Memory メモリ上にデータを持つUserRepo, PostRepo, CommentRepo, TokenRepo, ImageStoreの実装
+
+	MySQLやmemcachedを用意せずにハンドラを動かすためのものです(主にテスト用)
+	各リポジトリは同じデータを共有し、BANされたユーザーの扱いや並び順はMySQLの実装に合わせています
+*/
+type Memory struct {
+	Users    *MemoryUserRepo
+	Posts    *MemoryPostRepo
+	Comments *MemoryCommentRepo
+	Tokens   *MemoryTokenRepo
+	Images   *MemoryImageStore
+
+	data *memoryData
+}
+
+type memoryData struct {
+	mu       sync.RWMutex
+	users    []User
+	posts    []Post
+	comments []Comment
+	tokens   []Token
+
+	// MySQLのAUTO_INCREMENTと同じく、最後に使ったIDより大きいIDを振る
+	lastUserID    int
+	lastPostID    int
+	lastCommentID int
+	lastTokenID   int
+}
+
+func nextID(last *int, id int) int {
+	if id == 0 {
+		id = *last + 1
+	}
+	if id > *last {
+		*last = id
+	}
+
+	return id
+}
+
+// NewMemory 空のMemoryを作成
+func NewMemory() *Memory {
+	d := &memoryData{}
+
+	return &Memory{
+		Users:    &MemoryUserRepo{d: d},
+		Posts:    &MemoryPostRepo{d: d},
+		Comments: &MemoryCommentRepo{d: d},
+		Tokens:   &MemoryTokenRepo{d: d},
+		Images:   &MemoryImageStore{d: d},
+		data:     d,
+	}
+}
+
+// now DATETIME型に合わせて秒単位に切り捨てた現在時刻
+func now() time.Time {
+	return time.Now().Truncate(time.Second)
+}
+
+// AddUser ユーザーをそのまま追加する(IDとCreatedAtが空なら埋める)
+func (m *Memory) AddUser(u User) User {
+	d := m.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	u.ID = nextID(&d.lastUserID, u.ID)
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = now()
+	}
+	d.users = append(d.users, u)
+
+	return u
+}
+
+// AddPost 投稿をそのまま追加する(IDとCreatedAtが空なら埋める)
+func (m *Memory) AddPost(p Post) Post {
+	d := m.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	p.ID = nextID(&d.lastPostID, p.ID)
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = now()
+	}
+	d.posts = append(d.posts, p)
+
+	return p
+}
+
+// AddComment コメントをそのまま追加する(IDとCreatedAtが空なら埋める)
+func (m *Memory) AddComment(c Comment) Comment {
+	d := m.data
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c.ID = nextID(&d.lastCommentID, c.ID)
+	if c.CreatedAt.IsZero() {
+		c.CreatedAt = now()
+	}
+	d.comments = append(d.comments, c)
+
+	return c
+}
+
+// userLocked ロックを取った状態でユーザーを探す
+func (d *memoryData) userLocked(id int) (User, bool) {
+	for _, u := range d.users {
+		if u.ID == id {
+			return u, true
+		}
+	}
+
+	return User{}, false
+}
+
+// filterPosts 条件に合う投稿を新しい順に返す(Imgdataは含めない)
+func (d *memoryData) filterPosts(f func(p Post) bool) []Post {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	posts := []Post{}
+	for _, p := range d.posts {
+		if f(p) {
+			p.Imgdata = nil
+			posts = append(posts, p)
+		}
+	}
+	sort.SliceStable(posts, func(i, j int) bool {
+		if !posts[i].CreatedAt.Equal(posts[j].CreatedAt) {
+			return posts[i].CreatedAt.After(posts[j].CreatedAt)
+		}
+		return posts[i].ID > posts[j].ID
+	})
+
+	return posts
+}
+
+// activePostLocked 投稿したユーザーがBANされていないか
+func (d *memoryData) activePostLocked(p Post) bool {
+	u, ok := d.userLocked(p.UserID)
+	return ok && u.DelFlg == 0
+}
+
+// filterComments 条件に合うコメントを新しい順に返す
+func (d *memoryData) filterComments(f func(c Comment) bool) []Comment {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	comments := []Comment{}
+	for _, c := range d.comments {
+		if f(c) {
+			comments = append(comments, c)
+		}
+	}
+	sort.SliceStable(comments, func(i, j int) bool {
+		if !comments[i].CreatedAt.Equal(comments[j].CreatedAt) {
+			return comments[i].CreatedAt.After(comments[j].CreatedAt)
+		}
+		return comments[i].ID > comments[j].ID
+	})
+
+	return comments
+}
+
+// MemoryUserRepo メモリ上のUserRepo
+type MemoryUserRepo struct {
+	d *memoryData
+}
+
+func (r *MemoryUserRepo) FindByID(id int) (User, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	u, ok := r.d.userLocked(id)
+	if !ok {
+		return User{}, ErrNotFound
+	}
+
+	return u, nil
+}
+
+func (r *MemoryUserRepo) FindByIDs(ids []int) (map[int]User, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	m := make(map[int]User, len(ids))
+	for _, id := range ids {
+		if u, ok := r.d.userLocked(id); ok {
+			m[id] = u
+		}
+	}
+
+	return m, nil
+}
+
+func (r *MemoryUserRepo) FindActiveByAccountName(accountName string) (User, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	for _, u := range r.d.users {
+		if u.AccountName == accountName && u.DelFlg == 0 {
+			return u, nil
+		}
+	}
+
+	return User{}, ErrNotFound
+}
+
+func (r *MemoryUserRepo) ExistsAccountName(accountName string) (bool, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	for _, u := range r.d.users {
+		if u.AccountName == accountName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (r *MemoryUserRepo) Create(accountName, passhash string) (int, error) {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+
+	u := User{
+		ID:          nextID(&r.d.lastUserID, 0),
+		AccountName: accountName,
+		Passhash:    passhash,
+		CreatedAt:   now(),
+	}
+	r.d.users = append(r.d.users, u)
+
+	return u.ID, nil
+}
+
+func (r *MemoryUserRepo) ListBannable() ([]User, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	users := []User{}
+	for _, u := range r.d.users {
+		if u.Authority == 0 && u.DelFlg == 0 {
+			users = append(users, u)
+		}
+	}
+	sort.SliceStable(users, func(i, j int) bool {
+		if !users[i].CreatedAt.Equal(users[j].CreatedAt) {
+			return users[i].CreatedAt.After(users[j].CreatedAt)
+		}
+		return users[i].ID > users[j].ID
+	})
+
+	return users, nil
+}
+
+func (r *MemoryUserRepo) Ban(id int) error {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+
+	for i := range r.d.users {
+		if r.d.users[i].ID == id {
+			r.d.users[i].DelFlg = 1
+		}
+	}
+
+	return nil
+}
+
+// MemoryPostRepo メモリ上のPostRepo
+type MemoryPostRepo struct {
+	d *memoryData
+}
+
+func (r *MemoryPostRepo) Recent(limit int) ([]Post, error) {
+	posts := r.d.filterPosts(r.d.activePostLocked)
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+
+	return posts, nil
+}
+
+func (r *MemoryPostRepo) RecentBefore(maxCreatedAt time.Time, limit int) ([]Post, error) {
+	posts := r.d.filterPosts(func(p Post) bool {
+		return !p.CreatedAt.After(maxCreatedAt) && r.d.activePostLocked(p)
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+
+	return posts, nil
+}
+
+func (r *MemoryPostRepo) RecentAfter(cursor PostCursor, limit int) ([]Post, error) {
+	posts := r.d.filterPosts(func(p Post) bool {
+		after := p.CreatedAt.Before(cursor.CreatedAt) ||
+			p.CreatedAt.Equal(cursor.CreatedAt) && p.ID < cursor.ID
+		return after && r.d.activePostLocked(p)
+	})
+	if len(posts) > limit {
+		posts = posts[:limit]
+	}
+
+	return posts, nil
+}
+
+func (r *MemoryPostRepo) ListByUser(userID int) ([]Post, error) {
+	return r.d.filterPosts(func(p Post) bool {
+		return p.UserID == userID
+	}), nil
+}
+
+func (r *MemoryPostRepo) CountByUser(userID int) (int, error) {
+	posts, err := r.ListByUser(userID)
+	return len(posts), err
+}
+
+func (r *MemoryPostRepo) FindByID(id int) (Post, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	for _, p := range r.d.posts {
+		if p.ID == id {
+			p.Imgdata = nil
+			return p, nil
+		}
+	}
+
+	return Post{}, ErrNotFound
+}
+
+func (r *MemoryPostRepo) Create(p Post, images ImageStore) (int, error) {
+	r.d.mu.Lock()
+	p.ID = nextID(&r.d.lastPostID, 0)
+	r.d.mu.Unlock()
+
+	// MySQLの実装と同じく、MemoryImageStore以外には投稿を追加する前に画像を置く
+	// AUTO_INCREMENTと同じく、失敗してもIDは再利用しない
+	if storesInPostRow(images) {
+		p.Imgdata = append([]byte(nil), p.Imgdata...)
+	} else {
+		err := images.Put(ImageKey{PostID: p.ID, Mime: p.Mime}, p.Imgdata)
+		if err != nil {
+			return 0, err
+		}
+		p.Imgdata = nil
+	}
+
+	r.d.mu.Lock()
+	p.CreatedAt = now()
+	r.d.posts = append(r.d.posts, p)
+	r.d.mu.Unlock()
+
+	return p.ID, nil
+}
+
+// MemoryCommentRepo メモリ上のCommentRepo
+type MemoryCommentRepo struct {
+	d *memoryData
+}
+
+func (r *MemoryCommentRepo) CountByPost(postID int) (int, error) {
+	comments, err := r.ListByPost(postID)
+	return len(comments), err
+}
+
+func (r *MemoryCommentRepo) LatestByPost(postID int) ([]Comment, error) {
+	comments, err := r.ListByPost(postID)
+	if len(comments) > LatestComments {
+		comments = comments[:LatestComments]
+	}
+
+	return comments, err
+}
+
+func (r *MemoryCommentRepo) CountByPosts(postIDs []int) (map[int]int, error) {
+	m := make(map[int]int, len(postIDs))
+	for _, id := range postIDs {
+		m[id], _ = r.CountByPost(id)
+	}
+
+	return m, nil
+}
+
+func (r *MemoryCommentRepo) LatestByPosts(postIDs []int) (map[int][]Comment, error) {
+	m := make(map[int][]Comment, len(postIDs))
+	for _, id := range postIDs {
+		m[id], _ = r.LatestByPost(id)
+	}
+
+	return m, nil
+}
+
+func (r *MemoryCommentRepo) ListByPost(postID int) ([]Comment, error) {
+	return r.d.filterComments(func(c Comment) bool {
+		return c.PostID == postID
+	}), nil
+}
+
+func (r *MemoryCommentRepo) CountByUser(userID int) (int, error) {
+	comments := r.d.filterComments(func(c Comment) bool {
+		return c.UserID == userID
+	})
+
+	return len(comments), nil
+}
+
+func (r *MemoryCommentRepo) CountOnUserPosts(userID int) (int, error) {
+	comments := r.d.filterComments(func(c Comment) bool {
+		for _, p := range r.d.posts {
+			if p.ID == c.PostID {
+				return p.UserID == userID
+			}
+		}
+		return false
+	})
+
+	return len(comments), nil
+}
+
+func (r *MemoryCommentRepo) Create(postID, userID int, comment string) (Comment, error) {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+
+	c := Comment{
+		ID:        nextID(&r.d.lastCommentID, 0),
+		PostID:    postID,
+		UserID:    userID,
+		Comment:   comment,
+		CreatedAt: now(),
+	}
+	r.d.comments = append(r.d.comments, c)
+
+	return c, nil
+}
+
+// MemoryTokenRepo メモリ上のTokenRepo
+type MemoryTokenRepo struct {
+	d *memoryData
+}
+
+func (r *MemoryTokenRepo) Create(userID int, name, tokenHash string) (Token, error) {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+
+	t := Token{
+		ID:        nextID(&r.d.lastTokenID, 0),
+		UserID:    userID,
+		Name:      name,
+		TokenHash: tokenHash,
+		CreatedAt: now(),
+	}
+	r.d.tokens = append(r.d.tokens, t)
+
+	return t, nil
+}
+
+func (r *MemoryTokenRepo) FindByHash(tokenHash string) (Token, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	for _, t := range r.d.tokens {
+		if t.TokenHash == tokenHash {
+			return t, nil
+		}
+	}
+
+	return Token{}, ErrNotFound
+}
+
+func (r *MemoryTokenRepo) ListByUser(userID int) ([]Token, error) {
+	r.d.mu.RLock()
+	defer r.d.mu.RUnlock()
+
+	tokens := []Token{}
+	for _, t := range r.d.tokens {
+		if t.UserID == userID {
+			tokens = append(tokens, t)
+		}
+	}
+	sort.SliceStable(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+		}
+		return tokens[i].ID > tokens[j].ID
+	})
+
+	return tokens, nil
+}
+
+func (r *MemoryTokenRepo) Revoke(userID, id int) error {
+	r.d.mu.Lock()
+	defer r.d.mu.Unlock()
+
+	for i, t := range r.d.tokens {
+		if t.ID == id && t.UserID == userID {
+			r.d.tokens = append(r.d.tokens[:i], r.d.tokens[i+1:]...)
+			return nil
+		}
+	}
+
+	return ErrNotFound
+}
+
+// MemoryImageStore メモリ上の投稿のImgdataに画像を置くImageStore(MySQLImageStoreに相当)
+type MemoryImageStore struct {
+	d *memoryData
+}
+
+// postLocked keyの投稿を探す(ロックを取ってから呼ぶこと)
+func (s *MemoryImageStore) postLocked(key ImageKey) *Post {
+	for i := range s.d.posts {
+		if s.d.posts[i].ID == key.PostID && s.d.posts[i].Mime == key.Mime {
+			return &s.d.posts[i]
+		}
+	}
+
+	return nil
+}
+
+func (s *MemoryImageStore) Put(key ImageKey, data []byte) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if p := s.postLocked(key); p != nil {
+		p.Imgdata = append([]byte(nil), data...)
+	}
+
+	return nil
+}
+
+func (s *MemoryImageStore) Get(key ImageKey) ([]byte, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	p := s.postLocked(key)
+	if p == nil || len(p.Imgdata) == 0 {
+		return nil, ErrNotFound
+	}
+
+	return append([]byte(nil), p.Imgdata...), nil
+}
+
+func (s *MemoryImageStore) Delete(key ImageKey) error {
+	s.d.mu.Lock()
+	defer s.d.mu.Unlock()
+
+	if p := s.postLocked(key); p != nil {
+		p.Imgdata = nil
+	}
+
+	return nil
+}
+
+func (s *MemoryImageStore) Stat(key ImageKey) (ImageInfo, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	p := s.postLocked(key)
+	if p == nil || len(p.Imgdata) == 0 {
+		return ImageInfo{}, ErrNotFound
+	}
+
+	return ImageInfo{Size: int64(len(p.Imgdata)), ModTime: p.CreatedAt}, nil
+}
+
+func (s *MemoryImageStore) ListKeys(afterID, limit int) ([]ImageKey, error) {
+	s.d.mu.RLock()
+	defer s.d.mu.RUnlock()
+
+	keys := []ImageKey{}
+	for _, p := range s.d.posts {
+		if p.ID > afterID {
+			keys = append(keys, ImageKey{PostID: p.ID, Mime: p.Mime})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].PostID < keys[j].PostID
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+
+	return keys, nil
+}
+
+func (s *MemoryImageStore) Checksum(key ImageKey) (string, error) {
+	data, err := s.Get(key)
+	if err != nil {
+		return "", err
+	}
+
+	return ImageChecksum(data), nil
+}
+
+var (
+	_ UserRepo    = (*MemoryUserRepo)(nil)
+	_ PostRepo    = (*MemoryPostRepo)(nil)
+	_ CommentRepo = (*MemoryCommentRepo)(nil)
+	_ TokenRepo   = (*MemoryTokenRepo)(nil)
+	_ ImageStore  = (*MemoryImageStore)(nil)
+	_ UserRepo    = (*MySQLUserRepo)(nil)
+	_ PostRepo    = (*MySQLPostRepo)(nil)
+	_ CommentRepo = (*MySQLCommentRepo)(nil)
+	_ TokenRepo   = (*MySQLTokenRepo)(nil)
+	_ ImageStore  = (*MySQLImageStore)(nil)
+	_ ImageStore  = (*FileImageStore)(nil)
+	_ ImageStore  = (*MigratingImageStore)(nil)
+)
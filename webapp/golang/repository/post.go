@@ -0,0 +1,142 @@
+package repository
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// postColumns 一覧で使う投稿のカラム(imgdataは重いので含めない)
+const postColumns = "posts.id, posts.user_id, posts.body, posts.mime, posts.created_at"
+
+// MySQLPostRepo MySQLによるPostRepo
+type MySQLPostRepo struct {
+	db *sqlx.DB
+}
+
+// NewMySQLPostRepo 新たなMySQLPostRepoを作成
+func NewMySQLPostRepo(db *sqlx.DB) *MySQLPostRepo {
+	return &MySQLPostRepo{db: db}
+}
+
+func (r *MySQLPostRepo) Recent(limit int) ([]Post, error) {
+	posts := []Post{}
+	err := r.db.Select(&posts,
+		"SELECT "+postColumns+" FROM `posts` JOIN `users` ON posts.user_id = users.id"+
+			" WHERE users.del_flg = 0 ORDER BY posts.created_at DESC, posts.id DESC LIMIT ?",
+		limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+func (r *MySQLPostRepo) RecentBefore(maxCreatedAt time.Time, limit int) ([]Post, error) {
+	posts := []Post{}
+	err := r.db.Select(&posts,
+		"SELECT "+postColumns+" FROM `posts` JOIN `users` ON posts.user_id = users.id"+
+			" WHERE users.del_flg = 0 AND posts.created_at <= ? ORDER BY posts.created_at DESC, posts.id DESC LIMIT ?",
+		maxCreatedAt,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+func (r *MySQLPostRepo) RecentAfter(cursor PostCursor, limit int) ([]Post, error) {
+	posts := []Post{}
+	err := r.db.Select(&posts,
+		"SELECT "+postColumns+" FROM `posts` JOIN `users` ON posts.user_id = users.id"+
+			" WHERE users.del_flg = 0 AND (posts.created_at < ? OR (posts.created_at = ? AND posts.id < ?))"+
+			" ORDER BY posts.created_at DESC, posts.id DESC LIMIT ?",
+		cursor.CreatedAt,
+		cursor.CreatedAt,
+		cursor.ID,
+		limit)
+	if err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+func (r *MySQLPostRepo) ListByUser(userID int) ([]Post, error) {
+	posts := []Post{}
+	err := r.db.Select(&posts, "SELECT "+postColumns+" FROM `posts` WHERE `user_id` = ? ORDER BY `created_at` DESC, `id` DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return posts, nil
+}
+
+func (r *MySQLPostRepo) CountByUser(userID int) (int, error) {
+	count := 0
+	err := r.db.Get(&count, "SELECT COUNT(*) AS `count` FROM `posts` WHERE `user_id` = ?", userID)
+
+	return count, err
+}
+
+func (r *MySQLPostRepo) FindByID(id int) (Post, error) {
+	p := Post{}
+	err := r.db.Get(&p, "SELECT "+postColumns+" FROM `posts` WHERE `id` = ?", id)
+	if err != nil {
+		return Post{}, notFound(err)
+	}
+
+	return p, nil
+}
+
+func (r *MySQLPostRepo) Create(p Post, images ImageStore) (int, error) {
+	// MySQLImageStoreは投稿の行に画像を置くので、INSERTで一緒に書く
+	// それ以外のImageStoreの場合、imgdataには空のデータを入れる
+	inRow := storesInPostRow(images)
+	imgdata := []byte{}
+	if inRow && p.Imgdata != nil {
+		imgdata = p.Imgdata
+	}
+
+	tx, err := r.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := "INSERT INTO `posts` (`user_id`, `mime`, `imgdata`, `body`) VALUES (?,?,?,?)"
+	result, err := tx.Exec(query, p.UserID, p.Mime, imgdata, p.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	pid, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	// コミットするまで投稿は他のリクエストから見えないので、その前に画像を置く
+	key := ImageKey{PostID: int(pid), Mime: p.Mime}
+	if !inRow {
+		err = images.Put(key, p.Imgdata)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		if !inRow {
+			// 投稿は保存されていないので、置いた画像を消す
+			derr := images.Delete(key)
+			if derr != nil {
+				return 0, fmt.Errorf("%w (failed to delete the image: %v)", err, derr)
+			}
+		}
+		return 0, err
+	}
+
+	return int(pid), nil
+}
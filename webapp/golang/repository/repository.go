@@ -0,0 +1,152 @@
+// Package repository ユーザー、投稿、コメントの読み書きをまとめる
+//
+//	ハンドラはここのインターフェースだけを使い、SQLやキャッシュには直接触らないこと
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/helpisu"
+)
+
+// ErrNotFound 指定されたユーザー、投稿が存在しない
+var ErrNotFound = errors.New("repository: not found")
+
+const (
+	// LatestComments 投稿一覧で表示するコメントの数
+	LatestComments = 3
+
+	cacheTTL = 5 * time.Minute
+
+	// cacheSchemaVersion キャッシュのスナップショットの形式
+	// User, Commentの構造を変えたら上げること
+	cacheSchemaVersion = 1
+)
+
+type User struct {
+	ID          int       `db:"id"`
+	AccountName string    `db:"account_name"`
+	Passhash    string    `db:"passhash"`
+	Authority   int       `db:"authority"`
+	DelFlg      int       `db:"del_flg"`
+	CreatedAt   time.Time `db:"created_at"`
+}
+
+type Post struct {
+	ID           int       `db:"id"`
+	UserID       int       `db:"user_id"`
+	Imgdata      []byte    `db:"imgdata"`
+	Body         string    `db:"body"`
+	Mime         string    `db:"mime"`
+	CreatedAt    time.Time `db:"created_at"`
+	CommentCount int
+	Comments     []Comment
+	User         User
+	CSRFToken    string
+}
+
+type Comment struct {
+	ID        int       `db:"id"`
+	PostID    int       `db:"post_id"`
+	UserID    int       `db:"user_id"`
+	Comment   string    `db:"comment"`
+	CreatedAt time.Time `db:"created_at"`
+	User      User
+}
+
+// UserRepo ユーザーの読み書き
+type UserRepo interface {
+	// FindByID IDでユーザーを取得する(BANされたユーザーも返す)
+	FindByID(id int) (User, error)
+	// FindByIDs 複数のユーザーをまとめて取得する。存在しないIDはmapに含まれない
+	FindByIDs(ids []int) (map[int]User, error)
+	// FindActiveByAccountName BANされていないユーザーをアカウント名で取得する
+	FindActiveByAccountName(accountName string) (User, error)
+	// ExistsAccountName アカウント名が使われているか(BANされたユーザーも含む)
+	ExistsAccountName(accountName string) (bool, error)
+	// Create ユーザーを作成してIDを返す
+	Create(accountName, passhash string) (int, error)
+	// ListBannable BANできる(管理者でなく、BANされていない)ユーザーを新しい順(created_atが同じ場合はIDの降順)に取得する
+	ListBannable() ([]User, error)
+	// Ban ユーザーをBANする
+	Ban(id int) error
+}
+
+// PostCursor 投稿一覧のページの区切り
+//
+//	一覧は(created_at, id)の降順に並ぶので、created_atが同じ投稿が続いてもページの境目で重複や漏れが起きません
+type PostCursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+// PostRepo 投稿の読み書き
+//
+//	投稿一覧は新しい順(created_atが同じ場合はIDの降順)に返します
+//	画像はImageStoreで読み書きするので、Imgdataは埋めません
+type PostRepo interface {
+	// Recent BANされていないユーザーの投稿を新しい順にlimit件取得する
+	Recent(limit int) ([]Post, error)
+	// RecentBefore maxCreatedAt以前の、BANされていないユーザーの投稿を新しい順にlimit件取得する
+	RecentBefore(maxCreatedAt time.Time, limit int) ([]Post, error)
+	// RecentAfter Recentの並び順でcursorより後ろにある投稿をlimit件取得する
+	RecentAfter(cursor PostCursor, limit int) ([]Post, error)
+	// ListByUser ユーザーの投稿を新しい順に全て取得する
+	ListByUser(userID int) ([]Post, error)
+	// CountByUser ユーザーの投稿数
+	CountByUser(userID int) (int, error)
+	// FindByID IDで投稿を取得する
+	FindByID(id int) (Post, error)
+	// Create 投稿を作成してIDを返す
+	//
+	//	p.Imgdataの画像はimagesに置き、投稿は画像を置き終えてから見えるようにします
+	//	画像を置けなかった場合は投稿を作成せずにエラーを返します
+	Create(p Post, images ImageStore) (int, error)
+}
+
+// CommentRepo コメントの読み書き
+//
+//	コメントは新しい順に返します
+type CommentRepo interface {
+	// CountByPost 投稿に付いたコメント数
+	CountByPost(postID int) (int, error)
+	// CountByPosts 複数の投稿のコメント数をまとめて取得する。コメントが無い投稿は0
+	CountByPosts(postIDs []int) (map[int]int, error)
+	// LatestByPost 投稿に付いた新しいコメントをLatestComments件取得する
+	LatestByPost(postID int) ([]Comment, error)
+	// LatestByPosts 複数の投稿の新しいコメントをLatestComments件ずつまとめて取得する
+	LatestByPosts(postIDs []int) (map[int][]Comment, error)
+	// ListByPost 投稿に付いたコメントを全て取得する
+	ListByPost(postID int) ([]Comment, error)
+	// CountByUser ユーザーが書いたコメント数
+	CountByUser(userID int) (int, error)
+	// CountOnUserPosts ユーザーの投稿に付いたコメント数
+	CountOnUserPosts(userID int) (int, error)
+	// Create コメントを作成して、作成したコメントを返す(Userは埋めない)
+	Create(postID, userID int, comment string) (Comment, error)
+}
+
+// CacheConfig MySQLのリポジトリが使うキャッシュの設定
+//
+//	複数プロセスで動かさない場合はどちらもnilで構いません
+type CacheConfig struct {
+	Bus    *helpisu.InvalidationBus
+	Remote *helpisu.RemoteTier
+}
+
+// userTag ユーザーから作られたキャッシュに付けるタグ
+func userTag(id int) string {
+	return "user:" + strconv.Itoa(id)
+}
+
+// notFound sql.ErrNoRowsをErrNotFoundに置き換える
+func notFound(err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrNotFound
+	}
+
+	return err
+}
@@ -0,0 +1,697 @@
+package repository
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/helpisu"
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// testDSNEnv 設定されているとMySQLの実装も同じテストで確かめる
+//
+//	例: isuconp:isuconp@tcp(127.0.0.1:3306)/isuconp?charset=utf8mb4&parseTime=true&loc=Local
+//	テーブルはTEMPORARYで作るので、既存のテーブルのデータには触りません
+const testDSNEnv = "ISUCONP_TEST_DSN"
+
+// repos テストするリポジトリと、フィクスチャをそのまま入れる関数
+type repos struct {
+	users    UserRepo
+	posts    PostRepo
+	comments CommentRepo
+	// images 投稿の行に画像を置くImageStore
+	images ImageStore
+
+	addUser    func(t *testing.T, u User)
+	addPost    func(t *testing.T, p Post)
+	addComment func(t *testing.T, c Comment)
+}
+
+// backend 空のreposを作る
+type backend struct {
+	name string
+	new  func(t *testing.T) repos
+}
+
+func newMemoryRepos(*testing.T) repos {
+	m := NewMemory()
+
+	return repos{
+		users:      m.Users,
+		posts:      m.Posts,
+		comments:   m.Comments,
+		images:     m.Images,
+		addUser:    func(_ *testing.T, u User) { m.AddUser(u) },
+		addPost:    func(_ *testing.T, p Post) { m.AddPost(p) },
+		addComment: func(_ *testing.T, c Comment) { m.AddComment(c) },
+	}
+}
+
+// mysqlSchema private-isuのテーブル(同じ名前の既存のテーブルより優先される)
+var mysqlSchema = []string{
+	"CREATE TEMPORARY TABLE `users` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`account_name` varchar(64) NOT NULL UNIQUE," +
+		"`passhash` varchar(128) NOT NULL," +
+		"`authority` tinyint(1) NOT NULL DEFAULT 0," +
+		"`del_flg` tinyint(1) NOT NULL DEFAULT 0," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TEMPORARY TABLE `posts` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` int NOT NULL," +
+		"`mime` varchar(64) NOT NULL," +
+		"`imgdata` mediumblob NOT NULL," +
+		"`body` text NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+	"CREATE TEMPORARY TABLE `comments` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`post_id` int NOT NULL," +
+		"`user_id` int NOT NULL," +
+		"`comment` text NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP" +
+		") DEFAULT CHARSET=utf8mb4",
+}
+
+var (
+	mysqlOnce  sync.Once
+	mysqlDB    *sqlx.DB
+	mysqlRepos repos
+	mysqlErr   error
+)
+
+// openMySQL MySQLのリポジトリを1度だけ作る
+//
+//	リポジトリはキャッシュを登録するので作り直さず、テストごとに行とキャッシュを消して使い回す
+//	TEMPORARYテーブルは接続ごとなので、接続を1本に絞る
+func openMySQL(dsn string) {
+	mysqlDB, mysqlErr = sqlx.Open("mysql", dsn)
+	if mysqlErr != nil {
+		return
+	}
+	mysqlDB.SetMaxOpenConns(1)
+	mysqlDB.SetMaxIdleConns(1)
+
+	for _, q := range mysqlSchema {
+		_, mysqlErr = mysqlDB.Exec(q)
+		if mysqlErr != nil {
+			return
+		}
+	}
+
+	mysqlRepos = repos{
+		users:    NewMySQLUserRepo(mysqlDB, CacheConfig{}),
+		posts:    NewMySQLPostRepo(mysqlDB),
+		comments: NewMySQLCommentRepo(mysqlDB, CacheConfig{}),
+		images:   NewMySQLImageStore(mysqlDB),
+		addUser: func(t *testing.T, u User) {
+			t.Helper()
+			_, err := mysqlDB.Exec("INSERT INTO `users` (`id`, `account_name`, `passhash`, `authority`, `del_flg`, `created_at`) VALUES (?,?,?,?,?,?)",
+				u.ID, u.AccountName, u.Passhash, u.Authority, u.DelFlg, u.CreatedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+		addPost: func(t *testing.T, p Post) {
+			t.Helper()
+			_, err := mysqlDB.Exec("INSERT INTO `posts` (`id`, `user_id`, `mime`, `imgdata`, `body`, `created_at`) VALUES (?,?,?,?,?,?)",
+				p.ID, p.UserID, p.Mime, []byte{}, p.Body, p.CreatedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+		addComment: func(t *testing.T, c Comment) {
+			t.Helper()
+			_, err := mysqlDB.Exec("INSERT INTO `comments` (`id`, `post_id`, `user_id`, `comment`, `created_at`) VALUES (?,?,?,?,?)",
+				c.ID, c.PostID, c.UserID, c.Comment, c.CreatedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+}
+
+func newMySQLRepos(t *testing.T) repos {
+	t.Helper()
+
+	mysqlOnce.Do(func() { openMySQL(os.Getenv(testDSNEnv)) })
+	if mysqlErr != nil {
+		t.Fatal(mysqlErr)
+	}
+
+	for _, table := range []string{"users", "posts", "comments"} {
+		_, err := mysqlDB.Exec("DELETE FROM `" + table + "`")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	helpisu.ResetAllCache()
+
+	return mysqlRepos
+}
+
+// backends テストするリポジトリの実装(MySQLはtestDSNEnvが設定されている場合だけ)
+func backends() []backend {
+	bs := []backend{{"Memory", newMemoryRepos}}
+	if os.Getenv(testDSNEnv) != "" {
+		bs = append(bs, backend{"MySQL", newMySQLRepos})
+	}
+
+	return bs
+}
+
+// base フィクスチャの時刻の基準(DATETIMEに合わせて秒単位)
+var base = time.Date(2024, 1, 1, 0, 0, 0, 0, time.Local)
+
+func at(min int) time.Time {
+	return base.Add(time.Duration(min) * time.Minute)
+}
+
+/*
+newFixture 全てのテストで使うデータを入れたreposを作る
+
+	user: 1 alice, 2 bob(BAN済み), 3 admin(管理者), 4 carol, 5 dave(3〜5は同じ時刻)
+	post: 10(1), 11(2), 12(4), 13(1), 14(4), 15(1) (12〜14は同じ時刻)
+	comment: 投稿10に100〜104(101と102は同じ時刻)、投稿12に105、投稿15に106, 107(同じ時刻)、投稿13には無し
+*/
+func newFixture(t *testing.T, b backend) repos {
+	t.Helper()
+
+	r := b.new(t)
+
+	for _, u := range []User{
+		{ID: 1, AccountName: "alice", CreatedAt: at(1)},
+		{ID: 2, AccountName: "bob", DelFlg: 1, CreatedAt: at(2)},
+		{ID: 3, AccountName: "admin", Authority: 1, CreatedAt: at(3)},
+		{ID: 4, AccountName: "carol", CreatedAt: at(3)},
+		{ID: 5, AccountName: "dave", CreatedAt: at(3)},
+	} {
+		u.Passhash = "hash"
+		r.addUser(t, u)
+	}
+
+	for _, p := range []Post{
+		{ID: 10, UserID: 1, CreatedAt: at(10)},
+		{ID: 11, UserID: 2, CreatedAt: at(11)},
+		{ID: 12, UserID: 4, CreatedAt: at(12)},
+		{ID: 13, UserID: 1, CreatedAt: at(12)},
+		{ID: 14, UserID: 4, CreatedAt: at(12)},
+		{ID: 15, UserID: 1, CreatedAt: at(13)},
+	} {
+		p.Mime = "image/jpeg"
+		p.Body = "body"
+		r.addPost(t, p)
+	}
+
+	for _, c := range []Comment{
+		{ID: 100, PostID: 10, UserID: 4, CreatedAt: at(20)},
+		{ID: 101, PostID: 10, UserID: 1, CreatedAt: at(21)},
+		{ID: 102, PostID: 10, UserID: 4, CreatedAt: at(21)},
+		{ID: 103, PostID: 10, UserID: 2, CreatedAt: at(22)},
+		{ID: 104, PostID: 10, UserID: 1, CreatedAt: at(23)},
+		{ID: 105, PostID: 12, UserID: 1, CreatedAt: at(20)},
+		{ID: 106, PostID: 15, UserID: 4, CreatedAt: at(30)},
+		{ID: 107, PostID: 15, UserID: 4, CreatedAt: at(30)},
+	} {
+		c.Comment = "comment"
+		r.addComment(t, c)
+	}
+
+	return r
+}
+
+func userIDs(users []User) []int {
+	ids := make([]int, 0, len(users))
+	for _, u := range users {
+		ids = append(ids, u.ID)
+	}
+
+	return ids
+}
+
+func postIDs(posts []Post) []int {
+	ids := make([]int, 0, len(posts))
+	for _, p := range posts {
+		ids = append(ids, p.ID)
+	}
+
+	return ids
+}
+
+func commentIDs(comments []Comment) []int {
+	ids := make([]int, 0, len(comments))
+	for _, c := range comments {
+		ids = append(ids, c.ID)
+	}
+
+	return ids
+}
+
+func TestUserRepo(t *testing.T) {
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			r := newFixture(t, b)
+
+			// 2回目はキャッシュから読む
+			for i := 0; i < 2; i++ {
+				u, err := r.users.FindByID(2)
+				if err != nil || u.AccountName != "bob" || u.DelFlg != 1 {
+					t.Errorf("FindByID(2) = %+v, %v, want bob (banned)", u, err)
+				}
+				if _, err := r.users.FindByID(999); !errors.Is(err, ErrNotFound) {
+					t.Errorf("FindByID(999) err = %v, want %v", err, ErrNotFound)
+				}
+
+				m, err := r.users.FindByIDs([]int{1, 2, 999})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(m) != 2 || m[1].AccountName != "alice" || m[2].AccountName != "bob" {
+					t.Errorf("FindByIDs() = %+v, want alice and bob only", m)
+				}
+			}
+
+			if u, err := r.users.FindActiveByAccountName("alice"); err != nil || u.ID != 1 {
+				t.Errorf("FindActiveByAccountName(alice) = %+v, %v, want ID 1", u, err)
+			}
+			if _, err := r.users.FindActiveByAccountName("bob"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("FindActiveByAccountName(bob) err = %v, want %v", err, ErrNotFound)
+			}
+
+			for name, want := range map[string]bool{"bob": true, "admin": true, "nobody": false} {
+				if got, err := r.users.ExistsAccountName(name); err != nil || got != want {
+					t.Errorf("ExistsAccountName(%s) = %v, %v, want %v", name, got, err, want)
+				}
+			}
+
+			users, err := r.users.ListBannable()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := userIDs(users), []int{5, 4, 1}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ListBannable() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestUserRepoWrites(t *testing.T) {
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			r := newFixture(t, b)
+
+			id, err := r.users.Create("erin", "hash")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id <= 5 {
+				t.Errorf("Create() = %d, want an ID after the existing users", id)
+			}
+			if u, err := r.users.FindByID(id); err != nil || u.AccountName != "erin" || u.DelFlg != 0 {
+				t.Errorf("FindByID(%d) = %+v, %v, want erin", id, u, err)
+			}
+
+			// キャッシュに載せてからBANしても、BANされた状態が読める
+			_, _ = r.users.FindByID(1)
+			_, _ = r.users.FindByIDs([]int{1})
+			err = r.users.Ban(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u, err := r.users.FindByID(1); err != nil || u.DelFlg != 1 {
+				t.Errorf("FindByID(1) after Ban = %+v, %v, want del_flg=1", u, err)
+			}
+			if m, err := r.users.FindByIDs([]int{1}); err != nil || m[1].DelFlg != 1 {
+				t.Errorf("FindByIDs() after Ban = %+v, %v, want del_flg=1", m, err)
+			}
+			if _, err := r.users.FindActiveByAccountName("alice"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("FindActiveByAccountName(alice) after Ban err = %v, want %v", err, ErrNotFound)
+			}
+			users, err := r.users.ListBannable()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := userIDs(users), []int{id, 5, 4}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ListBannable() after Ban = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestPostRepo(t *testing.T) {
+	tests := []struct {
+		name string
+		list func(r PostRepo) ([]Post, error)
+		want []int
+	}{
+		{
+			name: "Recent",
+			list: func(r PostRepo) ([]Post, error) { return r.Recent(10) },
+			want: []int{15, 14, 13, 12, 10},
+		},
+		{
+			name: "Recentはlimit件まで",
+			list: func(r PostRepo) ([]Post, error) { return r.Recent(2) },
+			want: []int{15, 14},
+		},
+		{
+			name: "RecentBeforeは同じ時刻を含む",
+			list: func(r PostRepo) ([]Post, error) { return r.RecentBefore(at(12), 10) },
+			want: []int{14, 13, 12, 10},
+		},
+		{
+			name: "RecentAfterは同じ時刻のIDの小さい投稿から続ける",
+			list: func(r PostRepo) ([]Post, error) { return r.RecentAfter(PostCursor{CreatedAt: at(12), ID: 14}, 2) },
+			want: []int{13, 12},
+		},
+		{
+			name: "RecentAfterの最後",
+			list: func(r PostRepo) ([]Post, error) { return r.RecentAfter(PostCursor{CreatedAt: at(10), ID: 10}, 2) },
+			want: []int{},
+		},
+		{
+			name: "ListByUserはBANされたユーザーの投稿も返す",
+			list: func(r PostRepo) ([]Post, error) { return r.ListByUser(2) },
+			want: []int{11},
+		},
+		{
+			name: "ListByUser",
+			list: func(r PostRepo) ([]Post, error) { return r.ListByUser(1) },
+			want: []int{15, 13, 10},
+		},
+		{
+			name: "ListByUserの同じ時刻の投稿",
+			list: func(r PostRepo) ([]Post, error) { return r.ListByUser(4) },
+			want: []int{14, 12},
+		},
+	}
+
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			r := newFixture(t, b)
+
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					posts, err := tt.list(r.posts)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := postIDs(posts); !reflect.DeepEqual(got, tt.want) {
+						t.Errorf("got %v, want %v", got, tt.want)
+					}
+					for _, p := range posts {
+						if p.Imgdata != nil {
+							t.Errorf("post %d has imgdata", p.ID)
+						}
+					}
+				})
+			}
+
+			t.Run("RecentAfterでページを辿る", func(t *testing.T) {
+				got := []int{}
+				posts, err := r.posts.Recent(2)
+				for err == nil && len(posts) > 0 {
+					got = append(got, postIDs(posts)...)
+					last := posts[len(posts)-1]
+					posts, err = r.posts.RecentAfter(PostCursor{CreatedAt: last.CreatedAt, ID: last.ID}, 2)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if want := []int{15, 14, 13, 12, 10}; !reflect.DeepEqual(got, want) {
+					t.Errorf("pages = %v, want %v", got, want)
+				}
+			})
+
+			t.Run("CountByUser", func(t *testing.T) {
+				for userID, want := range map[int]int{1: 3, 2: 1, 3: 0} {
+					if got, err := r.posts.CountByUser(userID); err != nil || got != want {
+						t.Errorf("CountByUser(%d) = %d, %v, want %d", userID, got, err, want)
+					}
+				}
+			})
+
+			t.Run("FindByID", func(t *testing.T) {
+				p, err := r.posts.FindByID(11)
+				if err != nil || p.UserID != 2 || p.Mime != "image/jpeg" || p.Body != "body" || !p.CreatedAt.Equal(at(11)) {
+					t.Errorf("FindByID(11) = %+v, %v", p, err)
+				}
+				if _, err := r.posts.FindByID(999); !errors.Is(err, ErrNotFound) {
+					t.Errorf("FindByID(999) err = %v, want %v", err, ErrNotFound)
+				}
+			})
+		})
+	}
+}
+
+// failingImageStore Putが失敗するImageStore
+type failingImageStore struct {
+	ImageStore
+	key ImageKey
+}
+
+var errPut = errors.New("put failed")
+
+func (s *failingImageStore) Put(key ImageKey, _ []byte) error {
+	s.key = key
+	return errPut
+}
+
+func TestPostRepoCreate(t *testing.T) {
+	tests := []struct {
+		name   string
+		images func(t *testing.T, r repos) ImageStore
+	}{
+		{
+			name:   "投稿の行に置く",
+			images: func(_ *testing.T, r repos) ImageStore { return r.images },
+		},
+		{
+			name: "ファイルに置く",
+			images: func(t *testing.T, _ repos) ImageStore {
+				return NewFileImageStore(t.TempDir())
+			},
+		},
+		{
+			name: "移行中",
+			images: func(t *testing.T, r repos) ImageStore {
+				return NewMigratingImageStore(r.images, NewFileImageStore(t.TempDir()))
+			},
+		},
+	}
+
+	for _, b := range backends() {
+		for _, tt := range tests {
+			t.Run(b.name+"/"+tt.name, func(t *testing.T) {
+				r := newFixture(t, b)
+				images := tt.images(t, r)
+				data := []byte("\x89PNG\r\n\x1a\npng")
+
+				// 画像を置けなかったら投稿を作らない
+				failing := &failingImageStore{}
+				_, err := r.posts.Create(Post{UserID: 4, Mime: "image/png", Imgdata: data, Body: "failed"}, failing)
+				if !errors.Is(err, errPut) {
+					t.Errorf("Create() err = %v, want %v", err, errPut)
+				}
+				if _, err := r.posts.FindByID(failing.key.PostID); !errors.Is(err, ErrNotFound) {
+					t.Errorf("FindByID(%d) of a failed post err = %v, want %v", failing.key.PostID, err, ErrNotFound)
+				}
+
+				id, err := r.posts.Create(Post{UserID: 4, Mime: "image/png", Imgdata: data, Body: "new"}, images)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if id <= failing.key.PostID {
+					t.Errorf("Create() = %d, want a new ID after %d", id, failing.key.PostID)
+				}
+				if p, err := r.posts.FindByID(id); err != nil || p.UserID != 4 || p.Body != "new" {
+					t.Errorf("FindByID(%d) = %+v, %v", id, p, err)
+				}
+				if posts, err := r.posts.Recent(1); err != nil || len(posts) != 1 || posts[0].ID != id {
+					t.Errorf("Recent(1) = %v, %v, want [%d]", postIDs(posts), err, id)
+				}
+				if got, err := images.Get(ImageKey{PostID: id, Mime: "image/png"}); err != nil || !reflect.DeepEqual(got, data) {
+					t.Errorf("Get() = %q, %v, want %q", got, err, data)
+				}
+			})
+		}
+	}
+}
+
+// fixtureCounts, fixtureLatest newFixtureの投稿ごとのコメント数と新しいコメント(999は存在しない投稿)
+var (
+	fixtureCounts = map[int]int{10: 5, 12: 1, 13: 0, 15: 2, 999: 0}
+	fixtureLatest = map[int][]int{10: {104, 103, 102}, 12: {105}, 13: {}, 15: {107, 106}, 999: {}}
+)
+
+func TestCommentRepo(t *testing.T) {
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			r := newFixture(t, b)
+
+			// 2回目はキャッシュから読む
+			for i := 0; i < 2; i++ {
+				for id, want := range fixtureCounts {
+					if got, err := r.comments.CountByPost(id); err != nil || got != want {
+						t.Errorf("CountByPost(%d) = %d, %v, want %d", id, got, err, want)
+					}
+				}
+				for id, want := range fixtureLatest {
+					comments, err := r.comments.LatestByPost(id)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if got := commentIDs(comments); !reflect.DeepEqual(got, want) {
+						t.Errorf("LatestByPost(%d) = %v, want %v", id, got, want)
+					}
+				}
+			}
+
+			comments, err := r.comments.ListByPost(10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := commentIDs(comments), []int{104, 103, 102, 101, 100}; !reflect.DeepEqual(got, want) {
+				t.Errorf("ListByPost(10) = %v, want %v", got, want)
+			}
+
+			for userID, want := range map[int]int{1: 3, 4: 4, 5: 0} {
+				if got, err := r.comments.CountByUser(userID); err != nil || got != want {
+					t.Errorf("CountByUser(%d) = %d, %v, want %d", userID, got, err, want)
+				}
+			}
+			for userID, want := range map[int]int{1: 7, 4: 1, 5: 0} {
+				if got, err := r.comments.CountOnUserPosts(userID); err != nil || got != want {
+					t.Errorf("CountOnUserPosts(%d) = %d, %v, want %d", userID, got, err, want)
+				}
+			}
+		})
+	}
+}
+
+// TestCommentRepoBatch まとめて取得した結果がLatestByPostなどで1件ずつ取得した結果と一致する
+//
+//	MySQLではLatestByPostsのROW_NUMBER()のクエリとLatestByPostのクエリが同じ並び順になることを確かめる
+func TestCommentRepoBatch(t *testing.T) {
+	tests := []struct {
+		name string
+		// warm 先に1件ずつ読んでキャッシュに載せておく投稿
+		warm []int
+		ids  []int
+	}{
+		{
+			name: "キャッシュに無い",
+			ids:  []int{10, 12, 13, 15, 999},
+		},
+		{
+			name: "一部がキャッシュにある",
+			warm: []int{10, 13},
+			ids:  []int{10, 12, 13, 15, 999},
+		},
+		{
+			name: "空",
+			ids:  []int{},
+		},
+	}
+
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			for _, tt := range tests {
+				t.Run(tt.name, func(t *testing.T) {
+					r := newFixture(t, b)
+
+					wantCounts := map[int]int{}
+					wantLatest := map[int][]int{}
+					for _, id := range tt.ids {
+						wantCounts[id] = fixtureCounts[id]
+						wantLatest[id] = fixtureLatest[id]
+					}
+
+					for _, id := range tt.warm {
+						_, _ = r.comments.CountByPost(id)
+						_, _ = r.comments.LatestByPost(id)
+					}
+
+					counts, err := r.comments.CountByPosts(tt.ids)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if !reflect.DeepEqual(counts, wantCounts) {
+						t.Errorf("CountByPosts() = %v, want %v", counts, wantCounts)
+					}
+
+					latest, err := r.comments.LatestByPosts(tt.ids)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got := map[int][]int{}
+					for id, comments := range latest {
+						got[id] = commentIDs(comments)
+					}
+					if !reflect.DeepEqual(got, wantLatest) {
+						t.Errorf("LatestByPosts() = %v, want %v", got, wantLatest)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestCommentRepoCreate(t *testing.T) {
+	for _, b := range backends() {
+		t.Run(b.name, func(t *testing.T) {
+			r := newFixture(t, b)
+
+			// キャッシュに載せてから書き込んでも、新しいコメントが読める
+			_, _ = r.comments.CountByPost(10)
+			_, _ = r.comments.LatestByPost(10)
+			_, _ = r.comments.CountByPosts([]int{13})
+			_, _ = r.comments.LatestByPosts([]int{13})
+
+			c10, err := r.comments.Create(10, 5, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c10.PostID != 10 || c10.UserID != 5 || c10.Comment != "new" || c10.CreatedAt.IsZero() {
+				t.Errorf("Create() = %+v", c10)
+			}
+			c13, err := r.comments.Create(13, 5, "new")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			counts, err := r.comments.CountByPosts([]int{10, 13})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := map[int]int{10: 6, 13: 1}; !reflect.DeepEqual(counts, want) {
+				t.Errorf("CountByPosts() = %v, want %v", counts, want)
+			}
+
+			latest, err := r.comments.LatestByPosts([]int{10, 13})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := commentIDs(latest[10]), []int{c10.ID, 104, 103}; !reflect.DeepEqual(got, want) {
+				t.Errorf("LatestByPosts()[10] = %v, want %v", got, want)
+			}
+			if got, want := commentIDs(latest[13]), []int{c13.ID}; !reflect.DeepEqual(got, want) {
+				t.Errorf("LatestByPosts()[13] = %v, want %v", got, want)
+			}
+			// Createが返すコメントは読み直したコメントと同じ
+			if got := latest[10][0]; got.Comment != c10.Comment || !got.CreatedAt.Equal(c10.CreatedAt) {
+				t.Errorf("LatestByPosts()[10][0] = %+v, want %+v", got, c10)
+			}
+
+			if got, err := r.comments.CountByUser(5); err != nil || got != 2 {
+				t.Errorf("CountByUser(5) = %d, %v, want 2", got, err)
+			}
+		})
+	}
+}
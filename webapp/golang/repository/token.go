@@ -0,0 +1,135 @@
+package repository
+
+import (
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/helpisu"
+	"github.com/jmoiron/sqlx"
+)
+
+// Token APIで使う個人用アクセストークン
+//
+//	トークンそのものは保存せず、ハッシュ値だけを持ちます
+type Token struct {
+	ID        int       `db:"id"`
+	UserID    int       `db:"user_id"`
+	Name      string    `db:"name"`
+	TokenHash string    `db:"token_hash"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+// TokenRepo 個人用アクセストークンの読み書き
+type TokenRepo interface {
+	// Create トークンのハッシュ値を保存する
+	Create(userID int, name, tokenHash string) (Token, error)
+	// FindByHash ハッシュ値でトークンを取得する
+	FindByHash(tokenHash string) (Token, error)
+	// ListByUser ユーザーのトークンを新しい順に取得する
+	ListByUser(userID int) ([]Token, error)
+	// Revoke ユーザーのトークンを削除する。他のユーザーのトークンの場合はErrNotFound
+	Revoke(userID, id int) error
+}
+
+// tokenCacheTTL トークンのキャッシュの有効期間
+//
+//	Revokeしたプロセスではすぐに消しますが、他のプロセスではこの時間だけ使えることがあります
+const tokenCacheTTL = time.Minute
+
+// MySQLTokenRepo MySQLとhelpisu.CacheによるTokenRepo
+type MySQLTokenRepo struct {
+	db    *sqlx.DB
+	cache *helpisu.Cache[string, Token]
+}
+
+// NewMySQLTokenRepo 新たなMySQLTokenRepoを作成
+//
+//	キャッシュを登録するので、プロセスで1度だけ呼ぶこと
+func NewMySQLTokenRepo(db *sqlx.DB, cfg CacheConfig) *MySQLTokenRepo {
+	return &MySQLTokenRepo{
+		db: db,
+		cache: helpisu.NewCache[string, Token](
+			"token",
+			helpisu.WithInvalidation(cfg.Bus),
+			helpisu.WithTTL(tokenCacheTTL),
+			helpisu.WithJanitor(time.Minute),
+		),
+	}
+}
+
+// CreateTable トークンのテーブルが無ければ作る
+func (r *MySQLTokenRepo) CreateTable() error {
+	_, err := r.db.Exec("CREATE TABLE IF NOT EXISTS `personal_access_tokens` (" +
+		"`id` int NOT NULL AUTO_INCREMENT PRIMARY KEY," +
+		"`user_id` int NOT NULL," +
+		"`name` varchar(64) NOT NULL," +
+		"`token_hash` char(64) NOT NULL," +
+		"`created_at` timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP," +
+		"UNIQUE KEY `token_hash` (`token_hash`)," +
+		"KEY `user_id` (`user_id`)" +
+		") DEFAULT CHARSET=utf8mb4")
+
+	return err
+}
+
+func (r *MySQLTokenRepo) load(tokenHash string) (Token, error) {
+	t := Token{}
+	err := r.db.Get(&t, "SELECT * FROM `personal_access_tokens` WHERE `token_hash` = ?", tokenHash)
+
+	return t, err
+}
+
+func (r *MySQLTokenRepo) Create(userID int, name, tokenHash string) (Token, error) {
+	result, err := r.db.Exec("INSERT INTO `personal_access_tokens` (`user_id`, `name`, `token_hash`) VALUES (?,?,?)", userID, name, tokenHash)
+	if err != nil {
+		return Token{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return Token{}, err
+	}
+
+	t := Token{}
+	err = r.db.Get(&t, "SELECT * FROM `personal_access_tokens` WHERE `id` = ?", id)
+	if err != nil {
+		return Token{}, err
+	}
+
+	return t, nil
+}
+
+func (r *MySQLTokenRepo) FindByHash(tokenHash string) (Token, error) {
+	t, err := r.cache.GetOrLoad(tokenHash, r.load)
+	if err != nil {
+		return Token{}, notFound(err)
+	}
+
+	return t, nil
+}
+
+func (r *MySQLTokenRepo) ListByUser(userID int) ([]Token, error) {
+	tokens := []Token{}
+	err := r.db.Select(&tokens, "SELECT * FROM `personal_access_tokens` WHERE `user_id` = ? ORDER BY `created_at` DESC, `id` DESC", userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+func (r *MySQLTokenRepo) Revoke(userID, id int) error {
+	t := Token{}
+	err := r.db.Get(&t, "SELECT * FROM `personal_access_tokens` WHERE `id` = ? AND `user_id` = ?", id, userID)
+	if err != nil {
+		return notFound(err)
+	}
+
+	_, err = r.db.Exec("DELETE FROM `personal_access_tokens` WHERE `id` = ?", id)
+	if err != nil {
+		return err
+	}
+
+	r.cache.Delete(t.TokenHash)
+
+	return nil
+}
@@ -0,0 +1,159 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/catatsuy/private-isu/webapp/golang/helpisu"
+	"github.com/jmoiron/sqlx"
+)
+
+// MySQLUserRepo MySQLとhelpisu.CacheによるUserRepo
+type MySQLUserRepo struct {
+	db    *sqlx.DB
+	cache *helpisu.Cache[int, User]
+}
+
+// NewMySQLUserRepo 新たなMySQLUserRepoを作成
+//
+//	キャッシュを登録するので、プロセスで1度だけ呼ぶこと
+func NewMySQLUserRepo(db *sqlx.DB, cfg CacheConfig) *MySQLUserRepo {
+	r := &MySQLUserRepo{
+		db: db,
+		cache: helpisu.NewCache[int, User](
+			"user",
+			helpisu.WithInvalidation(cfg.Bus),
+			helpisu.WithRemote(cfg.Remote),
+			helpisu.WithTagger(func(id int, _ User) []string {
+				return []string{userTag(id)}
+			}),
+			helpisu.WithTTL(cacheTTL),
+			helpisu.WithJanitor(time.Minute),
+			helpisu.WithMaxEntries(100000),
+			helpisu.WithSnapshot(helpisu.SnapshotGob, cacheSchemaVersion),
+		),
+	}
+	r.cache.RegisterWarmUp(r.warmUp)
+
+	return r
+}
+
+func (r *MySQLUserRepo) warmUp(ctx context.Context, c *helpisu.Cache[int, User]) error {
+	// 読み込み中にBanされたユーザーを古い値で上書きしないよう、読み込む前に始める
+	f := c.BeginFill()
+
+	users := []User{}
+	err := r.db.SelectContext(ctx, &users, "SELECT * FROM `users`")
+	if err != nil {
+		return err
+	}
+
+	m := make(map[int]User, len(users))
+	for _, u := range users {
+		m[u.ID] = u
+	}
+	_, err = f.FillMany(ctx, m)
+
+	return err
+}
+
+func (r *MySQLUserRepo) load(id int) (User, error) {
+	u := User{}
+	err := r.db.Get(&u, "SELECT * FROM `users` WHERE `id` = ?", id)
+
+	return u, err
+}
+
+func (r *MySQLUserRepo) loadMany(ids []int) (map[int]User, error) {
+	query, args, err := sqlx.In("SELECT * FROM `users` WHERE `id` IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+
+	users := []User{}
+	err = r.db.Select(&users, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[int]User, len(users))
+	for _, u := range users {
+		m[u.ID] = u
+	}
+
+	return m, nil
+}
+
+func (r *MySQLUserRepo) FindByID(id int) (User, error) {
+	u, err := r.cache.GetOrLoad(id, r.load)
+	if err != nil {
+		return User{}, notFound(err)
+	}
+
+	return u, nil
+}
+
+func (r *MySQLUserRepo) FindByIDs(ids []int) (map[int]User, error) {
+	return r.cache.GetManyOrLoad(ids, r.loadMany)
+}
+
+func (r *MySQLUserRepo) FindActiveByAccountName(accountName string) (User, error) {
+	u := User{}
+	err := r.db.Get(&u, "SELECT * FROM `users` WHERE `account_name` = ? AND `del_flg` = 0", accountName)
+	if err != nil {
+		return User{}, notFound(err)
+	}
+
+	return u, nil
+}
+
+func (r *MySQLUserRepo) ExistsAccountName(accountName string) (bool, error) {
+	exists := 0
+	err := r.db.Get(&exists, "SELECT 1 FROM `users` WHERE `account_name` = ? LIMIT 1", accountName)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return exists == 1, nil
+}
+
+func (r *MySQLUserRepo) Create(accountName, passhash string) (int, error) {
+	result, err := r.db.Exec("INSERT INTO `users` (`account_name`, `passhash`) VALUES (?,?)", accountName, passhash)
+	if err != nil {
+		return 0, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(id), nil
+}
+
+func (r *MySQLUserRepo) ListBannable() ([]User, error) {
+	users := []User{}
+	err := r.db.Select(&users, "SELECT * FROM `users` WHERE `authority` = 0 AND `del_flg` = 0 ORDER BY `created_at` DESC, `id` DESC")
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (r *MySQLUserRepo) Ban(id int) error {
+	_, err := r.db.Exec("UPDATE `users` SET `del_flg` = ? WHERE `id` = ?", 1, id)
+	if err != nil {
+		return err
+	}
+
+	// ユーザー本人と、そのユーザーのコメントを含むキャッシュを消す
+	helpisu.InvalidateTag(userTag(id))
+
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"html/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// go test -run TestTemplateGolden -update でgoldenファイルを書き換える
+var update = flag.Bool("update", false, "update golden files")
+
+var (
+	spacesRe     = regexp.MustCompile(`\s+`)
+	betweenTagRe = regexp.MustCompile(`>\s*<`)
+)
+
+// normalizeHTML 空白の違いを無視して比べられるようにする
+//
+//	連続する空白を1つにまとめ、タグの間で改行します
+func normalizeHTML(s string) string {
+	s = spacesRe.ReplaceAllString(s, " ")
+	s = betweenTagRe.ReplaceAllString(s, ">\n<")
+
+	return strings.TrimSpace(s) + "\n"
+}
+
+// templateFixture テンプレートに渡すデータ
+//
+//	時刻は実行環境のタイムゾーンに左右されないよう固定しています
+type templateFixture struct {
+	admin  User
+	alice  User
+	bob    User
+	posts  []Post
+	users  []User
+	csrf   string
+	notice string
+}
+
+func newTemplateFixture() templateFixture {
+	jst := time.FixedZone("Asia/Tokyo", 9*60*60)
+	base := time.Date(2016, 1, 2, 15, 4, 5, 0, jst)
+
+	admin := User{ID: 1, AccountName: "admin", Authority: 1, CreatedAt: base}
+	alice := User{ID: 2, AccountName: "alice", CreatedAt: base.Add(time.Hour)}
+	bob := User{ID: 3, AccountName: "bob", CreatedAt: base.Add(2 * time.Hour)}
+
+	posts := []Post{
+		{
+			ID:           12,
+			UserID:       alice.ID,
+			Body:         "<b>escaped</b> body",
+			Mime:         "image/png",
+			CreatedAt:    base.Add(3 * time.Hour),
+			CommentCount: 5,
+			Comments: []Comment{
+				{ID: 101, PostID: 12, UserID: bob.ID, Comment: "nice", CreatedAt: base.Add(4 * time.Hour), User: bob},
+				{ID: 102, PostID: 12, UserID: alice.ID, Comment: "thanks & bye", CreatedAt: base.Add(5 * time.Hour), User: alice},
+			},
+			User:      alice,
+			CSRFToken: "0123456789abcdef",
+		},
+		{
+			ID:        11,
+			UserID:    bob.ID,
+			Body:      "second",
+			Mime:      "image/gif",
+			CreatedAt: base.Add(2 * time.Hour),
+			User:      bob,
+			CSRFToken: "0123456789abcdef",
+		},
+		{
+			ID:        10,
+			UserID:    alice.ID,
+			Body:      "first",
+			Mime:      "image/jpeg",
+			CreatedAt: base,
+			User:      alice,
+			CSRFToken: "0123456789abcdef",
+		},
+	}
+
+	return templateFixture{
+		admin:  admin,
+		alice:  alice,
+		bob:    bob,
+		posts:  posts,
+		users:  []User{bob, alice},
+		csrf:   "0123456789abcdef",
+		notice: "アカウント名かパスワードが間違っています",
+	}
+}
+
+func TestTemplateGolden(t *testing.T) {
+	f := newTemplateFixture()
+
+	tests := []struct {
+		name string
+		tmpl *template.Template
+		data interface{}
+	}{
+		{
+			name: "login",
+			tmpl: loginTemp,
+			data: struct {
+				Me    User
+				Flash string
+			}{User{}, f.notice},
+		},
+		{
+			name: "register",
+			tmpl: registerTemp,
+			data: struct {
+				Me    User
+				Flash string
+			}{User{}, ""},
+		},
+		{
+			name: "index",
+			tmpl: indexTemp,
+			data: struct {
+				Posts     []Post
+				Me        User
+				CSRFToken string
+				Flash     string
+			}{f.posts, f.alice, f.csrf, "画像が必須です"},
+		},
+		{
+			name: "index_logged_out",
+			tmpl: indexTemp,
+			data: struct {
+				Posts     []Post
+				Me        User
+				CSRFToken string
+				Flash     string
+			}{f.posts, User{}, "", ""},
+		},
+		{
+			name: "index_admin",
+			tmpl: indexTemp,
+			data: struct {
+				Posts     []Post
+				Me        User
+				CSRFToken string
+				Flash     string
+			}{f.posts[:1], f.admin, f.csrf, ""},
+		},
+		{
+			name: "posts",
+			tmpl: postsTemp,
+			data: f.posts,
+		},
+		{
+			name: "post_id",
+			tmpl: postsIDTemp,
+			data: struct {
+				Post Post
+				Me   User
+			}{f.posts[0], f.bob},
+		},
+		{
+			name: "user",
+			tmpl: accountNameTemp,
+			data: struct {
+				Posts          []Post
+				User           User
+				PostCount      int
+				CommentCount   int
+				CommentedCount int
+				Me             User
+			}{[]Post{f.posts[0], f.posts[2]}, f.alice, 2, 1, 5, User{}},
+		},
+		{
+			name: "banned",
+			tmpl: bannedTemp,
+			data: struct {
+				Users     []User
+				Me        User
+				CSRFToken string
+			}{f.users, f.admin, f.csrf},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			err := tt.tmpl.Execute(buf, tt.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := normalizeHTML(buf.String())
+
+			golden := filepath.Join("testdata", "golden", tt.name+".html")
+			if *update {
+				err := os.MkdirAll(filepath.Dir(golden), 0o755)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = os.WriteFile(golden, []byte(got), 0o644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("%s (run with -update to create it)", err)
+			}
+			if got != string(want) {
+				t.Errorf("%s does not match the rendered DOM (run with -update if the change is intended)\n%s", golden, lineDiff(string(want), got))
+			}
+		})
+	}
+}
+
+// lineDiff 最初に異なる行を前後の行と一緒に示す
+func lineDiff(want, got string) string {
+	wl := strings.Split(want, "\n")
+	gl := strings.Split(got, "\n")
+
+	i := 0
+	for i < len(wl) && i < len(gl) && wl[i] == gl[i] {
+		i++
+	}
+
+	line := func(lines []string, n int) string {
+		if n < len(lines) {
+			return lines[n]
+		}
+		return "<EOF>"
+	}
+
+	b := &strings.Builder{}
+	if i > 0 {
+		b.WriteString("  " + line(wl, i-1) + "\n")
+	}
+	b.WriteString("- " + line(wl, i) + "\n")
+	b.WriteString("+ " + line(gl, i) + "\n")
+
+	return b.String()
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/catatsuy/private-isu/webapp/golang/repository"
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	// tokenPrefix 個人用アクセストークンの先頭に付ける文字列(漏れたときに見つけやすくするため)
+	tokenPrefix = "isup_"
+	// tokenNameMaxLength トークンの名前の最大文字数
+	tokenNameMaxLength = 64
+)
+
+type ctxKey int
+
+// tokenUserKey トークンで認証したユーザーをcontextに入れるキー
+const tokenUserKey ctxKey = iota
+
+type apiToken struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	// Token 作成したときだけ返す
+	Token string `json:"token,omitempty"`
+}
+
+func toAPIToken(t repository.Token) apiToken {
+	return apiToken{
+		ID:        t.ID,
+		Name:      t.Name,
+		CreatedAt: t.CreatedAt,
+	}
+}
+
+// hashToken DBに保存するトークンのハッシュ値
+//
+//	トークンは十分に長いランダムな文字列なので、saltもストレッチングも使いません
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken Authorization: Bearer ヘッダのトークンを取り出す
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// tokenUser トークンで認証したユーザーを取得する
+func tokenUser(r *http.Request) (User, bool) {
+	u, ok := r.Context().Value(tokenUserKey).(User)
+	return u, ok
+}
+
+// tokenAuth Authorization: Bearer ヘッダのトークンをユーザーに解決してcontextに入れる
+//
+//	ヘッダが無いリクエストはそのままセッションでの認証に任せます
+//	トークンが無効、またはBANされたユーザーのトークンなら401を返します
+func tokenAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := bearerToken(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		t, err := tokenRepo.FindByHash(hashToken(token))
+		if errors.Is(err, repository.ErrNotFound) {
+			writeInvalidToken(w)
+			return
+		}
+		if err != nil {
+			writeAPIServerError(w, err)
+			return
+		}
+
+		u, err := userRepo.FindByID(t.UserID)
+		if errors.Is(err, repository.ErrNotFound) || (err == nil && u.DelFlg != 0) {
+			writeInvalidToken(w)
+			return
+		}
+		if err != nil {
+			writeAPIServerError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenUserKey, u)))
+	})
+}
+
+func writeInvalidToken(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+	writeAPIError(w, http.StatusUnauthorized, "invalid_token", "トークンが正しくありません")
+}
+
+func apiGetTokens(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuth(w, r, false)
+	if !ok {
+		return
+	}
+
+	tokens, err := tokenRepo.ListByUser(me.ID)
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	ts := make([]apiToken, 0, len(tokens))
+	for _, t := range tokens {
+		ts = append(ts, toAPIToken(t))
+	}
+
+	writeJSON(w, http.StatusOK, struct {
+		Tokens []apiToken `json:"tokens"`
+	}{ts})
+}
+
+// apiPostTokens トークンを作成する
+//
+//	bodyは {"name": "..."} のJSONかnameフォームで送ります
+//	トークンそのものはこのレスポンスでしか返さないので、利用者が控えておく必要があります
+func apiPostTokens(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuth(w, r, true)
+	if !ok {
+		return
+	}
+
+	req := struct {
+		Name string `json:"name"`
+	}{}
+	if isJSONRequest(r) {
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, "invalid_body", "JSONが正しくありません")
+			return
+		}
+	} else {
+		req.Name = r.FormValue("name")
+	}
+
+	n := utf8.RuneCountInString(req.Name)
+	if n == 0 || n > tokenNameMaxLength {
+		writeAPIError(w, http.StatusBadRequest, "invalid_parameter", "nameは1文字以上"+strconv.Itoa(tokenNameMaxLength)+"文字以下にしてください")
+		return
+	}
+
+	token := tokenPrefix + secureRandomStr(32)
+	t, err := tokenRepo.Create(me.ID, req.Name, hashToken(token))
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	res := toAPIToken(t)
+	res.Token = token
+	writeJSON(w, http.StatusCreated, res)
+}
+
+func apiDeleteToken(w http.ResponseWriter, r *http.Request) {
+	me, ok := apiAuth(w, r, true)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err == nil {
+		err = tokenRepo.Revoke(me.ID, id)
+	} else {
+		err = repository.ErrNotFound
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		writeAPIError(w, http.StatusNotFound, "not_found", "トークンが見つかりません")
+		return
+	}
+	if err != nil {
+		writeAPIServerError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}